@@ -2,6 +2,8 @@ package algorithms
 
 import (
 	"context"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -108,6 +110,26 @@ func BenchmarkTokenBucketMultipleUsers(b *testing.B) {
 	}
 }
 
+func BenchmarkGCRAAllow(b *testing.B) {
+	s := store.NewMemoryStore()
+	g := NewGCRA(100, 1*time.Second, 100, s)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.Allow(ctx, "user1")
+	}
+}
+
+func BenchmarkGCRAMultipleUsers(b *testing.B) {
+	s := store.NewMemoryStore()
+	g := NewGCRA(100, 1*time.Second, 100, s)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.Allow(ctx, "user"+string(rune(i%1000)))
+	}
+}
+
 func BenchmarkFixedWindowConcurrent(b *testing.B) {
 	s := store.NewMemoryStore()
 	fw := NewFixedWindow(10000, 1*time.Second, s)
@@ -162,3 +184,149 @@ func BenchmarkTokenBucketConcurrent(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkGCRAConcurrent(b *testing.B) {
+	s := store.NewMemoryStore()
+	g := NewGCRA(10000, 1*time.Second, 10000, s)
+	ctx := context.Background()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			g.Allow(ctx, "user1")
+		}
+	})
+}
+
+// slowStore adds a fixed latency to every call, like the network round trip
+// to Redis or a database.
+type slowStore struct {
+	store.Store
+	latency time.Duration
+}
+
+func (s *slowStore) Get(ctx context.Context, key string) (interface{}, error) {
+	time.Sleep(s.latency)
+	return s.Store.Get(ctx, key)
+}
+
+func (s *slowStore) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	time.Sleep(s.latency)
+	return s.Store.Set(ctx, key, value, ttl)
+}
+
+// benchmarkSlowStore runs Allow from many goroutines at once against a store
+// with 200µs of latency, spreading the requests over keys distinct keys.
+// Requests only wait on each other when they share a key, so throughput
+// grows with the number of keys.
+func benchmarkSlowStore(b *testing.B, newLimiter func(s store.Store) RateLimiter, keys int) {
+	s := &slowStore{Store: store.NewMemoryStore(), latency: 200 * time.Microsecond}
+	limiter := newLimiter(s)
+	ctx := context.Background()
+	var next atomic.Int64
+	b.SetParallelism(32)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := next.Add(1) % int64(keys)
+			limiter.Allow(ctx, "user"+strconv.FormatInt(i, 10))
+		}
+	})
+}
+
+func BenchmarkTokenBucketSlowStoreOneKey(b *testing.B) {
+	benchmarkSlowStore(b, func(s store.Store) RateLimiter { return NewTokenBucket(100, 10, s) }, 1)
+}
+
+func BenchmarkTokenBucketSlowStoreManyKeys(b *testing.B) {
+	benchmarkSlowStore(b, func(s store.Store) RateLimiter { return NewTokenBucket(100, 10, s) }, 10000)
+}
+
+func BenchmarkLeakyBucketSlowStoreManyKeys(b *testing.B) {
+	benchmarkSlowStore(b, func(s store.Store) RateLimiter { return NewLeakyBucket(100, 10, s) }, 10000)
+}
+
+func BenchmarkFixedWindowSlowStoreManyKeys(b *testing.B) {
+	benchmarkSlowStore(b, func(s store.Store) RateLimiter { return NewFixedWindow(100, 1*time.Second, s) }, 10000)
+}
+
+func BenchmarkSlidingWindowSlowStoreManyKeys(b *testing.B) {
+	benchmarkSlowStore(b, func(s store.Store) RateLimiter { return NewSlidingWindow(100, 1*time.Second, s) }, 10000)
+}
+
+func BenchmarkSlidingWindowCounterSlowStoreManyKeys(b *testing.B) {
+	benchmarkSlowStore(b, func(s store.Store) RateLimiter { return NewSlidingWindowCounter(100, 1*time.Second, s) }, 10000)
+}
+
+func BenchmarkGCRASlowStoreManyKeys(b *testing.B) {
+	benchmarkSlowStore(b, func(s store.Store) RateLimiter { return NewGCRA(100, 1*time.Second, 100, s) }, 10000)
+}
+
+// slowBatchStore is a slowStore whose batch calls cost one round trip each.
+type slowBatchStore struct {
+	slowStore
+}
+
+func (s *slowBatchStore) GetMany(ctx context.Context, keys []string) ([]interface{}, error) {
+	time.Sleep(s.latency)
+	return s.Store.(store.Batcher).GetMany(ctx, keys)
+}
+
+func (s *slowBatchStore) SetMany(ctx context.Context, entries []store.Entry) error {
+	time.Sleep(s.latency)
+	return s.Store.(store.Batcher).SetMany(ctx, entries)
+}
+
+// benchmarkBatch checks a batch of 500 events against a store with 200µs of
+// latency, with AllowMany or with one Allow call per event.
+func benchmarkBatch(b *testing.B, batched bool) {
+	s := &slowBatchStore{slowStore{Store: store.NewMemoryStore(), latency: 200 * time.Microsecond}}
+	tb := NewTokenBucket(100, 10, s)
+	ctx := context.Background()
+	keys := make([]string, 500)
+	for i := range keys {
+		keys[i] = "user" + strconv.Itoa(i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if batched {
+			tb.AllowMany(ctx, keys)
+			continue
+		}
+		for _, key := range keys {
+			tb.Allow(ctx, key)
+		}
+	}
+}
+
+func BenchmarkBatchAllowEach(b *testing.B) {
+	benchmarkBatch(b, false)
+}
+
+func BenchmarkBatchAllowMany(b *testing.B) {
+	benchmarkBatch(b, true)
+}
+
+func benchmarkBoundedStore(b *testing.B, eviction store.EvictionPolicy) {
+	s := store.NewMemoryStoreWithOptions(store.MemoryOptions{MaxEntries: 1000, Eviction: eviction})
+	defer s.Close()
+	tb := NewTokenBucket(100, 10, s)
+	ctx := context.Background()
+	var n atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			// Twice as many keys as the store holds, so it keeps evicting
+			tb.Allow(ctx, "user"+strconv.FormatInt(n.Add(1)%2000, 10))
+		}
+	})
+}
+
+func BenchmarkBoundedStoreLRU(b *testing.B) {
+	benchmarkBoundedStore(b, store.EvictLRU)
+}
+
+func BenchmarkBoundedStoreLFU(b *testing.B) {
+	benchmarkBoundedStore(b, store.EvictLFU)
+}
+
+func BenchmarkBoundedStoreEarliestExpiry(b *testing.B) {
+	benchmarkBoundedStore(b, store.EvictEarliestExpiry)
+}
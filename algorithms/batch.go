@@ -0,0 +1,63 @@
+package algorithms
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+// allowMany decides one request for each of keys with reserve, holding the
+// locks of every key for the whole batch. The state is updated with
+// store.Typed's UpdateMany, in one atomic step when the store is a
+// store.BatchUpdater.
+func allowMany[T any](ctx context.Context, s *store.Typed[T], locks *keyLocks, keys []string, reserve func(bucket *T, n int, now time.Time, maxDelay time.Duration) (*T, time.Duration, *Reservation)) ([]Result, error) {
+	unlock := locks.lockMany(keys)
+	defer unlock()
+
+	now := time.Now()
+	results := make([]Result, len(keys))
+	err := s.UpdateMany(ctx, keys, func(i int, bucket *T) (*T, time.Duration, error) {
+		next, ttl, res := reserve(bucket, 1, now, 0)
+		results[i] = res.result()
+		return next, ttl, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update bucket state: %w", err)
+	}
+	return results, nil
+}
+
+// allowManyRedis runs one "reserve" call of script for each key in a single
+// pipeline, and turns the replies into results.
+func allowManyRedis(ctx context.Context, s *store.RedisStore, script *store.Script, limit int, calls []store.ScriptCall) ([]Result, error) {
+	now := time.Now()
+	vals, err := s.EvalMany(ctx, script, calls)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Result, len(vals))
+	for i, val := range vals {
+		reply, err := parseRedisReply(val)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = reply.reservation(limit, now, nil).result()
+	}
+	return results, nil
+}
+
+// allowEach checks a request for each of keys with its own Allow call, for
+// limiters and fallbacks that cannot batch.
+func allowEach(ctx context.Context, l RateLimiter, keys []string) ([]Result, error) {
+	results := make([]Result, len(keys))
+	for i, key := range keys {
+		r, err := l.Allow(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = r
+	}
+	return results, nil
+}
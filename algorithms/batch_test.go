@@ -0,0 +1,258 @@
+package algorithms
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+// batchKeys repeats some keys, so that later requests in the batch must see
+// the state left by earlier ones.
+var batchKeys = []string{"a", "b", "a", "a", "a", "c", "b"}
+
+// countingStore is a MemoryStore that counts the calls limiters make to it.
+type countingStore struct {
+	*store.MemoryStore
+	single atomic.Int64 // Get, Set and Update
+	gets   atomic.Int64
+	sets   atomic.Int64
+	many   atomic.Int64 // UpdateMany
+}
+
+func (s *countingStore) Get(ctx context.Context, key string) (interface{}, error) {
+	s.single.Add(1)
+	return s.MemoryStore.Get(ctx, key)
+}
+
+func (s *countingStore) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	s.single.Add(1)
+	return s.MemoryStore.Set(ctx, key, value, ttl)
+}
+
+func (s *countingStore) Update(ctx context.Context, key string, fn store.UpdateFunc) error {
+	s.single.Add(1)
+	return s.MemoryStore.Update(ctx, key, fn)
+}
+
+func (s *countingStore) GetMany(ctx context.Context, keys []string) ([]interface{}, error) {
+	s.gets.Add(1)
+	return s.MemoryStore.GetMany(ctx, keys)
+}
+
+func (s *countingStore) SetMany(ctx context.Context, entries []store.Entry) error {
+	s.sets.Add(1)
+	return s.MemoryStore.SetMany(ctx, entries)
+}
+
+func (s *countingStore) UpdateMany(ctx context.Context, keys []string, fn store.UpdateManyFunc) error {
+	s.many.Add(1)
+	return s.MemoryStore.UpdateMany(ctx, keys, fn)
+}
+
+// allowedManyAcross is allowedAcross for AllowMany: each of the 10 requests
+// for the shared key is sent in a batch with a key of its own.
+func allowedManyAcross(t *testing.T, first, second RateLimiter) int {
+	t.Helper()
+	ctx := context.Background()
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		l := first
+		if i%2 == 1 {
+			l = second
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results, err := l.(BatchLimiter).AllowMany(ctx, []string{"shared", "own" + strconv.Itoa(i)})
+			if err != nil {
+				t.Errorf("AllowMany returned error: %v", err)
+				return
+			}
+			if results[0].Allowed {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	return int(allowed.Load())
+}
+
+// checkSameResults compares a batch's results with those of one Allow call
+// per key.
+func checkSameResults(t *testing.T, got, want []Result) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d results, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Allowed != want[i].Allowed || got[i].Remaining != want[i].Remaining {
+			t.Errorf("request %d for %s: got %+v, want %+v", i, batchKeys[i], got[i], want[i])
+		}
+	}
+}
+
+func TestAllowManyMatchesAllow(t *testing.T) {
+	stores := map[string]func(t *testing.T) store.Store{
+		"memory": func(t *testing.T) store.Store {
+			s := store.NewMemoryStore()
+			t.Cleanup(s.Close)
+			return s
+		},
+		"redis": func(t *testing.T) store.Store {
+			return newTestRedisStore(t)
+		},
+		"sqlite": func(t *testing.T) store.Store {
+			s := newSQLiteStore(t, newSQLite(t), store.DatabaseOptions{})
+			return s
+		},
+	}
+
+	for storeName, newStore := range stores {
+		for name, newLimiter := range rateLimiters() {
+			t.Run(storeName+"/"+name, func(t *testing.T) {
+				ctx := context.Background()
+				got, err := newLimiter(newStore(t)).(BatchLimiter).AllowMany(ctx, batchKeys)
+				if err != nil {
+					t.Fatalf("AllowMany returned error: %v", err)
+				}
+				want, err := allowEach(ctx, newLimiter(newStore(t)), batchKeys)
+				if err != nil {
+					t.Fatalf("Allow returned error: %v", err)
+				}
+				checkSameResults(t, got, want)
+			})
+		}
+	}
+}
+
+func TestAllowManyOneRoundTrip(t *testing.T) {
+	keys := make([]string, 500)
+	for i := range keys {
+		keys[i] = "event" + strconv.Itoa(i%100)
+	}
+
+	for name, newLimiter := range rateLimiters() {
+		t.Run(name, func(t *testing.T) {
+			s := &countingStore{MemoryStore: store.NewMemoryStore()}
+			defer s.Close()
+			results, err := newLimiter(s).(BatchLimiter).AllowMany(context.Background(), keys)
+			if err != nil {
+				t.Fatalf("AllowMany returned error: %v", err)
+			}
+			allowed := 0
+			for _, r := range results {
+				if r.Allowed {
+					allowed++
+				}
+			}
+			if allowed != 300 {
+				t.Errorf("got %d allowed, want 3 for each of 100 keys", allowed)
+			}
+			if s.many.Load() != 1 || s.gets.Load() != 0 || s.sets.Load() != 0 || s.single.Load() != 0 {
+				t.Errorf("got %d UpdateMany, %d GetMany, %d SetMany and %d single-key calls, want one UpdateMany only",
+					s.many.Load(), s.gets.Load(), s.sets.Load(), s.single.Load())
+			}
+		})
+	}
+}
+
+func TestStoresUpdateManyAtomically(t *testing.T) {
+	stores := map[string]func(t *testing.T) store.Store{
+		"memory": func(t *testing.T) store.Store {
+			s := store.NewMemoryStore()
+			t.Cleanup(s.Close)
+			return s
+		},
+		"redis": func(t *testing.T) store.Store { return newTestRedisStore(t) },
+		"sqlite": func(t *testing.T) store.Store {
+			s := newSQLiteStore(t, newSQLite(t), store.DatabaseOptions{})
+			return s
+		},
+	}
+	for storeName, newStore := range stores {
+		for name, newLimiter := range rateLimiters() {
+			t.Run(storeName+"/"+name, func(t *testing.T) {
+				s := newStore(t)
+				if got := allowedManyAcross(t, newLimiter(s), newLimiter(s)); got != 3 {
+					t.Errorf("got %d allowed, want exactly 3", got)
+				}
+			})
+		}
+	}
+}
+
+func TestAllowManyUpdatesEachKey(t *testing.T) {
+	// An Updater without UpdateMany gets an Update per key, which is atomic,
+	// rather than a GetMany and SetMany, which are not
+	for name, newLimiter := range rateLimiters() {
+		t.Run(name, func(t *testing.T) {
+			s := newUpdaterStore(t)
+			// Hide MemoryStore's UpdateMany, keeping GetMany and SetMany
+			shared := struct {
+				store.Store
+				store.Updater
+				store.Batcher
+			}{s, s, s}
+			if got := allowedManyAcross(t, newLimiter(shared), newLimiter(shared)); got != 3 {
+				t.Errorf("got %d allowed, want exactly 3", got)
+			}
+			if s.updates.Load() != 20 {
+				t.Errorf("got %d calls to Update, want 20", s.updates.Load())
+			}
+		})
+	}
+}
+
+func TestRedisAllowMany(t *testing.T) {
+	ctx := context.Background()
+	for name := range newRedisLimiters(nil) {
+		t.Run(name, func(t *testing.T) {
+			// The first batch also loads the script, which a new miniredis
+			// does not have yet
+			got, err := newRedisLimiters(newTestRedisStore(t))[name].AllowMany(ctx, batchKeys)
+			if err != nil {
+				t.Fatalf("AllowMany returned error: %v", err)
+			}
+			want, err := allowEach(ctx, newRedisLimiters(newTestRedisStore(t))[name], batchKeys)
+			if err != nil {
+				t.Fatalf("Allow returned error: %v", err)
+			}
+			checkSameResults(t, got, want)
+		})
+	}
+}
+
+func TestFailSafeAllowMany(t *testing.T) {
+	ctx := context.Background()
+	for _, policy := range []FailurePolicy{FailOpen, FailLocal} {
+		s := newFlakyStore()
+		limiter := NewFailSafe(NewFixedWindow(3, time.Minute, s), policy)
+		defer limiter.Close()
+		s.down.Store(true)
+
+		results, err := limiter.AllowMany(ctx, batchKeys)
+		if err != nil {
+			t.Fatalf("AllowMany returned error: %v", err)
+		}
+		allowed := 0
+		for _, r := range results {
+			if !r.Degraded {
+				t.Errorf("got %+v, want a degraded result", r)
+			}
+			if r.Allowed {
+				allowed++
+			}
+		}
+		// The local fallback denies the 4th request for "a"
+		want := map[FailurePolicy]int{FailOpen: 7, FailLocal: 6}[policy]
+		if allowed != want {
+			t.Errorf("policy %d: got %d allowed, want %d", policy, allowed, want)
+		}
+	}
+}
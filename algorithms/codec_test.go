@@ -0,0 +1,146 @@
+package algorithms
+
+import (
+	"context"
+	"encoding"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+func TestBinaryStateRoundTrip(t *testing.T) {
+	states := map[string]struct {
+		in  encoding.BinaryMarshaler
+		out encoding.BinaryUnmarshaler
+	}{
+		"token bucket":           {&Buckets{Tokens: -3, LastRefillTs: time.Unix(0, 1700000000123456789)}, &Buckets{}},
+		"leaky bucket":           {&LeakyBucketUser{Queue: 7, LastLeak: time.Unix(0, 1700000000000000001)}, &LeakyBucketUser{}},
+		"fixed window":           {&FixedWindowBucket{Count: 42, Window: 28333333}, &FixedWindowBucket{}},
+		"sliding window":         {&SlidingWindowBucket{Timestamps: []int64{1700000000000000000, 1700000000000000500, 1700000001000000000}}, &SlidingWindowBucket{}},
+		"sliding window counter": {&SlidingWindowCounterBucket{PreviousCount: 9, CurrentCount: 2, CurrentWindow: 28333334}, &SlidingWindowCounterBucket{}},
+		"gcra":                   {&GCRABucket{TAT: 1700000000987654321}, &GCRABucket{}},
+		"concurrency":            {&ConcurrencyBucket{Leases: map[string]int64{"a": 1700000000000000000, "b": 1700000005000000000}}, &ConcurrencyBucket{}},
+	}
+
+	for name, state := range states {
+		t.Run(name, func(t *testing.T) {
+			data, err := state.in.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary failed: %v", err)
+			}
+			if err := state.out.UnmarshalBinary(data); err != nil {
+				t.Fatalf("UnmarshalBinary failed: %v", err)
+			}
+			if !reflect.DeepEqual(state.in, state.out) {
+				t.Errorf("got %+v after round trip, want %+v", state.out, state.in)
+			}
+			if err := state.out.UnmarshalBinary(data[:len(data)-1]); err == nil {
+				t.Error("expected an error decoding truncated state")
+			}
+		})
+	}
+}
+
+func TestLimitersWithCodecs(t *testing.T) {
+	codecs := map[string]store.Codec{
+		"json":   store.JSONCodec{},
+		"binary": store.BinaryCodec{},
+	}
+
+	for codecName, codec := range codecs {
+		for name, newLimiter := range rateLimiters() {
+			t.Run(codecName+"/"+name, func(t *testing.T) {
+				ctx := context.Background()
+				s := newTestRedisStore(t)
+				s.SetCodec(codec)
+				limiter := newLimiter(s)
+
+				for i := 0; i < 3; i++ {
+					result, err := limiter.Allow(ctx, "user1")
+					if err != nil {
+						t.Fatalf("Allow returned error: %v", err)
+					}
+					if !result.Allowed {
+						t.Fatalf("request %d denied, want allowed", i+1)
+					}
+				}
+				result, err := limiter.Allow(ctx, "user1")
+				if err != nil {
+					t.Fatalf("Allow returned error: %v", err)
+				}
+				if result.Allowed {
+					t.Error("4th request allowed, want denied")
+				}
+			})
+		}
+	}
+}
+
+func TestCorruptStateIsAnError(t *testing.T) {
+	for name, newLimiter := range rateLimiters() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newTestRedisStore(t)
+			limiter := newLimiter(s)
+
+			if err := s.Set(ctx, "user1", []byte("not json"), time.Minute); err != nil {
+				t.Fatalf("Set failed: %v", err)
+			}
+			if _, err := limiter.Allow(ctx, "user1"); err == nil {
+				t.Error("expected an error for state that cannot be decoded")
+			}
+			if _, err := limiter.(Peeker).Peek(ctx, "user1"); err == nil {
+				t.Error("expected Peek to return an error for state that cannot be decoded")
+			}
+
+			// the corrupt state is left for inspection, not overwritten
+			data, _ := s.Get(ctx, "user1")
+			if data != "not json" {
+				t.Errorf("state was overwritten with %v", data)
+			}
+		})
+	}
+}
+
+func TestTypedStore(t *testing.T) {
+	ctx := context.Background()
+	mem := store.NewMemoryStore()
+	defer mem.Close()
+	typed := store.NewTyped[GCRABucket](mem)
+
+	bucket, err := typed.Get(ctx, "user1")
+	if err != nil || bucket != nil {
+		t.Fatalf("got %v, %v for a missing key, want nil, nil", bucket, err)
+	}
+
+	want := &GCRABucket{TAT: 42}
+	if err := typed.Set(ctx, "user1", want, time.Minute); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	bucket, err = typed.Get(ctx, "user1")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if bucket != want {
+		t.Error("MemoryStore should hand back the stored value itself")
+	}
+
+	mem.Set(ctx, "user2", &Buckets{}, time.Minute)
+	if _, err := typed.Get(ctx, "user2"); err == nil {
+		t.Error("expected an error reading state of another type")
+	}
+}
+
+// rateLimiters builds each algorithm with a limit of 3.
+func rateLimiters() map[string]func(s store.Store) RateLimiter {
+	return map[string]func(s store.Store) RateLimiter{
+		"token bucket":           func(s store.Store) RateLimiter { return NewTokenBucket(3, 1, s) },
+		"leaky bucket":           func(s store.Store) RateLimiter { return NewLeakyBucket(3, 1, s) },
+		"fixed window":           func(s store.Store) RateLimiter { return NewFixedWindow(3, time.Minute, s) },
+		"sliding window":         func(s store.Store) RateLimiter { return NewSlidingWindow(3, time.Minute, s) },
+		"sliding window counter": func(s store.Store) RateLimiter { return NewSlidingWindowCounter(3, time.Minute, s) },
+		"gcra":                   func(s store.Store) RateLimiter { return NewGCRA(3, time.Minute, 3, s) },
+	}
+}
@@ -0,0 +1,293 @@
+package algorithms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Policy is one named limit enforced by a Composite, such as "per-second"
+// or "per-day".
+type Policy struct {
+	Name    string
+	Limiter RateLimiter
+}
+
+// Composite enforces several policies on the same key at once. A request is
+// admitted only if every policy admits it; when any of them denies, none of
+// them is charged.
+//
+// Each policy keeps its state under "<name>:<key>", so the policies may share
+// one store.
+type Composite struct {
+	policies []compositePolicy
+	locks    keyLocks
+}
+
+type compositePolicy struct {
+	name    string
+	limiter RateLimiter
+	res     reserver
+	key     func(key string) string // Maps a request key to the policy's key
+	shared  bool                    // State is shared with other keys, so Reset leaves it alone
+}
+
+func NewComposite(policies ...Policy) *Composite {
+	if len(policies) == 0 {
+		panic("at least one policy is required")
+	}
+	c := &Composite{}
+	seen := map[string]bool{}
+	for _, p := range policies {
+		if p.Name == "" {
+			panic("policy name must not be empty")
+		}
+		if seen[p.Name] {
+			panic(fmt.Sprintf("duplicate policy name %q", p.Name))
+		}
+		seen[p.Name] = true
+
+		c.policies = append(c.policies, newCompositePolicy(p, prefixKey(p.Name)))
+	}
+	return c
+}
+
+func newCompositePolicy(p Policy, key func(string) string) compositePolicy {
+	res, ok := p.Limiter.(reserver)
+	if !ok {
+		panic(fmt.Sprintf("policy %q: limiter %T cannot be composed", p.Name, p.Limiter))
+	}
+	return compositePolicy{
+		name:    p.Name,
+		limiter: p.Limiter,
+		res:     res,
+		key:     key,
+	}
+}
+
+// Allow checks a request for key against every policy.
+func (c *Composite) Allow(ctx context.Context, key string) (Result, error) {
+	return c.AllowN(ctx, key, 1)
+}
+
+// AllowN checks n requests for key against every policy and charges all of
+// them, or none of them. The Result is the most restrictive one: the lowest
+// Remaining of any policy and, when denied, the longest RetryAfter along with
+// the policy it came from.
+func (c *Composite) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	res, err := c.reserveN(ctx, key, n, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return res.result(), nil
+}
+
+// AllowMany checks a request for each of keys against every policy, one key
+// at a time.
+func (c *Composite) AllowMany(ctx context.Context, keys []string) ([]Result, error) {
+	return allowEach(ctx, c, keys)
+}
+
+// Wait blocks until every policy admits a request for key.
+func (c *Composite) Wait(ctx context.Context, key string) error {
+	return c.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until every policy admits n requests for key.
+func (c *Composite) WaitN(ctx context.Context, key string, n int) error {
+	return waitN(ctx, c, key, n)
+}
+
+// Reserve books a request for key with every policy.
+func (c *Composite) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return c.ReserveN(ctx, key, 1)
+}
+
+// ReserveN books n requests for key with every policy. The reservation's
+// delay is the longest of any policy, and cancelling it hands the capacity
+// back to all of them.
+func (c *Composite) ReserveN(ctx context.Context, key string, n int) (*Reservation, error) {
+	return c.reserveN(ctx, key, n, maxWait)
+}
+
+func (c *Composite) reserveN(ctx context.Context, key string, n int, maxDelay time.Duration) (*Reservation, error) {
+	mu := c.locks.mutex(c.lockKey(key))
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	all := make([]*Reservation, 0, len(c.policies))
+	booked := make([]*Reservation, 0, len(c.policies))
+
+	// Every policy is asked even after one denies, so the caller learns the
+	// longest wait rather than the first one.
+	for _, p := range c.policies {
+		res, err := p.res.reserveN(ctx, p.key(key), n, maxDelay)
+		if err != nil {
+			if rbErr := rollback(ctx, booked); rbErr != nil {
+				return nil, fmt.Errorf("policy %s: %v (%v)", p.name, err, rbErr)
+			}
+			return nil, fmt.Errorf("policy %s: %w", p.name, err)
+		}
+		all = append(all, res)
+		if res.ok {
+			booked = append(booked, res)
+		}
+	}
+
+	ok := len(booked) == len(all)
+	if !ok {
+		if err := rollback(ctx, booked); err != nil {
+			return nil, err
+		}
+	}
+
+	var delay time.Duration
+	var deniedBy string
+	var degraded bool
+	limit, remaining := 0, -1
+	for i, res := range all {
+		if res.delay > delay {
+			delay = res.delay
+			deniedBy = c.policies[i].name
+		}
+		degraded = degraded || res.degraded
+		if res.degraded && res.limit == 0 {
+			// A failure policy deciding without the store does not know
+			// the quota
+			continue
+		}
+		left := res.remaining
+		if res.ok && !ok {
+			// Rolled back, so this request was never charged after all
+			left = min(left+n, res.limit)
+		}
+		if remaining < 0 || left < remaining {
+			limit, remaining = res.limit, left
+		}
+	}
+
+	combined := newReservation(limit, now, delay, maxDelay)
+	combined.ok = ok
+	combined.remaining = max(remaining, 0)
+	combined.deniedBy = deniedBy
+	combined.degraded = degraded
+	if ok {
+		combined.cancel = func(ctx context.Context) error {
+			return rollback(ctx, booked)
+		}
+	}
+	return combined, nil
+}
+
+// Peek reports whether every policy would admit a request for key right now,
+// without charging any of them. Policies whose limiter cannot peek are
+// skipped.
+func (c *Composite) Peek(ctx context.Context, key string) (Result, error) {
+	mu := c.locks.mutex(c.lockKey(key))
+	mu.Lock()
+	defer mu.Unlock()
+
+	out := Result{Allowed: true}
+	first := true
+	for _, p := range c.policies {
+		peeker, ok := p.limiter.(Peeker)
+		if !ok {
+			continue
+		}
+		r, err := peeker.Peek(ctx, p.key(key))
+		if err != nil {
+			return Result{}, fmt.Errorf("policy %s: %w", p.name, err)
+		}
+		// A failure policy deciding without the store does not know the quota
+		known := !r.Degraded || r.Limit > 0
+		out.Degraded = out.Degraded || r.Degraded
+		if known && (first || r.Remaining < out.Remaining) {
+			out.Limit = r.Limit
+			out.Remaining = r.Remaining
+			first = false
+		}
+		if !r.Allowed {
+			out.Allowed = false
+		}
+		if r.RetryAfter > out.RetryAfter {
+			out.RetryAfter = r.RetryAfter
+			out.DeniedBy = p.name
+		}
+	}
+	return out, nil
+}
+
+// Reset clears key's state in every policy, except for pools shared with
+// other keys. It fails only if none of the policies had any state for key.
+func (c *Composite) Reset(ctx context.Context, key string) error {
+	mu := c.locks.mutex(c.lockKey(key))
+	mu.Lock()
+	defer mu.Unlock()
+
+	var errs []error
+	reset := 0
+	for _, p := range c.policies {
+		if p.shared {
+			continue
+		}
+		reset++
+		if err := p.limiter.Reset(ctx, p.key(key)); err != nil {
+			errs = append(errs, fmt.Errorf("policy %s: %w", p.name, err))
+		}
+	}
+	if len(errs) == reset {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// ResetPrefix clears every key starting with prefix in every policy, except
+// for pools shared with other keys.
+func (c *Composite) ResetPrefix(ctx context.Context, prefix string) error {
+	for _, p := range c.policies {
+		if p.shared {
+			continue
+		}
+		r, ok := p.limiter.(PrefixResetter)
+		if !ok {
+			return fmt.Errorf("policy %s: limiter %T cannot reset a prefix", p.name, p.limiter)
+		}
+		if err := r.ResetPrefix(ctx, p.key(prefix)); err != nil {
+			return fmt.Errorf("policy %s: %w", p.name, err)
+		}
+	}
+	return nil
+}
+
+// lockKey is the key requests are serialized on. When a policy's state is
+// shared with other keys, such as a hierarchy's parent pool, its key is used
+// instead, so that requests drawing on the same pool are checked one at a
+// time and cannot crowd each other out between charge and rollback.
+func (c *Composite) lockKey(key string) string {
+	for _, p := range c.policies {
+		if p.shared {
+			return p.key(key)
+		}
+	}
+	return key
+}
+
+// prefixKey keeps a policy's state under "<name>:<key>".
+func prefixKey(name string) func(string) string {
+	return func(key string) string {
+		return name + ":" + key
+	}
+}
+
+// rollback refunds every reservation in booked.
+func rollback(ctx context.Context, booked []*Reservation) error {
+	var errs []error
+	for _, res := range booked {
+		if err := res.refund(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
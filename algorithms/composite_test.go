@@ -0,0 +1,143 @@
+package algorithms
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+func newTestComposite(s store.Store) *Composite {
+	return NewComposite(
+		Policy{Name: "per-second", Limiter: NewTokenBucket(5, 1, s)},
+		Policy{Name: "per-minute", Limiter: NewFixedWindow(3, time.Minute, s)},
+	)
+}
+
+func TestCompositeAllow(t *testing.T) {
+	ctx := context.Background()
+	c := newTestComposite(store.NewMemoryStore())
+
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		result, err := c.Allow(ctx, "user1")
+		if err == nil && result.Allowed {
+			allowed++
+		}
+	}
+
+	// The per-minute policy is the tighter of the two
+	if allowed != 3 {
+		t.Errorf("got %d allowed, want 3", allowed)
+	}
+}
+
+func TestCompositeDeniedChargesNothing(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	tb := NewTokenBucket(5, 1, s)
+	fw := NewFixedWindow(3, time.Minute, s)
+	c := NewComposite(
+		Policy{Name: "per-second", Limiter: tb},
+		Policy{Name: "per-minute", Limiter: fw},
+	)
+
+	for i := 0; i < 3; i++ {
+		c.Allow(ctx, "user1")
+	}
+	result, err := c.Allow(ctx, "user1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Allowed {
+		t.Fatal("request over the per-minute limit should be denied")
+	}
+	if result.DeniedBy != "per-minute" {
+		t.Errorf("DeniedBy = %q, want per-minute", result.DeniedBy)
+	}
+	if result.RetryAfter <= 0 {
+		t.Errorf("expected RetryAfter > 0, got %v", result.RetryAfter)
+	}
+
+	// The token bucket admitted the denied request, but must have been
+	// refunded
+	bucket, _ := tb.Inspect(ctx, "per-second:user1")
+	if bucket.Tokens != 2 {
+		t.Errorf("token bucket has %d tokens, want 2", bucket.Tokens)
+	}
+}
+
+func TestCompositeMostRestrictiveResult(t *testing.T) {
+	ctx := context.Background()
+	c := newTestComposite(store.NewMemoryStore())
+
+	result, err := c.Allow(ctx, "user1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Limit != 3 || result.Remaining != 2 {
+		t.Errorf("got Limit %d Remaining %d, want 3 and 2", result.Limit, result.Remaining)
+	}
+
+	// Exhaust the token bucket so both policies deny; the longer wait wins
+	c.AllowN(ctx, "user1", 2)
+	result, _ = c.AllowN(ctx, "user1", 3)
+	if result.Allowed {
+		t.Fatal("expected denial")
+	}
+	if result.DeniedBy != "per-minute" {
+		t.Errorf("DeniedBy = %q, want the policy with the longest wait", result.DeniedBy)
+	}
+}
+
+func TestCompositePolicyError(t *testing.T) {
+	ctx := context.Background()
+	c := newTestComposite(store.NewMemoryStore())
+
+	// 4 fits the token bucket but can never fit the fixed window
+	if _, err := c.AllowN(ctx, "user1", 4); err == nil {
+		t.Fatal("expected error for n over a policy's limit")
+	}
+	result, _ := c.Peek(ctx, "user1")
+	if result.Remaining != 3 {
+		t.Errorf("failed request was charged, Remaining = %d", result.Remaining)
+	}
+}
+
+func TestCompositeReset(t *testing.T) {
+	ctx := context.Background()
+	c := newTestComposite(store.NewMemoryStore())
+
+	for i := 0; i < 3; i++ {
+		c.Allow(ctx, "user1")
+	}
+	if err := c.Reset(ctx, "user1"); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	result, _ := c.Allow(ctx, "user1")
+	if !result.Allowed {
+		t.Error("request after reset should be allowed")
+	}
+
+	if err := c.Reset(ctx, "nobody"); err == nil {
+		t.Error("expected error resetting a key no policy has seen")
+	}
+}
+
+func TestCompositeNesting(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	inner := newTestComposite(s)
+	c := NewComposite(
+		Policy{Name: "limits", Limiter: inner},
+		Policy{Name: "per-day", Limiter: NewSlidingWindow(2, 24*time.Hour, s)},
+	)
+
+	c.Allow(ctx, "user1")
+	c.Allow(ctx, "user1")
+	result, _ := c.Allow(ctx, "user1")
+	if result.Allowed || result.DeniedBy != "per-day" {
+		t.Errorf("got %+v, want denial by per-day", result)
+	}
+}
@@ -0,0 +1,237 @@
+package algorithms
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+// ConcurrencyBucket stores the leases currently held for a user, mapping
+// each lease ID to its expiry in Unix nanoseconds.
+type ConcurrencyBucket struct {
+	Leases map[string]int64
+}
+
+// ConcurrencyLimiter caps how many requests per key may be in flight at
+// once. Unlike the rate limiters it does not care how fast requests arrive,
+// only how many are still running.
+type ConcurrencyLimiter struct {
+	Limit    int           // Max leases held at once
+	LeaseTTL time.Duration // How long a lease is held if never released
+	store    store.Store
+	state    *store.Typed[ConcurrencyBucket]
+	locks    keyLocks
+}
+
+// Lease is a slot held by an in-flight request. It must be released when
+// the request finishes; otherwise it expires after the limiter's LeaseTTL.
+type Lease struct {
+	ID        string
+	Key       string
+	ExpiresAt time.Time
+	limiter   *ConcurrencyLimiter
+}
+
+func NewConcurrencyLimiter(limit int, leaseTTL time.Duration, s store.Store) *ConcurrencyLimiter {
+	if limit <= 0 {
+		panic("limit must be greater than 0")
+	}
+	if leaseTTL <= 0 {
+		panic("leaseTTL must be greater than 0")
+	}
+	return &ConcurrencyLimiter{
+		Limit:    limit,
+		LeaseTTL: leaseTTL,
+		store:    s,
+		state:    store.NewTyped[ConcurrencyBucket](s),
+	}
+}
+
+// Acquire takes a slot for key if fewer than Limit leases are held. The
+// lease is nil when the request is denied, in which case RetryAfter is how
+// long until the oldest lease expires.
+func (cl *ConcurrencyLimiter) Acquire(ctx context.Context, key string) (*Lease, Result, error) {
+	mu := cl.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	id, err := newLeaseID()
+	if err != nil {
+		return nil, Result{}, err
+	}
+	now := time.Now()
+	nowNanos := now.UnixNano()
+	expiresAt := now.Add(cl.LeaseTTL)
+
+	var result Result
+	err = update(ctx, cl.state, key, func(bucket *ConcurrencyBucket) (*ConcurrencyBucket, time.Duration, error) {
+		bucket = cl.orEmpty(bucket)
+		cl.expire(bucket, nowNanos)
+
+		if len(bucket.Leases) >= cl.Limit {
+			result = Result{
+				Allowed:    false,
+				Limit:      cl.Limit,
+				Remaining:  0,
+				RetryAfter: time.Duration(cl.earliestExpiry(bucket) - nowNanos),
+			}
+			return nil, 0, nil
+		}
+
+		bucket.Leases[id] = expiresAt.UnixNano()
+		result = Result{
+			Allowed:    true,
+			Limit:      cl.Limit,
+			Remaining:  cl.Limit - len(bucket.Leases),
+			RetryAfter: 0,
+		}
+		return bucket, cl.ttl(bucket, nowNanos), nil
+	})
+	if err != nil {
+		return nil, Result{}, err
+	}
+	if !result.Allowed {
+		return nil, result, nil
+	}
+	lease := &Lease{
+		ID:        id,
+		Key:       key,
+		ExpiresAt: expiresAt,
+		limiter:   cl,
+	}
+	return lease, result, nil
+}
+
+// Release frees the lease's slot. Releasing a lease that has already been
+// released or has expired does nothing.
+func (l *Lease) Release(ctx context.Context) error {
+	cl := l.limiter
+	mu := cl.locks.mutex(l.Key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	nowNanos := time.Now().UnixNano()
+	return update(ctx, cl.state, l.Key, func(bucket *ConcurrencyBucket) (*ConcurrencyBucket, time.Duration, error) {
+		if bucket == nil {
+			return nil, 0, nil
+		}
+		bucket = cl.orEmpty(bucket)
+		if _, held := bucket.Leases[l.ID]; !held {
+			return nil, 0, nil
+		}
+		delete(bucket.Leases, l.ID)
+		cl.expire(bucket, nowNanos)
+		return bucket, cl.ttl(bucket, nowNanos), nil
+	})
+}
+
+// Renew extends the lease by another LeaseTTL, for requests that run longer
+// than expected. It fails if the lease has already expired.
+func (l *Lease) Renew(ctx context.Context) error {
+	cl := l.limiter
+	mu := cl.locks.mutex(l.Key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	nowNanos := now.UnixNano()
+	expiresAt := now.Add(cl.LeaseTTL)
+
+	var held bool
+	err := update(ctx, cl.state, l.Key, func(bucket *ConcurrencyBucket) (*ConcurrencyBucket, time.Duration, error) {
+		bucket = cl.orEmpty(bucket)
+		cl.expire(bucket, nowNanos)
+		if _, held = bucket.Leases[l.ID]; !held {
+			return nil, 0, nil
+		}
+		bucket.Leases[l.ID] = expiresAt.UnixNano()
+		return bucket, cl.ttl(bucket, nowNanos), nil
+	})
+	if err != nil {
+		return err
+	}
+	if !held {
+		return fmt.Errorf("lease %s for key %s is no longer held", l.ID, l.Key)
+	}
+	l.ExpiresAt = expiresAt
+	return nil
+}
+
+// Reset drops every lease held for key.
+func (cl *ConcurrencyLimiter) Reset(ctx context.Context, key string) error {
+	mu := cl.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	exists, err := cl.store.Exists(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket for key %s does not exist", key)
+	}
+
+	return cl.store.Delete(ctx, key)
+}
+
+// ResetPrefix drops the leases of every key starting with prefix.
+func (cl *ConcurrencyLimiter) ResetPrefix(ctx context.Context, prefix string) error {
+	return resetPrefix(ctx, cl.store, &cl.locks, prefix)
+}
+
+// orEmpty gives a key with no state, or state with no lease map, an empty
+// set of leases.
+func (cl *ConcurrencyLimiter) orEmpty(bucket *ConcurrencyBucket) *ConcurrencyBucket {
+	if bucket == nil {
+		bucket = &ConcurrencyBucket{}
+	}
+	if bucket.Leases == nil {
+		bucket.Leases = map[string]int64{}
+	}
+	return bucket
+}
+
+// expire drops leases whose holders never released them, so a crashed
+// holder cannot keep a slot forever.
+func (cl *ConcurrencyLimiter) expire(bucket *ConcurrencyBucket, nowNanos int64) {
+	for id, expiresAt := range bucket.Leases {
+		if expiresAt <= nowNanos {
+			delete(bucket.Leases, id)
+		}
+	}
+}
+
+func (cl *ConcurrencyLimiter) earliestExpiry(bucket *ConcurrencyBucket) int64 {
+	var earliest int64
+	for _, expiresAt := range bucket.Leases {
+		if earliest == 0 || expiresAt < earliest {
+			earliest = expiresAt
+		}
+	}
+	return earliest
+}
+
+// ttl keeps the state until the last lease expires. With no leases left it
+// behaves the same as no state, so it is only kept briefly.
+func (cl *ConcurrencyLimiter) ttl(bucket *ConcurrencyBucket, nowNanos int64) time.Duration {
+	if len(bucket.Leases) == 0 {
+		return time.Millisecond
+	}
+	var latest int64
+	for _, expiresAt := range bucket.Leases {
+		latest = max(latest, expiresAt)
+	}
+	return time.Duration(latest - nowNanos)
+}
+
+func newLeaseID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate lease ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
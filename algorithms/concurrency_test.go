@@ -0,0 +1,143 @@
+package algorithms
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+func TestConcurrencyLimiterAcquire(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	cl := NewConcurrencyLimiter(2, 1*time.Minute, s)
+
+	for i := 0; i < 2; i++ {
+		lease, result, err := cl.Acquire(ctx, "user1")
+		if err != nil || lease == nil || !result.Allowed {
+			t.Fatalf("acquire %d should succeed", i+1)
+		}
+		if result.Remaining != 1-i {
+			t.Errorf("remaining: got %d, want %d", result.Remaining, 1-i)
+		}
+	}
+
+	lease, result, err := cl.Acquire(ctx, "user1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lease != nil || result.Allowed {
+		t.Error("third acquire should be denied")
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > 1*time.Minute {
+		t.Errorf("RetryAfter: got %v, want up to the lease TTL", result.RetryAfter)
+	}
+
+	// Other keys have their own slots
+	if lease, _, _ := cl.Acquire(ctx, "user2"); lease == nil {
+		t.Error("user2 should not be limited")
+	}
+}
+
+func TestConcurrencyLimiterRelease(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	cl := NewConcurrencyLimiter(1, 1*time.Minute, s)
+
+	lease, _, _ := cl.Acquire(ctx, "user1")
+	if lease == nil {
+		t.Fatal("first acquire should succeed")
+	}
+	if second, _, _ := cl.Acquire(ctx, "user1"); second != nil {
+		t.Fatal("second acquire should be denied")
+	}
+
+	if err := lease.Release(ctx); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	if err := lease.Release(ctx); err != nil {
+		t.Fatalf("second release should be a no-op, got %v", err)
+	}
+
+	if second, _, _ := cl.Acquire(ctx, "user1"); second == nil {
+		t.Error("acquire after release should succeed")
+	}
+}
+
+func TestConcurrencyLimiterLeaseExpiry(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	cl := NewConcurrencyLimiter(1, 100*time.Millisecond, s)
+
+	// Holder never releases, as if it crashed
+	lease, _, _ := cl.Acquire(ctx, "user1")
+	if lease == nil {
+		t.Fatal("first acquire should succeed")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if second, _, _ := cl.Acquire(ctx, "user1"); second == nil {
+		t.Error("acquire after lease expiry should succeed")
+	}
+	if err := lease.Renew(ctx); err == nil {
+		t.Error("renewing an expired lease should fail")
+	}
+}
+
+func TestConcurrencyLimiterRenew(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	cl := NewConcurrencyLimiter(1, 100*time.Millisecond, s)
+
+	lease, _, _ := cl.Acquire(ctx, "user1")
+	time.Sleep(60 * time.Millisecond)
+	if err := lease.Renew(ctx); err != nil {
+		t.Fatalf("renew failed: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	if second, _, _ := cl.Acquire(ctx, "user1"); second != nil {
+		t.Error("renewed lease should still hold the slot")
+	}
+}
+
+func TestConcurrencyLimiterParallel(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	cl := NewConcurrencyLimiter(5, 1*time.Minute, s)
+
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				lease, _, err := cl.Acquire(ctx, "user1")
+				if err != nil || lease == nil {
+					continue
+				}
+				mu.Lock()
+				inFlight++
+				peak = max(peak, inFlight)
+				mu.Unlock()
+
+				time.Sleep(time.Millisecond)
+
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+				_ = lease.Release(ctx)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak > 5 {
+		t.Errorf("peak in-flight: got %d, want at most 5", peak)
+	}
+}
@@ -0,0 +1,161 @@
+package algorithms
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// newSQLite opens an in-memory SQLite database. It has a single connection,
+// since each connection to :memory: would get a database of its own.
+func newSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open SQLite: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newSQLiteStore builds a DatabaseStore on db through GORM's SQLite driver.
+func newSQLiteStore(t *testing.T, db *sql.DB, opts store.DatabaseOptions) *store.DatabaseStore {
+	t.Helper()
+	gdb, err := gorm.Open(sqlite.Dialector{Conn: db}, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open SQLite: %v", err)
+	}
+	s, err := store.NewDatabaseStoreFromDB(gdb, opts)
+	if err != nil {
+		t.Fatalf("NewDatabaseStoreFromDB returned error: %v", err)
+	}
+	return s
+}
+
+// tableExists reports whether SQLite has a table called name.
+func tableExists(t *testing.T, db *sql.DB, name string) bool {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&n); err != nil {
+		t.Fatalf("failed to query SQLite: %v", err)
+	}
+	return n > 0
+}
+
+func TestDatabaseStoreFromGORM(t *testing.T) {
+	for name, newLimiter := range rateLimiters() {
+		t.Run(name, func(t *testing.T) {
+			db, err := gorm.Open(sqlite.Dialector{Conn: newSQLite(t)}, &gorm.Config{})
+			if err != nil {
+				t.Fatalf("failed to open SQLite: %v", err)
+			}
+			s, err := store.NewDatabaseStoreFromDB(db, store.DatabaseOptions{})
+			if err != nil {
+				t.Fatalf("NewDatabaseStoreFromDB returned error: %v", err)
+			}
+
+			if got := allowedAcross(t, newLimiter(s), newLimiter(s)); got != 3 {
+				t.Errorf("got %d allowed, want 3", got)
+			}
+		})
+	}
+}
+
+func TestDatabaseStoreTableAndSchema(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLite(t)
+	s := newSQLiteStore(t, db, store.DatabaseOptions{Table: "limits", Schema: "main"})
+
+	if err := s.Set(ctx, "user1", []byte("1"), time.Minute); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if err := s.Set(ctx, "user1", []byte("2"), time.Minute); err != nil {
+		t.Fatalf("Set returned error on an existing key: %v", err)
+	}
+	if val, err := s.Get(ctx, "user1"); err != nil || val != "2" {
+		t.Errorf("got %v, %v, want the second value", val, err)
+	}
+	if !tableExists(t, db, "limits") || tableExists(t, db, "rate_limit_entries") {
+		t.Error("want the state in the limits table only")
+	}
+
+	s.Close()
+	if err := db.Ping(); err != nil {
+		t.Errorf("connection was closed with the store: %v", err)
+	}
+}
+
+func TestDatabaseStoreOwnsDialectorPool(t *testing.T) {
+	db := newSQLite(t)
+	s, err := store.NewDatabaseStore(sqlite.Dialector{Conn: db}, store.DatabaseOptions{})
+	if err != nil {
+		t.Fatalf("NewDatabaseStore returned error: %v", err)
+	}
+	if !tableExists(t, db, "rate_limit_entries") {
+		t.Error("table was not created")
+	}
+	s.Close()
+	if err := db.Ping(); err == nil {
+		t.Error("connection is still open after closing the store")
+	}
+}
+
+func TestDatabaseStoreSkipMigration(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLite(t)
+	s := newSQLiteStore(t, db, store.DatabaseOptions{SkipMigration: true})
+	if tableExists(t, db, "rate_limit_entries") {
+		t.Fatal("table was created with SkipMigration set")
+	}
+	if _, err := s.Get(ctx, "user1"); !errors.Is(err, store.ErrBackend) {
+		t.Errorf("got %v without a table, want a backend error", err)
+	}
+
+	migrations, err := store.DatabaseMigrations("sqlite", "rate_limit_entries")
+	if err != nil {
+		t.Fatalf("DatabaseMigrations returned error: %v", err)
+	}
+	for _, stmt := range migrations {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("migration %q failed: %v", stmt, err)
+		}
+	}
+	if _, err := s.Get(ctx, "user1"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("got %v after migrating, want ErrNotFound", err)
+	}
+
+	if _, err := store.DatabaseMigrations("oracle", "rate_limit_entries"); err == nil {
+		t.Error("want an error for an unsupported dialect")
+	}
+}
+
+func TestDatabaseStoreCleanupExpired(t *testing.T) {
+	ctx := context.Background()
+	db := newSQLite(t)
+	s := newSQLiteStore(t, db, store.DatabaseOptions{})
+
+	for _, key := range []string{"a", "b", "c"} {
+		s.Set(ctx, key, "1", time.Millisecond)
+	}
+	s.Set(ctx, "live", "1", time.Minute)
+	time.Sleep(5 * time.Millisecond)
+
+	if ok, err := s.Exists(ctx, "a"); err != nil || ok {
+		t.Errorf("got %v, %v for an expired key, want false", ok, err)
+	}
+	if err := s.CleanupExpired(); err != nil {
+		t.Fatalf("CleanupExpired returned error: %v", err)
+	}
+	var n int
+	db.QueryRow(`SELECT count(*) FROM rate_limit_entries`).Scan(&n)
+	if n != 1 {
+		t.Errorf("got %d rows after cleanup, want only the live one", n)
+	}
+}
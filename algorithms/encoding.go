@@ -0,0 +1,184 @@
+package algorithms
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// The binary encodings below are used by store.BinaryCodec. Numbers are
+// written as varints, so a typical bucket takes a handful of bytes instead
+// of the 40 to 60 its JSON needs.
+
+var errShortState = errors.New("state is truncated")
+
+// stateReader reads varints from encoded state, remembering the first error
+// so that decoders can check it once at the end.
+type stateReader struct {
+	data []byte
+	err  error
+}
+
+func (r *stateReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errShortState
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *stateReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errShortState
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *stateReader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if uint64(len(r.data)) < n {
+		r.err = errShortState
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// done returns the first error met, or an error if bytes are left over.
+func (r *stateReader) done() error {
+	if r.err == nil && len(r.data) > 0 {
+		return fmt.Errorf("state has %d unexpected trailing bytes", len(r.data))
+	}
+	return r.err
+}
+
+func (b *Buckets) MarshalBinary() ([]byte, error) {
+	data := binary.AppendVarint(nil, int64(b.Tokens))
+	return binary.AppendVarint(data, b.LastRefillTs.UnixNano()), nil
+}
+
+func (b *Buckets) UnmarshalBinary(data []byte) error {
+	r := stateReader{data: data}
+	b.Tokens = int(r.varint())
+	b.LastRefillTs = time.Unix(0, r.varint())
+	return r.done()
+}
+
+func (b *LeakyBucketUser) MarshalBinary() ([]byte, error) {
+	data := binary.AppendVarint(nil, int64(b.Queue))
+	return binary.AppendVarint(data, b.LastLeak.UnixNano()), nil
+}
+
+func (b *LeakyBucketUser) UnmarshalBinary(data []byte) error {
+	r := stateReader{data: data}
+	b.Queue = int(r.varint())
+	b.LastLeak = time.Unix(0, r.varint())
+	return r.done()
+}
+
+func (b *FixedWindowBucket) MarshalBinary() ([]byte, error) {
+	data := binary.AppendVarint(nil, int64(b.Count))
+	return binary.AppendVarint(data, int64(b.Window)), nil
+}
+
+func (b *FixedWindowBucket) UnmarshalBinary(data []byte) error {
+	r := stateReader{data: data}
+	b.Count = int(r.varint())
+	b.Window = int(r.varint())
+	return r.done()
+}
+
+// MarshalBinary writes the log as deltas from the previous timestamp, which
+// keeps each entry to a few bytes since the log is sorted.
+func (b *SlidingWindowBucket) MarshalBinary() ([]byte, error) {
+	data := binary.AppendUvarint(nil, uint64(len(b.Timestamps)))
+	var prev int64
+	for _, ts := range b.Timestamps {
+		data = binary.AppendVarint(data, ts-prev)
+		prev = ts
+	}
+	return data, nil
+}
+
+func (b *SlidingWindowBucket) UnmarshalBinary(data []byte) error {
+	r := stateReader{data: data}
+	n := r.uvarint()
+	if n > uint64(len(data)) {
+		return errShortState
+	}
+	b.Timestamps = make([]int64, 0, n)
+	var prev int64
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		prev += r.varint()
+		b.Timestamps = append(b.Timestamps, prev)
+	}
+	return r.done()
+}
+
+func (b *SlidingWindowCounterBucket) MarshalBinary() ([]byte, error) {
+	data := binary.AppendVarint(nil, int64(b.PreviousCount))
+	data = binary.AppendVarint(data, int64(b.CurrentCount))
+	return binary.AppendVarint(data, int64(b.CurrentWindow)), nil
+}
+
+func (b *SlidingWindowCounterBucket) UnmarshalBinary(data []byte) error {
+	r := stateReader{data: data}
+	b.PreviousCount = int(r.varint())
+	b.CurrentCount = int(r.varint())
+	b.CurrentWindow = int(r.varint())
+	return r.done()
+}
+
+func (b *GCRABucket) MarshalBinary() ([]byte, error) {
+	return binary.AppendVarint(nil, b.TAT), nil
+}
+
+func (b *GCRABucket) UnmarshalBinary(data []byte) error {
+	r := stateReader{data: data}
+	b.TAT = r.varint()
+	return r.done()
+}
+
+// MarshalBinary writes leases sorted by ID, so the same leases always
+// encode to the same bytes.
+func (b *ConcurrencyBucket) MarshalBinary() ([]byte, error) {
+	ids := slices.Sorted(maps.Keys(b.Leases))
+	data := binary.AppendUvarint(nil, uint64(len(ids)))
+	for _, id := range ids {
+		data = binary.AppendUvarint(data, uint64(len(id)))
+		data = append(data, id...)
+		data = binary.AppendVarint(data, b.Leases[id])
+	}
+	return data, nil
+}
+
+func (b *ConcurrencyBucket) UnmarshalBinary(data []byte) error {
+	r := stateReader{data: data}
+	n := r.uvarint()
+	if n > uint64(len(data)) {
+		return errShortState
+	}
+	b.Leases = make(map[string]int64, n)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		id := string(r.bytes(r.uvarint()))
+		b.Leases[id] = r.varint()
+	}
+	return r.done()
+}
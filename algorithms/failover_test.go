@@ -0,0 +1,190 @@
+package algorithms
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+// transitions records a FailoverStore's transitions.
+type transitions struct {
+	mu   sync.Mutex
+	seen []store.Transition
+}
+
+func (tr *transitions) record(t store.Transition) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.seen = append(tr.seen, t)
+}
+
+func (tr *transitions) list() []store.Transition {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return append([]store.Transition(nil), tr.seen...)
+}
+
+func TestFailoverSwitchesOver(t *testing.T) {
+	ctx := context.Background()
+	primary, fallback := newFlakyStore(), newFlakyStore()
+	f := store.NewFailoverStore(2, time.Hour, primary, fallback)
+	defer f.Close()
+	var tr transitions
+	f.OnTransition(tr.record)
+	limiter := NewFixedWindow(3, time.Minute, f)
+
+	if _, err := limiter.Allow(ctx, "user1"); err != nil {
+		t.Fatalf("Allow returned error: %v", err)
+	}
+
+	primary.down.Store(true)
+	// The first failure is returned, the second opens the circuit and the
+	// request is retried on the fallback
+	if _, err := limiter.Allow(ctx, "user1"); !errors.Is(err, store.ErrBackend) {
+		t.Fatalf("got %v, want the primary's error before the circuit opens", err)
+	}
+	result, err := limiter.Allow(ctx, "user1")
+	if err != nil {
+		t.Fatalf("Allow returned error after switch-over: %v", err)
+	}
+	if !result.Allowed || result.Remaining != 2 {
+		t.Errorf("got %+v, want the first request on the fallback", result)
+	}
+
+	if f.Active() != 1 {
+		t.Errorf("active backend is %d, want 1", f.Active())
+	}
+	seen := tr.list()
+	if len(seen) != 1 || seen[0].From != 0 || seen[0].To != 1 || !errors.Is(seen[0].Err, store.ErrBackend) {
+		t.Errorf("got transitions %+v, want one from 0 to 1 with the primary's error", seen)
+	}
+}
+
+func TestFailoverSwitchesBack(t *testing.T) {
+	ctx := context.Background()
+	primary, fallback := newFlakyStore(), newFlakyStore()
+	f := store.NewFailoverStore(1, 10*time.Millisecond, primary, fallback)
+	defer f.Close()
+	var tr transitions
+	f.OnTransition(tr.record)
+
+	primary.down.Store(true)
+	if err := f.Set(ctx, "key", "value", time.Minute); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if f.Active() != 1 {
+		t.Fatalf("active backend is %d, want 1", f.Active())
+	}
+
+	primary.down.Store(false)
+	deadline := time.Now().Add(time.Second)
+	for f.Active() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if f.Active() != 0 {
+		t.Fatal("did not switch back to the primary after it recovered")
+	}
+
+	seen := tr.list()
+	if len(seen) != 2 || seen[1].From != 1 || seen[1].To != 0 || seen[1].Err != nil {
+		t.Errorf("got transitions %+v, want a switch back from 1 to 0", seen)
+	}
+	if _, err := f.Get(ctx, "key"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("got %v, want the primary's own state, which never saw the key", err)
+	}
+}
+
+func TestFailoverAllBackendsDown(t *testing.T) {
+	ctx := context.Background()
+	primary, fallback := newFlakyStore(), newFlakyStore()
+	f := store.NewFailoverStore(1, time.Hour, primary, fallback)
+	defer f.Close()
+	var tr transitions
+	f.OnTransition(tr.record)
+
+	primary.down.Store(true)
+	fallback.down.Store(true)
+	if _, err := f.Get(ctx, "key"); !errors.Is(err, store.ErrBackend) {
+		t.Errorf("got %v, want a backend error", err)
+	}
+	if f.Active() != -1 {
+		t.Errorf("active backend is %d, want -1", f.Active())
+	}
+	if seen := tr.list(); len(seen) != 2 || seen[1].To != -1 {
+		t.Errorf("got transitions %+v, want the last one to -1", seen)
+	}
+}
+
+func TestFailoverIgnoresOtherErrors(t *testing.T) {
+	ctx := context.Background()
+	primary, fallback := newFlakyStore(), newFlakyStore()
+	f := store.NewFailoverStore(1, time.Hour, primary, fallback)
+	defer f.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := f.Get(ctx, "missing"); !errors.Is(err, store.ErrNotFound) {
+			t.Fatalf("got %v, want ErrNotFound", err)
+		}
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	f.Get(cancelled, "missing")
+
+	if f.Active() != 0 {
+		t.Errorf("active backend is %d, want the primary to stay in use", f.Active())
+	}
+}
+
+func TestFailoverPassesThroughBatchesAndScans(t *testing.T) {
+	ctx := context.Background()
+	primary := &countingStore{MemoryStore: store.NewMemoryStore()}
+	defer primary.Close()
+	f := store.NewFailoverStore(1, time.Hour, primary)
+	defer f.Close()
+	limiter := NewFixedWindow(3, time.Minute, f)
+
+	got, err := limiter.AllowMany(ctx, batchKeys)
+	if err != nil {
+		t.Fatalf("AllowMany returned error: %v", err)
+	}
+	want, _ := allowEach(ctx, NewFixedWindow(3, time.Minute, store.NewMemoryStore()), batchKeys)
+	checkSameResults(t, got, want)
+	if primary.many.Load() != 1 || primary.single.Load() != 0 {
+		t.Errorf("got %d UpdateMany and %d single-key calls, want the batch passed through", primary.many.Load(), primary.single.Load())
+	}
+
+	if err := limiter.ResetPrefix(ctx, "a"); err != nil {
+		t.Fatalf("ResetPrefix returned error: %v", err)
+	}
+	if got := scanned(t, f, "*"); len(got) != 2 || got[0] != "b" || got[1] != "c" {
+		t.Errorf("got keys %v, want b and c", got)
+	}
+}
+
+func TestFailoverBatchesWithoutBatchBackend(t *testing.T) {
+	ctx := context.Background()
+	mem := store.NewMemoryStore()
+	defer mem.Close()
+	// A backend with none of the optional interfaces
+	f := store.NewFailoverStore(1, time.Hour, struct{ store.Store }{mem})
+	defer f.Close()
+
+	got, err := NewFixedWindow(3, time.Minute, f).AllowMany(ctx, batchKeys)
+	if err != nil {
+		t.Fatalf("AllowMany returned error: %v", err)
+	}
+	want, _ := allowEach(ctx, NewFixedWindow(3, time.Minute, store.NewMemoryStore()), batchKeys)
+	checkSameResults(t, got, want)
+
+	var scanErr error
+	for _, err := range f.Scan(ctx, "*") {
+		scanErr = err
+	}
+	if scanErr == nil {
+		t.Error("want an error scanning a backend that cannot scan")
+	}
+}
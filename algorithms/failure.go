@@ -0,0 +1,321 @@
+package algorithms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+// FailurePolicy decides what a FailSafe limiter does with a request when its
+// store cannot be reached.
+type FailurePolicy int
+
+const (
+	// FailClosed denies every request until the store is back.
+	FailClosed FailurePolicy = iota
+	// FailOpen admits every request until the store is back.
+	FailOpen
+	// FailLocal enforces the same limit with an in-memory copy of the
+	// limiter. Each process counts on its own, so with several app servers
+	// a key may get up to the limit from each of them.
+	FailLocal
+)
+
+func (p FailurePolicy) String() string {
+	switch p {
+	case FailClosed:
+		return "fail-closed"
+	case FailOpen:
+		return "fail-open"
+	case FailLocal:
+		return "fail-local"
+	default:
+		return fmt.Sprintf("FailurePolicy(%d)", int(p))
+	}
+}
+
+// FailSafe wraps a limiter with a policy for store outages. When the store
+// returns a store.ErrBackend, such as a Redis timeout, the request is decided
+// by the policy instead of failing, and its Result has Degraded set. Any
+// other error, such as an invalid n or state that cannot be decoded, is
+// returned as it is.
+//
+// FailOpen and FailClosed cannot know the quota, so their results have a
+// Limit and Remaining of 0.
+type FailSafe struct {
+	RetryAfter time.Duration // What FailClosed tells denied callers to wait
+
+	policy     FailurePolicy
+	limiter    RateLimiter
+	res        reserver
+	local      RateLimiter
+	localRes   reserver
+	localStore *store.MemoryStore
+}
+
+func NewFailSafe(limiter RateLimiter, policy FailurePolicy) *FailSafe {
+	res, ok := limiter.(reserver)
+	if !ok {
+		panic(fmt.Sprintf("limiter %T cannot be wrapped", limiter))
+	}
+	f := &FailSafe{
+		RetryAfter: time.Second,
+		policy:     policy,
+		limiter:    limiter,
+		res:        res,
+	}
+	switch policy {
+	case FailClosed, FailOpen:
+	case FailLocal:
+		l, ok := limiter.(localizer)
+		if !ok {
+			panic(fmt.Sprintf("limiter %T has no local fallback", limiter))
+		}
+		f.localStore = store.NewMemoryStore()
+		f.local = l.local(f.localStore)
+		f.localRes = f.local.(reserver)
+	default:
+		panic(fmt.Sprintf("unknown failure policy %d", policy))
+	}
+	return f
+}
+
+// Policy returns the limiter's failure policy.
+func (f *FailSafe) Policy() FailurePolicy {
+	return f.policy
+}
+
+// Allow checks a request for key, falling back to the policy if the store
+// fails.
+func (f *FailSafe) Allow(ctx context.Context, key string) (Result, error) {
+	return f.AllowN(ctx, key, 1)
+}
+
+// AllowN checks n requests for key, falling back to the policy if the store
+// fails.
+func (f *FailSafe) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	res, err := f.reserveN(ctx, key, n, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return res.result(), nil
+}
+
+// AllowMany checks a request for each of keys, as one batch when the wrapped
+// limiter is a BatchLimiter. If the store fails, the policy decides every
+// request in the batch, and the local fallback decides them as a batch too.
+func (f *FailSafe) AllowMany(ctx context.Context, keys []string) ([]Result, error) {
+	batch, ok := f.limiter.(BatchLimiter)
+	if !ok {
+		return allowEach(ctx, f, keys)
+	}
+	results, err := batch.AllowMany(ctx, keys)
+	if err == nil || !storeFailed(ctx, err) {
+		return results, err
+	}
+
+	switch f.policy {
+	case FailOpen:
+		results = make([]Result, len(keys))
+		for i := range results {
+			results[i] = Result{Allowed: true}
+		}
+	case FailClosed:
+		results = make([]Result, len(keys))
+		for i := range results {
+			results[i] = Result{Allowed: false, RetryAfter: f.RetryAfter}
+		}
+	case FailLocal:
+		results, err = f.local.(BatchLimiter).AllowMany(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := range results {
+		results[i].Degraded = true
+	}
+	return results, nil
+}
+
+// Wait blocks until a request for key is admitted.
+func (f *FailSafe) Wait(ctx context.Context, key string) error {
+	return f.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until n requests for key are admitted. Under FailClosed it
+// returns the store's error rather than waiting for the store to come back.
+func (f *FailSafe) WaitN(ctx context.Context, key string, n int) error {
+	return waitN(ctx, f, key, n)
+}
+
+// Reserve books a request for key.
+func (f *FailSafe) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return f.ReserveN(ctx, key, 1)
+}
+
+// ReserveN books n requests for key. Under FailClosed it returns the store's
+// error, since nothing can be booked.
+func (f *FailSafe) ReserveN(ctx context.Context, key string, n int) (*Reservation, error) {
+	return f.reserveN(ctx, key, n, maxWait)
+}
+
+func (f *FailSafe) reserveN(ctx context.Context, key string, n int, maxDelay time.Duration) (*Reservation, error) {
+	res, err := f.res.reserveN(ctx, key, n, maxDelay)
+	if err == nil || !storeFailed(ctx, err) {
+		return res, err
+	}
+
+	switch f.policy {
+	case FailOpen:
+		res = newReservation(0, time.Now(), 0, maxDelay)
+	case FailClosed:
+		if maxDelay > 0 {
+			return nil, err
+		}
+		res = newReservation(0, time.Now(), f.RetryAfter, maxDelay)
+		res.ok = false
+	case FailLocal:
+		res, err = f.localRes.reserveN(ctx, key, n, maxDelay)
+		if err != nil {
+			return nil, err
+		}
+	}
+	res.degraded = true
+	return res, nil
+}
+
+// Peek reports whether a request for key would be admitted right now,
+// falling back to the policy if the store fails.
+func (f *FailSafe) Peek(ctx context.Context, key string) (Result, error) {
+	peeker, ok := f.limiter.(Peeker)
+	if !ok {
+		return Result{}, fmt.Errorf("limiter %T cannot peek", f.limiter)
+	}
+	r, err := peeker.Peek(ctx, key)
+	if err == nil || !storeFailed(ctx, err) {
+		return r, err
+	}
+
+	switch f.policy {
+	case FailOpen:
+		r = Result{Allowed: true}
+	case FailClosed:
+		r = Result{Allowed: false, RetryAfter: f.RetryAfter}
+	case FailLocal:
+		r, err = f.local.(Peeker).Peek(ctx, key)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	r.Degraded = true
+	return r, nil
+}
+
+// Reset clears key's state in the store, and in the local fallback if there
+// is one. Store errors are returned, not handled by the policy.
+func (f *FailSafe) Reset(ctx context.Context, key string) error {
+	if f.local != nil {
+		f.local.Reset(ctx, key)
+	}
+	return f.limiter.Reset(ctx, key)
+}
+
+// ResetPrefix clears every key starting with prefix in the store, and in the
+// local fallback if there is one.
+func (f *FailSafe) ResetPrefix(ctx context.Context, prefix string) error {
+	r, ok := f.limiter.(PrefixResetter)
+	if !ok {
+		return fmt.Errorf("limiter %T cannot reset a prefix", f.limiter)
+	}
+	if local, ok := f.local.(PrefixResetter); ok {
+		local.ResetPrefix(ctx, prefix)
+	}
+	return r.ResetPrefix(ctx, prefix)
+}
+
+// Close stops the local fallback's store, if there is one.
+func (f *FailSafe) Close() {
+	if f.localStore != nil {
+		f.localStore.Close()
+	}
+}
+
+// storeFailed reports whether err is a store outage that the failure policy
+// should handle. Errors caused by the caller's own context ending are not:
+// there is no caller left to admit.
+func storeFailed(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && errors.Is(err, store.ErrBackend)
+}
+
+// localizer is implemented by limiters that can build a copy of themselves
+// on another store, used by FailLocal.
+type localizer interface {
+	local(s store.Store) RateLimiter
+}
+
+func (tb *TokenBucket) local(s store.Store) RateLimiter {
+	return NewTokenBucket(tb.Capacity, tb.RefillRate, s)
+}
+
+func (lb *LeakyBucket) local(s store.Store) RateLimiter {
+	return NewLeakyBucket(lb.Capacity, lb.Rate, s)
+}
+
+func (fw *FixedWindow) local(s store.Store) RateLimiter {
+	return NewFixedWindow(fw.Limit, fw.WindowSize, s)
+}
+
+func (sw *SlidingWindow) local(s store.Store) RateLimiter {
+	return NewSlidingWindow(sw.Limit, sw.WindowSize, s)
+}
+
+func (swc *SlidingWindowCounter) local(s store.Store) RateLimiter {
+	return NewSlidingWindowCounter(swc.Limit, swc.WindowSize, s)
+}
+
+func (g *GCRA) local(s store.Store) RateLimiter {
+	return NewGCRA(g.Limit, g.Period, g.Burst, s)
+}
+
+func (tb *RedisTokenBucket) local(s store.Store) RateLimiter {
+	return NewTokenBucket(tb.Capacity, tb.RefillRate, s)
+}
+
+func (lb *RedisLeakyBucket) local(s store.Store) RateLimiter {
+	return NewLeakyBucket(lb.Capacity, lb.Rate, s)
+}
+
+func (fw *RedisFixedWindow) local(s store.Store) RateLimiter {
+	return NewFixedWindow(fw.Limit, fw.WindowSize, s)
+}
+
+func (sw *RedisSlidingWindow) local(s store.Store) RateLimiter {
+	return NewSlidingWindow(sw.Limit, sw.WindowSize, s)
+}
+
+func (swc *RedisSlidingWindowCounter) local(s store.Store) RateLimiter {
+	return NewSlidingWindowCounter(swc.Limit, swc.WindowSize, s)
+}
+
+func (t *Tiered) local(s store.Store) RateLimiter {
+	return NewFixedWindow(t.Limit, t.WindowSize, s)
+}
+
+// local copies the composite with every policy moved to s, keeping the
+// policies' names and keys.
+func (c *Composite) local(s store.Store) RateLimiter {
+	out := &Composite{policies: make([]compositePolicy, len(c.policies))}
+	for i, p := range c.policies {
+		l, ok := p.limiter.(localizer)
+		if !ok {
+			panic(fmt.Sprintf("policy %q: limiter %T has no local fallback", p.name, p.limiter))
+		}
+		p.limiter = l.local(s)
+		p.res = p.limiter.(reserver)
+		out.policies[i] = p
+	}
+	return out
+}
@@ -0,0 +1,263 @@
+package algorithms
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/codetesla51/limitz/store"
+)
+
+// flakyStore is a MemoryStore that fails every call with a backend error
+// while it is down.
+type flakyStore struct {
+	*store.MemoryStore
+	down atomic.Bool
+}
+
+func newFlakyStore() *flakyStore {
+	return &flakyStore{MemoryStore: store.NewMemoryStore()}
+}
+
+func (s *flakyStore) err(op string) error {
+	if s.down.Load() {
+		return &store.BackendError{Backend: "test", Op: op, Err: errors.New("connection refused")}
+	}
+	return nil
+}
+
+func (s *flakyStore) Get(ctx context.Context, key string) (interface{}, error) {
+	if err := s.err("Get"); err != nil {
+		return nil, err
+	}
+	return s.MemoryStore.Get(ctx, key)
+}
+
+func (s *flakyStore) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	if err := s.err("Set"); err != nil {
+		return err
+	}
+	return s.MemoryStore.Set(ctx, key, value, ttl)
+}
+
+func (s *flakyStore) Delete(ctx context.Context, key string) error {
+	if err := s.err("Delete"); err != nil {
+		return err
+	}
+	return s.MemoryStore.Delete(ctx, key)
+}
+
+func (s *flakyStore) Update(ctx context.Context, key string, fn store.UpdateFunc) error {
+	if err := s.err("Update"); err != nil {
+		return err
+	}
+	return s.MemoryStore.Update(ctx, key, fn)
+}
+
+func (s *flakyStore) GetMany(ctx context.Context, keys []string) ([]interface{}, error) {
+	if err := s.err("GetMany"); err != nil {
+		return nil, err
+	}
+	return s.MemoryStore.GetMany(ctx, keys)
+}
+
+func (s *flakyStore) SetMany(ctx context.Context, entries []store.Entry) error {
+	if err := s.err("SetMany"); err != nil {
+		return err
+	}
+	return s.MemoryStore.SetMany(ctx, entries)
+}
+
+func (s *flakyStore) UpdateMany(ctx context.Context, keys []string, fn store.UpdateManyFunc) error {
+	if err := s.err("UpdateMany"); err != nil {
+		return err
+	}
+	return s.MemoryStore.UpdateMany(ctx, keys, fn)
+}
+
+func (s *flakyStore) Exists(ctx context.Context, key string) (bool, error) {
+	if err := s.err("Exists"); err != nil {
+		return false, err
+	}
+	return s.MemoryStore.Exists(ctx, key)
+}
+
+func TestStoreSentinelErrors(t *testing.T) {
+	ctx := context.Background()
+
+	mem := store.NewMemoryStore()
+	defer mem.Close()
+	if _, err := mem.Get(ctx, "missing"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("MemoryStore Get: got %v, want ErrNotFound", err)
+	}
+	mem.Set(ctx, "short", "v", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	_, err := mem.Get(ctx, "short")
+	if !errors.Is(err, store.ErrExpired) || !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("MemoryStore Get: got %v, want ErrExpired", err)
+	}
+
+	mr := miniredis.RunT(t)
+	rs, err := store.NewRedisStore(mr.Addr(), "", "")
+	if err != nil {
+		t.Fatalf("failed to connect to miniredis: %v", err)
+	}
+	defer rs.Close()
+	if _, err := rs.Get(ctx, "missing"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("RedisStore Get: got %v, want ErrNotFound", err)
+	}
+	if err := rs.Delete(ctx, "missing"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("RedisStore Delete: got %v, want ErrNotFound", err)
+	}
+
+	mr.Close()
+	_, err = rs.Get(ctx, "missing")
+	var backendErr *store.BackendError
+	if !errors.Is(err, store.ErrBackend) || !errors.As(err, &backendErr) || backendErr.Op != "Get" {
+		t.Errorf("RedisStore Get with Redis down: got %v, want a BackendError", err)
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		t.Error("an outage must not look like a missing key")
+	}
+}
+
+func TestStoreOutageIsAnError(t *testing.T) {
+	for name, newLimiter := range rateLimiters() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newFlakyStore()
+			limiter := newLimiter(s)
+			s.down.Store(true)
+
+			for i := 0; i < 5; i++ {
+				if _, err := limiter.Allow(ctx, "user1"); !errors.Is(err, store.ErrBackend) {
+					t.Fatalf("got %v, want the store's error", err)
+				}
+			}
+		})
+	}
+}
+
+func TestFailSafeFailOpen(t *testing.T) {
+	ctx := context.Background()
+	s := newFlakyStore()
+	limiter := NewFailSafe(NewTokenBucket(1, 1, s), FailOpen)
+	s.down.Store(true)
+
+	for i := 0; i < 3; i++ {
+		result, err := limiter.Allow(ctx, "user1")
+		if err != nil {
+			t.Fatalf("Allow returned error: %v", err)
+		}
+		if !result.Allowed || !result.Degraded {
+			t.Errorf("got %+v, want an allowed, degraded result", result)
+		}
+	}
+
+	s.down.Store(false)
+	result, err := limiter.Allow(ctx, "user1")
+	if err != nil {
+		t.Fatalf("Allow returned error: %v", err)
+	}
+	if !result.Allowed || result.Degraded {
+		t.Errorf("got %+v once the store is back, want an allowed result that is not degraded", result)
+	}
+}
+
+func TestFailSafeFailClosed(t *testing.T) {
+	ctx := context.Background()
+	s := newFlakyStore()
+	limiter := NewFailSafe(NewFixedWindow(5, time.Minute, s), FailClosed)
+	s.down.Store(true)
+
+	result, err := limiter.Allow(ctx, "user1")
+	if err != nil {
+		t.Fatalf("Allow returned error: %v", err)
+	}
+	if result.Allowed || !result.Degraded || result.RetryAfter != time.Second {
+		t.Errorf("got %+v, want a degraded denial with RetryAfter 1s", result)
+	}
+
+	peek, err := limiter.Peek(ctx, "user1")
+	if err != nil {
+		t.Fatalf("Peek returned error: %v", err)
+	}
+	if peek.Allowed || !peek.Degraded {
+		t.Errorf("got %+v from Peek, want a degraded denial", peek)
+	}
+
+	if _, err := limiter.Reserve(ctx, "user1"); !errors.Is(err, store.ErrBackend) {
+		t.Errorf("Reserve: got %v, want the store's error", err)
+	}
+}
+
+func TestFailSafeFailLocal(t *testing.T) {
+	ctx := context.Background()
+	s := newFlakyStore()
+	limiter := NewFailSafe(NewSlidingWindow(3, time.Minute, s), FailLocal)
+	defer limiter.Close()
+	s.down.Store(true)
+
+	for i := 0; i < 3; i++ {
+		result, err := limiter.Allow(ctx, "user1")
+		if err != nil {
+			t.Fatalf("Allow returned error: %v", err)
+		}
+		if !result.Allowed || !result.Degraded || result.Limit != 3 {
+			t.Errorf("request %d: got %+v, want an allowed, degraded result with the real limit", i+1, result)
+		}
+	}
+	result, err := limiter.Allow(ctx, "user1")
+	if err != nil {
+		t.Fatalf("Allow returned error: %v", err)
+	}
+	if result.Allowed || !result.Degraded {
+		t.Errorf("got %+v, want the local limiter to deny the 4th request", result)
+	}
+}
+
+func TestFailSafePassesOtherErrors(t *testing.T) {
+	ctx := context.Background()
+	s := newTestRedisStore(t)
+	limiter := NewFailSafe(NewTokenBucket(3, 1, s), FailOpen)
+
+	if _, err := limiter.AllowN(ctx, "user1", 4); err == nil {
+		t.Error("expected an error for n above the limit")
+	}
+
+	s.Set(ctx, "user2", []byte("not json"), time.Minute)
+	if _, err := limiter.Allow(ctx, "user2"); err == nil {
+		t.Error("expected an error for state that cannot be decoded")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := limiter.Allow(cancelled, "user1"); err == nil {
+		t.Error("expected an error for a cancelled context")
+	}
+}
+
+func TestFailSafeInComposite(t *testing.T) {
+	ctx := context.Background()
+	healthy := store.NewMemoryStore()
+	flaky := newFlakyStore()
+	c := NewComposite(
+		Policy{Name: "local", Limiter: NewTokenBucket(2, 1, healthy)},
+		Policy{Name: "shared", Limiter: NewFailSafe(NewTokenBucket(10, 1, flaky), FailOpen)},
+	)
+	flaky.down.Store(true)
+
+	result, err := c.Allow(ctx, "user1")
+	if err != nil {
+		t.Fatalf("Allow returned error: %v", err)
+	}
+	if !result.Allowed || !result.Degraded {
+		t.Errorf("got %+v, want an allowed, degraded result", result)
+	}
+	if result.Limit != 2 || result.Remaining != 1 {
+		t.Errorf("got Limit %d, Remaining %d, want the healthy policy's 2 and 1", result.Limit, result.Remaining)
+	}
+}
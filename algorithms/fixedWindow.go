@@ -2,9 +2,7 @@ package algorithms
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"sync"
 	"time"
 
 	"github.com/codetesla51/limitz/store"
@@ -19,7 +17,8 @@ type FixedWindow struct {
 	Limit      int
 	WindowSize time.Duration
 	store      store.Store
-	mu         sync.Mutex
+	state      *store.Typed[FixedWindowBucket]
+	locks      keyLocks
 }
 
 func NewFixedWindow(limit int, windowSize time.Duration, s store.Store) *FixedWindow {
@@ -30,72 +29,224 @@ func NewFixedWindow(limit int, windowSize time.Duration, s store.Store) *FixedWi
 		Limit:      limit,
 		WindowSize: windowSize,
 		store:      s,
+		state:      store.NewTyped[FixedWindowBucket](s),
 	}
 }
 
 func (fw *FixedWindow) Allow(ctx context.Context, key string) (Result, error) {
-	fw.mu.Lock()
-	defer fw.mu.Unlock()
+	return fw.AllowN(ctx, key, 1)
+}
 
-	nowNanos := time.Now().UnixNano()
-	windowSizeNanos := fw.WindowSize.Nanoseconds()
+// AllowN checks if n requests fit in the current window and counts all of
+// them at once, or none of them.
+func (fw *FixedWindow) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	res, err := fw.reserveN(ctx, key, n, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return res.result(), nil
+}
+
+// AllowMany counts a request for each of keys whose window has room. With a
+// store.BatchUpdater, the counters of the whole batch are updated in one
+// atomic step.
+func (fw *FixedWindow) AllowMany(ctx context.Context, keys []string) ([]Result, error) {
+	return allowMany(ctx, fw.state, &fw.locks, keys, fw.reserve)
+}
+
+// Wait blocks until a request for key fits in a window.
+func (fw *FixedWindow) Wait(ctx context.Context, key string) error {
+	return fw.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until n requests for key fit in a window.
+func (fw *FixedWindow) WaitN(ctx context.Context, key string, n int) error {
+	return waitN(ctx, fw, key, n)
+}
+
+// Reserve books a request for key in the first window with room for it.
+func (fw *FixedWindow) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return fw.ReserveN(ctx, key, 1)
+}
+
+// ReserveN books n requests for key in the first window with room for them.
+// Requests booked past the current window carry over and count against the
+// windows that follow.
+func (fw *FixedWindow) ReserveN(ctx context.Context, key string, n int) (*Reservation, error) {
+	return fw.reserveN(ctx, key, n, maxWait)
+}
+
+func (fw *FixedWindow) reserveN(ctx context.Context, key string, n int, maxDelay time.Duration) (*Reservation, error) {
+	if err := checkN(n, fw.Limit); err != nil {
+		return nil, err
+	}
+
+	mu := fw.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
 
-	fixedWindowData, err := fw.store.Get(ctx, key)
-	var bucket *FixedWindowBucket
+	now := time.Now()
+
+	var res *Reservation
+	err := update(ctx, fw.state, key, func(bucket *FixedWindowBucket) (*FixedWindowBucket, time.Duration, error) {
+		var ttl time.Duration
+		bucket, ttl, res = fw.reserve(bucket, n, now, maxDelay)
+		return bucket, ttl, nil
+	})
 	if err != nil {
-		bucket = &FixedWindowBucket{
-			Count:  0,
-			Window: 0,
-		}
-	} else {
-		switch v := fixedWindowData.(type) {
-		case *FixedWindowBucket:
-			bucket = v
-		case string:
-			bucket = &FixedWindowBucket{}
-			if err := json.Unmarshal([]byte(v), bucket); err != nil {
-				bucket = &FixedWindowBucket{Count: 0, Window: 0}
-			}
-		default:
-			bucket = &FixedWindowBucket{Count: 0, Window: 0}
+		return nil, err
+	}
+	if res.ok {
+		res.cancel = func(ctx context.Context) error {
+			return fw.refund(ctx, key, n)
 		}
 	}
-	currentWindow := int(nowNanos / windowSizeNanos)
-	if currentWindow != bucket.Window {
-		bucket.Window = currentWindow
-		bucket.Count = 0
+	return res, nil
+}
+
+// reserve counts n requests in bucket, the key's counter or nil if it has
+// none, if a window has room for them within maxDelay of now. It returns the
+// counter to store, or nil when nothing was counted.
+func (fw *FixedWindow) reserve(bucket *FixedWindowBucket, n int, now time.Time, maxDelay time.Duration) (*FixedWindowBucket, time.Duration, *Reservation) {
+	nowNanos := now.UnixNano()
+
+	if bucket == nil {
+		bucket = fw.newBucket()
 	}
-	bucket.Count++
-	if bucket.Count > fw.Limit {
-		nextWindowStart := int64(currentWindow+1) * windowSizeNanos
-		retryAfter := time.Duration(nextWindowStart-nowNanos) * time.Nanosecond
+	fw.advance(bucket, int(nowNanos/fw.WindowSize.Nanoseconds()))
 
-		err = fw.store.Set(ctx, key, bucket, fw.WindowSize)
-		if err != nil {
-			return Result{}, fmt.Errorf("failed to save bucket state: %v", err)
-		}
-		return Result{
-			Allowed:    false,
-			Limit:      fw.Limit,
-			Remaining:  0,
-			RetryAfter: retryAfter,
-		}, nil
+	var delay time.Duration
+	if bucket.Count+n > fw.Limit {
+		delay = fw.retryAfter(bucket, n, nowNanos)
+	}
+
+	res := newReservation(fw.Limit, now, delay, maxDelay)
+	if !res.ok {
+		res.remaining = max(fw.Limit-bucket.Count, 0)
+		return nil, 0, res
 	}
-	err = fw.store.Set(ctx, key, bucket, fw.WindowSize)
+
+	bucket.Count += n
+	res.remaining = max(fw.Limit-bucket.Count, 0)
+	return bucket, fw.WindowSize + delay, res
+}
+
+// Peek reports whether a request for key would be allowed right now without
+// counting it. Remaining is what is left of the current window.
+func (fw *FixedWindow) Peek(ctx context.Context, key string) (Result, error) {
+	mu := fw.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	nowNanos := time.Now().UnixNano()
+	bucket, err := fw.inspect(ctx, key, nowNanos)
 	if err != nil {
-		return Result{}, fmt.Errorf("failed to save bucket state: %v", err)
+		return Result{}, err
 	}
 
+	if bucket.Count+1 <= fw.Limit {
+		return Result{
+			Allowed:    true,
+			Limit:      fw.Limit,
+			Remaining:  fw.Limit - bucket.Count,
+			RetryAfter: 0,
+		}, nil
+	}
 	return Result{
-		Allowed:    true,
+		Allowed:    false,
 		Limit:      fw.Limit,
-		Remaining:  fw.Limit - bucket.Count,
-		RetryAfter: 0,
+		Remaining:  0,
+		RetryAfter: fw.retryAfter(bucket, 1, nowNanos),
 	}, nil
 }
+
+// Inspect returns key's counter moved to the current window. A key with no
+// state yet gets an empty counter. Nothing is written back to the store.
+func (fw *FixedWindow) Inspect(ctx context.Context, key string) (*FixedWindowBucket, error) {
+	mu := fw.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+	return fw.inspect(ctx, key, time.Now().UnixNano())
+}
+
+// inspect advances a copy of key's counter, so the state held by the store
+// is left as it was.
+func (fw *FixedWindow) inspect(ctx context.Context, key string, nowNanos int64) (*FixedWindowBucket, error) {
+	stored, err := fw.load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	bucket := *stored
+	fw.advance(&bucket, int(nowNanos/fw.WindowSize.Nanoseconds()))
+	return &bucket, nil
+}
+
+// refund uncounts n requests for key after a reservation is cancelled.
+func (fw *FixedWindow) refund(ctx context.Context, key string, n int) error {
+	mu := fw.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	nowNanos := time.Now().UnixNano()
+	return update(ctx, fw.state, key, func(bucket *FixedWindowBucket) (*FixedWindowBucket, time.Duration, error) {
+		if bucket == nil {
+			return nil, 0, nil
+		}
+		fw.advance(bucket, int(nowNanos/fw.WindowSize.Nanoseconds()))
+		bucket.Count = max(bucket.Count-n, 0)
+
+		windowsAhead := bucket.Count / fw.Limit
+		return bucket, time.Duration(windowsAhead+1) * fw.WindowSize, nil
+	})
+}
+
+// load fetches key's bucket, starting an empty one when the key is new.
+func (fw *FixedWindow) load(ctx context.Context, key string) (*FixedWindowBucket, error) {
+	bucket, err := fw.state.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bucket state: %w", err)
+	}
+	if bucket == nil {
+		bucket = fw.newBucket()
+	}
+	return bucket, nil
+}
+
+// newBucket starts an empty counter for a key with no state.
+func (fw *FixedWindow) newBucket() *FixedWindowBucket {
+	return &FixedWindowBucket{
+		Count:  0,
+		Window: 0,
+	}
+}
+
+// retryAfter returns how long until n more requests fit, which is the start
+// of the window the last of them would carry over into.
+func (fw *FixedWindow) retryAfter(bucket *FixedWindowBucket, n int, nowNanos int64) time.Duration {
+	windowsAhead := (bucket.Count + n - 1) / fw.Limit
+	windowStart := int64(bucket.Window+windowsAhead) * fw.WindowSize.Nanoseconds()
+	return time.Duration(windowStart-nowNanos) * time.Nanosecond
+}
+
+// advance moves the bucket to currentWindow. Requests reserved beyond the
+// limit of a past window carry over into the windows that follow it.
+func (fw *FixedWindow) advance(bucket *FixedWindowBucket, currentWindow int) {
+	elapsed := currentWindow - bucket.Window
+	if elapsed == 0 {
+		return
+	}
+	if elapsed < 0 || elapsed > bucket.Count/fw.Limit {
+		bucket.Count = 0
+	} else {
+		bucket.Count -= fw.Limit * elapsed
+	}
+	bucket.Window = currentWindow
+}
+
 func (fw *FixedWindow) Reset(ctx context.Context, key string) error {
-	fw.mu.Lock()
-	defer fw.mu.Unlock()
+	mu := fw.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
 	exists, err := fw.store.Exists(ctx, key)
 	if err != nil {
 		return err
@@ -105,3 +256,8 @@ func (fw *FixedWindow) Reset(ctx context.Context, key string) error {
 	}
 	return fw.store.Delete(ctx, key)
 }
+
+// ResetPrefix clears every key starting with prefix.
+func (fw *FixedWindow) ResetPrefix(ctx context.Context, prefix string) error {
+	return resetPrefix(ctx, fw.store, &fw.locks, prefix)
+}
@@ -225,3 +225,58 @@ func TestFixedWindowEdgeCase(t *testing.T) {
 		t.Error("first request in new window should be allowed")
 	}
 }
+
+func TestFixedWindowAllowN(t *testing.T) {
+	s := store.NewMemoryStore()
+	fw := NewFixedWindow(10, 1*time.Second, s)
+	ctx := context.Background()
+
+	result, err := fw.AllowN(ctx, "user1", 8)
+	if err != nil || !result.Allowed {
+		t.Fatal("request of 8 should be allowed")
+	}
+	if result.Remaining != 2 {
+		t.Errorf("remaining: got %d, want 2", result.Remaining)
+	}
+
+	// 3 more does not fit, and nothing is counted
+	result, err = fw.AllowN(ctx, "user1", 3)
+	if err != nil || result.Allowed {
+		t.Error("request of 3 should be denied")
+	}
+	if result.Remaining != 2 {
+		t.Errorf("remaining after denial: got %d, want 2", result.Remaining)
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > 1*time.Second {
+		t.Errorf("RetryAfter: got %v, want within 1s", result.RetryAfter)
+	}
+
+	bucketData, _ := s.Get(ctx, "user1")
+	bucket := bucketData.(*FixedWindowBucket)
+	if bucket.Count != 8 {
+		t.Errorf("count after denial: got %d, want 8", bucket.Count)
+	}
+}
+
+func TestFixedWindowPeekAndInspect(t *testing.T) {
+	s := store.NewMemoryStore()
+	fw := NewFixedWindow(3, 1*time.Second, s)
+	ctx := context.Background()
+
+	_, _ = fw.AllowN(ctx, "user1", 2)
+
+	for i := 0; i < 3; i++ {
+		result, err := fw.Peek(ctx, "user1")
+		if err != nil || !result.Allowed || result.Remaining != 1 {
+			t.Errorf("peek %d: got %+v, want allowed with 1 remaining", i+1, result)
+		}
+	}
+
+	bucket, err := fw.Inspect(ctx, "user1")
+	if err != nil {
+		t.Fatalf("inspect failed: %v", err)
+	}
+	if bucket.Count != 2 {
+		t.Errorf("inspected count: got %d, want 2", bucket.Count)
+	}
+}
@@ -0,0 +1,279 @@
+package algorithms
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+// GCRABucket stores the theoretical arrival time (TAT) of the next request
+// for a user, in Unix nanoseconds. It is the only state GCRA needs.
+type GCRABucket struct {
+	TAT int64
+}
+
+// GCRA implements the Generic Cell Rate Algorithm. Requests are spaced one
+// emission interval (Period / Limit) apart, and up to Burst of them may
+// arrive at once. Unlike the token bucket, capacity is earned continuously
+// rather than in whole seconds.
+type GCRA struct {
+	Limit  int           // Requests allowed per period
+	Period time.Duration // Period the limit applies to (e.g., 1 minute)
+	Burst  int           // Max requests allowed at once
+	store  store.Store
+	state  *store.Typed[GCRABucket]
+	locks  keyLocks
+}
+
+func NewGCRA(limit int, period time.Duration, burst int, s store.Store) *GCRA {
+	if period <= 0 {
+		panic("period must be greater than 0")
+	}
+	if limit <= 0 {
+		panic("limit must be greater than 0")
+	}
+	if burst <= 0 {
+		panic("burst must be greater than 0")
+	}
+	return &GCRA{
+		Limit:  limit,
+		Period: period,
+		Burst:  burst,
+		store:  s,
+		state:  store.NewTyped[GCRABucket](s),
+	}
+}
+
+// Allow checks if a request is allowed under the generic cell rate algorithm.
+func (g *GCRA) Allow(ctx context.Context, key string) (Result, error) {
+	return g.AllowN(ctx, key, 1)
+}
+
+// AllowN checks if n requests can arrive now and admits all of them at
+// once, or none of them.
+func (g *GCRA) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	res, err := g.reserveN(ctx, key, n, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return res.result(), nil
+}
+
+// AllowMany admits a request for each of keys that conforms. With a
+// store.BatchUpdater, the state of the whole batch is updated in one atomic
+// step.
+func (g *GCRA) AllowMany(ctx context.Context, keys []string) ([]Result, error) {
+	return allowMany(ctx, g.state, &g.locks, keys, g.reserve)
+}
+
+// Wait blocks until a request for key can arrive.
+func (g *GCRA) Wait(ctx context.Context, key string) error {
+	return g.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until n requests for key can arrive.
+func (g *GCRA) WaitN(ctx context.Context, key string, n int) error {
+	return waitN(ctx, g, key, n)
+}
+
+// Reserve books the next arrival slot for key.
+func (g *GCRA) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return g.ReserveN(ctx, key, 1)
+}
+
+// ReserveN books the next n arrival slots for key by pushing its TAT
+// forward, which is exactly what an admitted request does.
+func (g *GCRA) ReserveN(ctx context.Context, key string, n int) (*Reservation, error) {
+	return g.reserveN(ctx, key, n, maxWait)
+}
+
+func (g *GCRA) reserveN(ctx context.Context, key string, n int, maxDelay time.Duration) (*Reservation, error) {
+	if err := checkN(n, g.Burst); err != nil {
+		return nil, err
+	}
+
+	mu := g.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+
+	var res *Reservation
+	err := update(ctx, g.state, key, func(bucket *GCRABucket) (*GCRABucket, time.Duration, error) {
+		var ttl time.Duration
+		bucket, ttl, res = g.reserve(bucket, n, now, maxDelay)
+		return bucket, ttl, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.ok {
+		res.cancel = func(ctx context.Context) error {
+			return g.refund(ctx, key, n)
+		}
+	}
+	return res, nil
+}
+
+// reserve moves bucket's theoretical arrival time, or a new one's if bucket
+// is nil, on by n requests if they conform within maxDelay of now. It
+// returns the state to store, or nil when the requests do not conform.
+func (g *GCRA) reserve(bucket *GCRABucket, n int, now time.Time, maxDelay time.Duration) (*GCRABucket, time.Duration, *Reservation) {
+	nowNanos := now.UnixNano()
+
+	if bucket == nil {
+		bucket = g.newBucket(nowNanos)
+	}
+	g.advance(bucket, nowNanos)
+
+	newTAT := bucket.TAT + int64(n)*g.interval()
+	delay := time.Duration(max(newTAT-g.tolerance()-nowNanos, 0))
+
+	res := newReservation(g.Burst, now, delay, maxDelay)
+	if !res.ok {
+		res.remaining = g.remaining(bucket.TAT, nowNanos)
+		return nil, 0, res
+	}
+
+	bucket.TAT = newTAT
+	res.remaining = g.remaining(bucket.TAT, nowNanos)
+	return bucket, g.ttl(bucket, nowNanos), res
+}
+
+// Peek reports whether a request for key would be allowed right now without
+// moving its TAT. Remaining is the burst currently available.
+func (g *GCRA) Peek(ctx context.Context, key string) (Result, error) {
+	mu := g.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	nowNanos := time.Now().UnixNano()
+	bucket, err := g.inspect(ctx, key, nowNanos)
+	if err != nil {
+		return Result{}, err
+	}
+
+	allowAt := bucket.TAT + g.interval() - g.tolerance()
+	if allowAt <= nowNanos {
+		return Result{
+			Allowed:    true,
+			Limit:      g.Burst,
+			Remaining:  g.remaining(bucket.TAT, nowNanos),
+			RetryAfter: 0,
+		}, nil
+	}
+	return Result{
+		Allowed:    false,
+		Limit:      g.Burst,
+		Remaining:  0,
+		RetryAfter: time.Duration(allowAt - nowNanos),
+	}, nil
+}
+
+// Inspect returns key's state with a TAT in the past moved up to now. A key
+// with no state yet gets a TAT of now. Nothing is written back to the store.
+func (g *GCRA) Inspect(ctx context.Context, key string) (*GCRABucket, error) {
+	mu := g.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+	return g.inspect(ctx, key, time.Now().UnixNano())
+}
+
+// inspect advances a copy of key's state, so the state held by the store is
+// left as it was.
+func (g *GCRA) inspect(ctx context.Context, key string, nowNanos int64) (*GCRABucket, error) {
+	stored, err := g.load(ctx, key, nowNanos)
+	if err != nil {
+		return nil, err
+	}
+	bucket := *stored
+	g.advance(&bucket, nowNanos)
+	return &bucket, nil
+}
+
+// refund moves key's TAT back by n emission intervals after a reservation
+// is cancelled.
+func (g *GCRA) refund(ctx context.Context, key string, n int) error {
+	mu := g.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	nowNanos := time.Now().UnixNano()
+	return update(ctx, g.state, key, func(bucket *GCRABucket) (*GCRABucket, time.Duration, error) {
+		if bucket == nil {
+			return nil, 0, nil
+		}
+		// A TAT moved back to now behaves like no state, and its ttl lets
+		// it expire right away
+		bucket.TAT = max(bucket.TAT-int64(n)*g.interval(), nowNanos)
+		return bucket, g.ttl(bucket, nowNanos), nil
+	})
+}
+
+// load fetches key's state, starting with a TAT of now when the key is new.
+func (g *GCRA) load(ctx context.Context, key string, nowNanos int64) (*GCRABucket, error) {
+	bucket, err := g.state.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bucket state: %w", err)
+	}
+	if bucket == nil {
+		bucket = g.newBucket(nowNanos)
+	}
+	return bucket, nil
+}
+
+// newBucket starts with a TAT of now for a key with no state.
+func (g *GCRA) newBucket(nowNanos int64) *GCRABucket {
+	return &GCRABucket{TAT: nowNanos}
+}
+
+// advance moves a TAT that has already passed up to now, since capacity
+// unused while idle does not accumulate beyond the burst.
+func (g *GCRA) advance(bucket *GCRABucket, nowNanos int64) {
+	bucket.TAT = max(bucket.TAT, nowNanos)
+}
+
+// interval is the emission interval, the time it takes to earn one request.
+func (g *GCRA) interval() int64 {
+	return g.Period.Nanoseconds() / int64(g.Limit)
+}
+
+// tolerance is how far ahead of now the TAT may run, which is what lets
+// Burst requests through back to back.
+func (g *GCRA) tolerance() int64 {
+	return g.interval() * int64(g.Burst)
+}
+
+// remaining counts the requests that could still arrive now given tat.
+func (g *GCRA) remaining(tat, nowNanos int64) int {
+	return int(max(g.tolerance()-(tat-nowNanos), 0) / g.interval())
+}
+
+// ttl keeps the state until its TAT has passed, after which a missing key
+// behaves exactly the same.
+func (g *GCRA) ttl(bucket *GCRABucket, nowNanos int64) time.Duration {
+	return time.Duration(bucket.TAT-nowNanos) + time.Millisecond
+}
+
+func (g *GCRA) Reset(ctx context.Context, key string) error {
+	mu := g.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	exists, err := g.store.Exists(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket for key %s does not exist", key)
+	}
+
+	return g.store.Delete(ctx, key)
+}
+
+// ResetPrefix clears every key starting with prefix.
+func (g *GCRA) ResetPrefix(ctx context.Context, prefix string) error {
+	return resetPrefix(ctx, g.store, &g.locks, prefix)
+}
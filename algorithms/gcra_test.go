@@ -0,0 +1,211 @@
+package algorithms
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+func TestGCRAAllow(t *testing.T) {
+	tests := []struct {
+		name     string
+		burst    int
+		requests int
+		expected int
+	}{
+		{
+			name:     "basic allow within burst",
+			burst:    5,
+			requests: 5,
+			expected: 5,
+		},
+		{
+			name:     "deny when burst exceeded",
+			burst:    3,
+			requests: 5,
+			expected: 3,
+		},
+		{
+			name:     "single request",
+			burst:    10,
+			requests: 1,
+			expected: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := store.NewMemoryStore()
+			g := NewGCRA(10, 1*time.Second, tt.burst, s)
+
+			allowed := 0
+			for i := 0; i < tt.requests; i++ {
+				result, err := g.Allow(ctx, "user1")
+				if err == nil && result.Allowed {
+					allowed++
+				}
+			}
+
+			if allowed != tt.expected {
+				t.Errorf("got %d, want %d", allowed, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGCRAMultipleUsers(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	g := NewGCRA(1, 1*time.Second, 2, s)
+
+	for i := 0; i < 2; i++ {
+		if result, err := g.Allow(ctx, "user1"); err != nil || !result.Allowed {
+			t.Errorf("user1 request %d should be allowed", i+1)
+		}
+	}
+	if result, err := g.Allow(ctx, "user1"); err != nil || result.Allowed {
+		t.Error("user1 should be rate limited")
+	}
+
+	if result, err := g.Allow(ctx, "user2"); err != nil || !result.Allowed {
+		t.Error("user2 should not be rate limited")
+	}
+}
+
+func TestGCRARemainingAndRetryAfter(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	g := NewGCRA(10, 1*time.Second, 4, s) // one request every 100ms
+
+	result, err := g.AllowN(ctx, "user1", 3)
+	if err != nil || !result.Allowed {
+		t.Fatal("request of 3 should be allowed")
+	}
+	if result.Remaining != 1 {
+		t.Errorf("remaining: got %d, want 1", result.Remaining)
+	}
+
+	result, err = g.AllowN(ctx, "user1", 3)
+	if err != nil || result.Allowed {
+		t.Fatal("request of 3 should be denied")
+	}
+	// 2 more emission intervals are needed
+	if result.RetryAfter < 190*time.Millisecond || result.RetryAfter > 200*time.Millisecond {
+		t.Errorf("RetryAfter: got %v, want about 200ms", result.RetryAfter)
+	}
+
+	time.Sleep(result.RetryAfter)
+
+	result, err = g.AllowN(ctx, "user1", 3)
+	if err != nil || !result.Allowed {
+		t.Error("request of 3 should be allowed after RetryAfter")
+	}
+}
+
+func TestGCRASmoothRefill(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	g := NewGCRA(20, 1*time.Second, 1, s) // one request every 50ms
+
+	if result, _ := g.Allow(ctx, "user1"); !result.Allowed {
+		t.Fatal("first request should be allowed")
+	}
+	if result, _ := g.Allow(ctx, "user1"); result.Allowed {
+		t.Fatal("second request should be denied")
+	}
+
+	// Capacity is earned continuously, not in whole seconds
+	time.Sleep(60 * time.Millisecond)
+	if result, _ := g.Allow(ctx, "user1"); !result.Allowed {
+		t.Error("request after one emission interval should be allowed")
+	}
+}
+
+func TestGCRAStoresSingleTimestamp(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	g := NewGCRA(10, 1*time.Second, 5, s)
+
+	before := time.Now().UnixNano()
+	_, _ = g.AllowN(ctx, "user1", 2)
+
+	bucketData, _ := s.Get(ctx, "user1")
+	bucket := bucketData.(*GCRABucket)
+	if bucket.TAT < before+200*int64(time.Millisecond) {
+		t.Errorf("TAT should be at least 200ms ahead, got %v", time.Duration(bucket.TAT-before))
+	}
+}
+
+func TestGCRAPeekAndInspect(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	g := NewGCRA(10, 1*time.Second, 3, s)
+
+	_, _ = g.AllowN(ctx, "user1", 2)
+
+	result, err := g.Peek(ctx, "user1")
+	if err != nil || !result.Allowed || result.Remaining != 1 {
+		t.Errorf("peek: got %+v, want allowed with 1 remaining", result)
+	}
+
+	bucket, err := g.Inspect(ctx, "user1")
+	if err != nil {
+		t.Fatalf("inspect failed: %v", err)
+	}
+	if bucket.TAT <= time.Now().UnixNano() {
+		t.Error("inspected TAT should be in the future")
+	}
+
+	if result, _ := g.Allow(ctx, "user1"); !result.Allowed {
+		t.Error("peek should not have consumed the last request")
+	}
+}
+
+func TestGCRAReset(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	g := NewGCRA(1, 1*time.Minute, 1, s)
+
+	_, _ = g.Allow(ctx, "user1")
+	if err := g.Reset(ctx, "user1"); err != nil {
+		t.Fatalf("reset failed: %v", err)
+	}
+
+	if result, _ := g.Allow(ctx, "user1"); !result.Allowed {
+		t.Error("request after reset should be allowed")
+	}
+
+	if err := g.Reset(ctx, "nonexistent"); err == nil {
+		t.Error("reset nonexistent should return error")
+	}
+}
+
+func TestGCRAConcurrency(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	g := NewGCRA(1, 1*time.Minute, 100, s)
+
+	done := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			allowed := 0
+			for j := 0; j < 20; j++ {
+				if result, err := g.Allow(ctx, "concurrent_user"); err == nil && result.Allowed {
+					allowed++
+				}
+			}
+			done <- allowed
+		}()
+	}
+
+	total := 0
+	for i := 0; i < 10; i++ {
+		total += <-done
+	}
+	if total != 100 {
+		t.Errorf("concurrent total: got %d, want 100", total)
+	}
+}
@@ -0,0 +1,101 @@
+package algorithms
+
+import "fmt"
+
+// NewHierarchy builds a limiter for keys that draw on a shared pool, such as
+// users within an organization. parentKey maps a request key to its parent's
+// key. Every request must pass each child policy, which limits the key on
+// its own, and the parent policy, which limits all keys with the same parent
+// together. Admission is charged at every level or at none of them, and a
+// denial names the exhausted level in DeniedBy.
+//
+// When maxShare is above 0, no single key may use more than that fraction of
+// the parent pool. It is enforced by a copy of the parent limiter scaled down
+// to the share, reported as "<parent>-share".
+//
+// The parent pool is kept under "<parent>:<parentKey(key)>" and is left
+// alone by Reset, which only clears the key's own levels.
+func NewHierarchy(parentKey func(key string) string, parent Policy, maxShare float64, children ...Policy) *Composite {
+	if parentKey == nil {
+		panic("parentKey must not be nil")
+	}
+	if maxShare < 0 || maxShare > 1 {
+		panic("maxShare must be between 0 and 1")
+	}
+
+	policies := make([]Policy, 0, len(children)+2)
+	policies = append(policies, children...)
+	if maxShare > 0 {
+		s, ok := parent.Limiter.(sharer)
+		if !ok {
+			panic(fmt.Sprintf("policy %q: limiter %T cannot be shared", parent.Name, parent.Limiter))
+		}
+		policies = append(policies, Policy{Name: parent.Name + "-share", Limiter: s.share(maxShare)})
+	}
+	policies = append(policies, parent)
+
+	// NewComposite validates the names and gives the child levels their keys
+	c := NewComposite(policies...)
+	last := len(c.policies) - 1
+	parentPrefix := prefixKey(parent.Name)
+	c.policies[last].key = func(key string) string {
+		return parentPrefix(parentKey(key))
+	}
+	c.policies[last].shared = true
+	return c
+}
+
+// sharer is implemented by algorithms that can hand out a smaller copy of
+// themselves, used to cap one key's share of a parent pool.
+type sharer interface {
+	share(fraction float64) RateLimiter
+}
+
+func (tb *TokenBucket) share(fraction float64) RateLimiter {
+	return NewTokenBucket(scale(tb.Capacity, fraction), scale(tb.RefillRate, fraction), tb.store)
+}
+
+func (lb *LeakyBucket) share(fraction float64) RateLimiter {
+	return NewLeakyBucket(scale(lb.Capacity, fraction), scale(lb.Rate, fraction), lb.store)
+}
+
+func (fw *FixedWindow) share(fraction float64) RateLimiter {
+	return NewFixedWindow(scale(fw.Limit, fraction), fw.WindowSize, fw.store)
+}
+
+func (sw *SlidingWindow) share(fraction float64) RateLimiter {
+	return NewSlidingWindow(scale(sw.Limit, fraction), sw.WindowSize, sw.store)
+}
+
+func (swc *SlidingWindowCounter) share(fraction float64) RateLimiter {
+	return NewSlidingWindowCounter(scale(swc.Limit, fraction), swc.WindowSize, swc.store)
+}
+
+func (g *GCRA) share(fraction float64) RateLimiter {
+	return NewGCRA(scale(g.Limit, fraction), g.Period, scale(g.Burst, fraction), g.store)
+}
+
+func (tb *RedisTokenBucket) share(fraction float64) RateLimiter {
+	return NewRedisTokenBucket(scale(tb.Capacity, fraction), scale(tb.RefillRate, fraction), tb.store)
+}
+
+func (lb *RedisLeakyBucket) share(fraction float64) RateLimiter {
+	return NewRedisLeakyBucket(scale(lb.Capacity, fraction), scale(lb.Rate, fraction), lb.store)
+}
+
+func (fw *RedisFixedWindow) share(fraction float64) RateLimiter {
+	return NewRedisFixedWindow(scale(fw.Limit, fraction), fw.WindowSize, fw.store)
+}
+
+func (sw *RedisSlidingWindow) share(fraction float64) RateLimiter {
+	return NewRedisSlidingWindow(scale(sw.Limit, fraction), sw.WindowSize, sw.store)
+}
+
+func (swc *RedisSlidingWindowCounter) share(fraction float64) RateLimiter {
+	return NewRedisSlidingWindowCounter(scale(swc.Limit, fraction), swc.WindowSize, swc.store)
+}
+
+// scale returns fraction of v, rounded down but never below 1.
+func scale(v int, fraction float64) int {
+	return max(int(float64(v)*fraction), 1)
+}
@@ -0,0 +1,122 @@
+package algorithms
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+// orgOf maps "org:user" keys to their organization.
+func orgOf(key string) string {
+	org, _, _ := strings.Cut(key, ":")
+	return org
+}
+
+func TestHierarchyParentPool(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	h := NewHierarchy(orgOf,
+		Policy{Name: "org", Limiter: NewFixedWindow(5, time.Minute, s)},
+		0,
+		Policy{Name: "user", Limiter: NewFixedWindow(3, time.Minute, s)},
+	)
+
+	allowed := 0
+	for _, user := range []string{"acme:alice", "acme:bob", "acme:carol"} {
+		for i := 0; i < 3; i++ {
+			result, err := h.Allow(ctx, user)
+			if err == nil && result.Allowed {
+				allowed++
+			}
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("got %d allowed across the org, want 5", allowed)
+	}
+
+	result, _ := h.Allow(ctx, "acme:carol")
+	if result.DeniedBy != "org" {
+		t.Errorf("DeniedBy = %q, want org", result.DeniedBy)
+	}
+
+	// Another organization has its own pool
+	result, _ = h.Allow(ctx, "globex:alice")
+	if !result.Allowed {
+		t.Error("request from another org should be allowed")
+	}
+}
+
+func TestHierarchyChildLimit(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	org := NewFixedWindow(10, time.Minute, s)
+	h := NewHierarchy(orgOf,
+		Policy{Name: "org", Limiter: org},
+		0,
+		Policy{Name: "user", Limiter: NewFixedWindow(2, time.Minute, s)},
+	)
+
+	h.Allow(ctx, "acme:alice")
+	h.Allow(ctx, "acme:alice")
+	result, _ := h.Allow(ctx, "acme:alice")
+	if result.Allowed || result.DeniedBy != "user" {
+		t.Errorf("got %+v, want denial by user", result)
+	}
+
+	// The denied request must not have been charged to the org
+	bucket, _ := org.Inspect(ctx, "org:acme")
+	if bucket.Count != 2 {
+		t.Errorf("org pool counted %d requests, want 2", bucket.Count)
+	}
+}
+
+func TestHierarchyMaxShare(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	h := NewHierarchy(orgOf,
+		Policy{Name: "org", Limiter: NewTokenBucket(10, 1, s)},
+		0.3,
+	)
+
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		result, _ := h.Allow(ctx, "acme:alice")
+		if result.Allowed {
+			allowed++
+		} else if result.DeniedBy != "org-share" {
+			t.Errorf("DeniedBy = %q, want org-share", result.DeniedBy)
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("got %d allowed, want 3 (30%% of 10)", allowed)
+	}
+
+	result, _ := h.Allow(ctx, "acme:bob")
+	if !result.Allowed {
+		t.Error("another user should still have a share of the pool")
+	}
+}
+
+func TestHierarchyResetKeepsParentPool(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	h := NewHierarchy(orgOf,
+		Policy{Name: "org", Limiter: NewFixedWindow(3, time.Minute, s)},
+		0,
+		Policy{Name: "user", Limiter: NewFixedWindow(3, time.Minute, s)},
+	)
+
+	for i := 0; i < 3; i++ {
+		h.Allow(ctx, "acme:alice")
+	}
+	if err := h.Reset(ctx, "acme:alice"); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	result, _ := h.Allow(ctx, "acme:alice")
+	if result.Allowed || result.DeniedBy != "org" {
+		t.Errorf("got %+v, want the org pool to stay exhausted", result)
+	}
+}
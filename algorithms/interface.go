@@ -2,6 +2,7 @@ package algorithms
 
 import (
 	"context"
+	"fmt"
 	"time"
 )
 
@@ -10,8 +11,54 @@ type Result struct {
 	Limit      int
 	Remaining  int
 	RetryAfter time.Duration
+	DeniedBy   string // Name of the policy that denied the request, set by Composite
+	Degraded   bool   // Decided by a FailSafe's failure policy because the store failed
 }
 type RateLimiter interface {
 	Allow(ctx context.Context, key string) (Result, error)
+	// AllowN checks and consumes n units for key in one step. Nothing is
+	// consumed when the request is denied.
+	AllowN(ctx context.Context, key string, n int) (Result, error)
 	Reset(ctx context.Context, key string) error
 }
+
+// Waiter is implemented by limiters that can block until a request is
+// admitted, or book capacity ahead of time instead of rejecting.
+type Waiter interface {
+	Wait(ctx context.Context, key string) error
+	WaitN(ctx context.Context, key string, n int) error
+	Reserve(ctx context.Context, key string) (*Reservation, error)
+	ReserveN(ctx context.Context, key string, n int) (*Reservation, error)
+}
+
+// Peeker is implemented by limiters that can report a key's quota without
+// consuming any of it.
+type Peeker interface {
+	Peek(ctx context.Context, key string) (Result, error)
+}
+
+// BatchLimiter is implemented by limiters that can check a request for each
+// of many keys at once, with a round trip or two to the store for the whole
+// batch instead of one or two per key. Results are in the order of keys.
+type BatchLimiter interface {
+	AllowMany(ctx context.Context, keys []string) ([]Result, error)
+}
+
+// PrefixResetter is implemented by limiters that can clear every key
+// starting with a prefix, such as all the keys of one tenant. The limiter's
+// store must implement store.Scanner.
+type PrefixResetter interface {
+	ResetPrefix(ctx context.Context, prefix string) error
+}
+
+// checkN validates the cost of a request against the limiter's limit. A
+// request costing more than the limit could never be admitted.
+func checkN(n, limit int) error {
+	if n <= 0 {
+		return fmt.Errorf("n must be greater than 0, got %d", n)
+	}
+	if n > limit {
+		return fmt.Errorf("n (%d) exceeds limit (%d)", n, limit)
+	}
+	return nil
+}
@@ -2,9 +2,7 @@ package algorithms
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"sync"
 	"time"
 
 	"github.com/codetesla51/limitz/store"
@@ -19,7 +17,8 @@ type LeakyBucket struct {
 	Capacity int
 	Rate     int
 	store    store.Store
-	mu       sync.Mutex
+	state    *store.Typed[LeakyBucketUser]
+	locks    keyLocks
 }
 
 func NewLeakyBucket(capacity, rate int, s store.Store) *LeakyBucket {
@@ -27,54 +26,120 @@ func NewLeakyBucket(capacity, rate int, s store.Store) *LeakyBucket {
 		Capacity: capacity,
 		Rate:     rate,
 		store:    s,
+		state:    store.NewTyped[LeakyBucketUser](s),
 	}
 }
 
 func (lb *LeakyBucket) Allow(ctx context.Context, key string) (Result, error) {
-	lb.mu.Lock()
-	defer lb.mu.Unlock()
+	return lb.AllowN(ctx, key, 1)
+}
+
+// AllowN checks if n requests fit in the queue together and enqueues all of
+// them at once, or none of them.
+func (lb *LeakyBucket) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	res, err := lb.reserveN(ctx, key, n, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return res.result(), nil
+}
+
+// AllowMany queues a request for each of keys whose queue has room. With a
+// store.BatchUpdater, the queues of the whole batch are updated in one
+// atomic step.
+func (lb *LeakyBucket) AllowMany(ctx context.Context, keys []string) ([]Result, error) {
+	return allowMany(ctx, lb.state, &lb.locks, keys, lb.reserve)
+}
+
+// Wait blocks until the queue has room for a request for key.
+func (lb *LeakyBucket) Wait(ctx context.Context, key string) error {
+	return lb.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until the queue has room for n requests for key.
+func (lb *LeakyBucket) WaitN(ctx context.Context, key string, n int) error {
+	return waitN(ctx, lb, key, n)
+}
+
+// Reserve books a place in the queue for key.
+func (lb *LeakyBucket) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return lb.ReserveN(ctx, key, 1)
+}
+
+// ReserveN books n places in the queue for key. The queue may grow past its
+// capacity, and later requests are denied until it has leaked back down.
+func (lb *LeakyBucket) ReserveN(ctx context.Context, key string, n int) (*Reservation, error) {
+	return lb.reserveN(ctx, key, n, maxWait)
+}
+
+func (lb *LeakyBucket) reserveN(ctx context.Context, key string, n int, maxDelay time.Duration) (*Reservation, error) {
+	if err := checkN(n, lb.Capacity); err != nil {
+		return nil, err
+	}
+
+	mu := lb.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
 
 	now := time.Now()
 
-	// GET bucket from store
-	bucketData, err := lb.store.Get(ctx, key)
-	var bucket *LeakyBucketUser
+	var res *Reservation
+	err := update(ctx, lb.state, key, func(bucket *LeakyBucketUser) (*LeakyBucketUser, time.Duration, error) {
+		var ttl time.Duration
+		bucket, ttl, res = lb.reserve(bucket, n, now, maxDelay)
+		return bucket, ttl, nil
+	})
 	if err != nil {
-		bucket = &LeakyBucketUser{
-			Queue:    0,
-			LastLeak: now,
-		}
-	} else {
-		// Handle both MemoryStore (returns struct) and RedisStore (returns JSON string)
-		switch v := bucketData.(type) {
-		case *LeakyBucketUser:
-			bucket = v
-		case string:
-			bucket = &LeakyBucketUser{}
-			if err := json.Unmarshal([]byte(v), bucket); err != nil {
-				bucket = &LeakyBucketUser{Queue: 0, LastLeak: now}
-			}
-		default:
-			bucket = &LeakyBucketUser{Queue: 0, LastLeak: now}
+		return nil, err
+	}
+	if res.ok {
+		res.cancel = func(ctx context.Context) error {
+			return lb.refund(ctx, key, n)
 		}
 	}
+	return res, nil
+}
 
-	// Calculate leakage
-	elapsed := now.Sub(bucket.LastLeak).Seconds()
-	bucket.LastLeak = now
-	leaked := int(elapsed * float64(lb.Rate))
-	bucket.Queue -= leaked
-	if bucket.Queue < 0 {
-		bucket.Queue = 0
+// reserve adds n requests to bucket's queue, or to a new queue if bucket is
+// nil, if it has room for them within maxDelay of now. It returns the queue
+// to store, or nil when nothing was added.
+func (lb *LeakyBucket) reserve(bucket *LeakyBucketUser, n int, now time.Time, maxDelay time.Duration) (*LeakyBucketUser, time.Duration, *Reservation) {
+	if bucket == nil {
+		bucket = lb.newBucket(now)
 	}
+	lb.leak(bucket, now)
 
 	// Check capacity
-	if bucket.Queue < lb.Capacity {
-		bucket.Queue++
-		err := lb.store.Set(ctx, key, bucket, 1*time.Hour)
-		if err != nil {
-			return Result{}, fmt.Errorf("failed to save bucket state: %v", err)
-		}
+	var delay time.Duration
+	if bucket.Queue+n > lb.Capacity {
+		delay = lb.retryAfter(bucket, n, now)
+	}
+
+	res := newReservation(lb.Capacity, now, delay, maxDelay)
+	if !res.ok {
+		res.remaining = max(lb.Capacity-bucket.Queue, 0)
+		return nil, 0, res
+	}
+
+	bucket.Queue += n
+	res.remaining = max(lb.Capacity-bucket.Queue, 0)
+	return bucket, lb.ttl(bucket, now), res
+}
+
+// Peek reports whether a request for key would be allowed right now without
+// enqueueing it. Remaining is the room currently left in the queue.
+func (lb *LeakyBucket) Peek(ctx context.Context, key string) (Result, error) {
+	mu := lb.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	bucket, err := lb.inspect(ctx, key, now)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if bucket.Queue+1 <= lb.Capacity {
 		return Result{
 			Allowed:    true,
 			Limit:      lb.Capacity,
@@ -82,22 +147,109 @@ func (lb *LeakyBucket) Allow(ctx context.Context, key string) (Result, error) {
 			RetryAfter: 0,
 		}, nil
 	}
-
-	err = lb.store.Set(ctx, key, bucket, 1*time.Hour)
-	if err != nil {
-		return Result{}, fmt.Errorf("failed to save bucket state: %v", err)
-	}
 	return Result{
 		Allowed:    false,
 		Limit:      lb.Capacity,
 		Remaining:  0,
-		RetryAfter: time.Duration(float64(time.Second) / float64(lb.Rate)),
+		RetryAfter: lb.retryAfter(bucket, 1, now),
 	}, nil
 }
 
+// Inspect returns key's queue with the leak applied up to now. A key with no
+// state yet gets an empty queue. Nothing is written back to the store.
+func (lb *LeakyBucket) Inspect(ctx context.Context, key string) (*LeakyBucketUser, error) {
+	mu := lb.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+	return lb.inspect(ctx, key, time.Now())
+}
+
+// inspect leaks a copy of key's bucket, so the state held by the store is
+// left as it was.
+func (lb *LeakyBucket) inspect(ctx context.Context, key string, now time.Time) (*LeakyBucketUser, error) {
+	stored, err := lb.load(ctx, key, now)
+	if err != nil {
+		return nil, err
+	}
+	bucket := *stored
+	lb.leak(&bucket, now)
+	return &bucket, nil
+}
+
+// refund takes n requests back out of key's queue after a reservation is
+// cancelled.
+func (lb *LeakyBucket) refund(ctx context.Context, key string, n int) error {
+	mu := lb.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	return update(ctx, lb.state, key, func(bucket *LeakyBucketUser) (*LeakyBucketUser, time.Duration, error) {
+		if bucket == nil {
+			return nil, 0, nil
+		}
+		lb.leak(bucket, now)
+		bucket.Queue = max(bucket.Queue-n, 0)
+		return bucket, lb.ttl(bucket, now), nil
+	})
+}
+
+// load fetches key's bucket, starting an empty queue when the key is new.
+func (lb *LeakyBucket) load(ctx context.Context, key string, now time.Time) (*LeakyBucketUser, error) {
+	bucket, err := lb.state.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bucket state: %w", err)
+	}
+	if bucket == nil {
+		bucket = lb.newBucket(now)
+	}
+	return bucket, nil
+}
+
+// newBucket starts an empty queue for a key with no state.
+func (lb *LeakyBucket) newBucket(now time.Time) *LeakyBucketUser {
+	return &LeakyBucketUser{
+		Queue:    0,
+		LastLeak: now,
+	}
+}
+
+// leak drains the requests processed since the last leak. LastLeak only
+// advances by the time those requests took, so partial progress towards the
+// next leak is kept.
+func (lb *LeakyBucket) leak(bucket *LeakyBucketUser, now time.Time) {
+	leaked := int(now.Sub(bucket.LastLeak).Seconds() * float64(lb.Rate))
+	if leaked > 0 {
+		bucket.Queue -= leaked
+		bucket.LastLeak = bucket.LastLeak.Add(time.Duration(leaked) * time.Second / time.Duration(lb.Rate))
+	}
+	if bucket.Queue <= 0 {
+		bucket.Queue = 0
+		bucket.LastLeak = now
+	}
+}
+
+// retryAfter returns how long until the queue has room for n more requests.
+func (lb *LeakyBucket) retryAfter(bucket *LeakyBucketUser, n int, now time.Time) time.Duration {
+	excess := int64(bucket.Queue + n - lb.Capacity)
+	rate := int64(lb.Rate)
+	wait := time.Duration((excess*int64(time.Second) + rate - 1) / rate)
+	return max(bucket.LastLeak.Add(wait).Sub(now), 0)
+}
+
+// ttl keeps the bucket around for an hour past the point where a queue
+// grown beyond capacity by reservations has drained back down.
+func (lb *LeakyBucket) ttl(bucket *LeakyBucketUser, now time.Time) time.Duration {
+	if bucket.Queue <= lb.Capacity {
+		return 1 * time.Hour
+	}
+	return 1*time.Hour + lb.retryAfter(bucket, 0, now)
+}
+
 func (lb *LeakyBucket) Reset(ctx context.Context, key string) error {
-	lb.mu.Lock()
-	defer lb.mu.Unlock()
+	mu := lb.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
 
 	exists, err := lb.store.Exists(ctx, key)
 	if err != nil {
@@ -109,3 +261,8 @@ func (lb *LeakyBucket) Reset(ctx context.Context, key string) error {
 
 	return lb.store.Delete(ctx, key)
 }
+
+// ResetPrefix clears every key starting with prefix.
+func (lb *LeakyBucket) ResetPrefix(ctx context.Context, prefix string) error {
+	return resetPrefix(ctx, lb.store, &lb.locks, prefix)
+}
@@ -192,3 +192,64 @@ func TestLeakyBucketConcurrency(t *testing.T) {
 		t.Errorf("concurrent queue: got %d, want 100", bucket.Queue)
 	}
 }
+
+func TestLeakyBucketAllowN(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	lb := NewLeakyBucket(10, 2, s)
+
+	result, err := lb.AllowN(ctx, "user1", 9)
+	if err != nil || !result.Allowed {
+		t.Fatal("request of 9 should be allowed")
+	}
+
+	// 3 more would overflow the queue by 2
+	result, err = lb.AllowN(ctx, "user1", 3)
+	if err != nil || result.Allowed {
+		t.Error("request of 3 should be denied")
+	}
+	if result.Remaining != 1 {
+		t.Errorf("remaining: got %d, want 1", result.Remaining)
+	}
+	// 2 requests leak out in 1s at rate 2
+	if result.RetryAfter <= 500*time.Millisecond || result.RetryAfter > 1*time.Second {
+		t.Errorf("RetryAfter: got %v, want about 1s", result.RetryAfter)
+	}
+
+	bucketData, _ := s.Get(ctx, "user1")
+	bucket := bucketData.(*LeakyBucketUser)
+	if bucket.Queue != 9 {
+		t.Errorf("queue after denial: got %d, want 9", bucket.Queue)
+	}
+}
+
+func TestLeakyBucketPeekAndInspect(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	lb := NewLeakyBucket(5, 10, s)
+
+	_, _ = lb.AllowN(ctx, "user1", 5)
+
+	result, err := lb.Peek(ctx, "user1")
+	if err != nil {
+		t.Fatalf("peek failed: %v", err)
+	}
+	if result.Allowed || result.RetryAfter <= 0 {
+		t.Errorf("peek on a full queue should be denied with RetryAfter, got %+v", result)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+
+	bucket, err := lb.Inspect(ctx, "user1")
+	if err != nil {
+		t.Fatalf("inspect failed: %v", err)
+	}
+	if bucket.Queue > 3 {
+		t.Errorf("inspected queue: got %d, want at most 3 after leaking", bucket.Queue)
+	}
+
+	bucketData, _ := s.Get(ctx, "user1")
+	if stored := bucketData.(*LeakyBucketUser); stored.Queue != 5 {
+		t.Errorf("stored queue: got %d, want 5", stored.Queue)
+	}
+}
@@ -0,0 +1,53 @@
+package algorithms
+
+import "sync"
+
+// lockStripes is how many mutexes a limiter spreads its keys over.
+const lockStripes = 256
+
+// keyLocks serializes operations on the same key while letting operations on
+// different keys run in parallel, so one slow store round trip only holds up
+// requests for its own key. Keys are hashed onto a fixed set of mutexes:
+// memory stays constant however many keys there are, at the cost of two keys
+// occasionally sharing a mutex. The zero value is ready to use.
+type keyLocks struct {
+	stripes [lockStripes]sync.Mutex
+}
+
+// mutex returns the mutex guarding key.
+func (l *keyLocks) mutex(key string) *sync.Mutex {
+	return &l.stripes[stripe(key)]
+}
+
+// lockMany locks the mutexes guarding keys and returns a function that
+// unlocks them. They are always locked in the same order, so two batches
+// sharing some of their mutexes cannot deadlock.
+func (l *keyLocks) lockMany(keys []string) (unlock func()) {
+	var held [lockStripes]bool
+	for _, key := range keys {
+		held[stripe(key)] = true
+	}
+	for i := range held {
+		if held[i] {
+			l.stripes[i].Lock()
+		}
+	}
+	return func() {
+		for i := range held {
+			if held[i] {
+				l.stripes[i].Unlock()
+			}
+		}
+	}
+}
+
+// stripe returns the index of the mutex guarding key.
+func stripe(key string) uint32 {
+	// FNV-1a, inlined so that hashing does not allocate
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h % lockStripes
+}
@@ -0,0 +1,155 @@
+package algorithms
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+// survivors returns which of keys are still in s.
+func survivors(t *testing.T, s *store.MemoryStore, keys ...string) []string {
+	t.Helper()
+	var out []string
+	for _, key := range keys {
+		ok, err := s.Exists(context.Background(), key)
+		if err != nil {
+			t.Fatalf("Exists returned error: %v", err)
+		}
+		if ok {
+			out = append(out, key)
+		}
+	}
+	return out
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	tests := []struct {
+		eviction store.EvictionPolicy
+		evicted  string
+	}{
+		{store.EvictLRU, "b"},
+		{store.EvictLFU, "c"},
+		{store.EvictEarliestExpiry, "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.eviction.String(), func(t *testing.T) {
+			ctx := context.Background()
+			s := store.NewMemoryStoreWithOptions(store.MemoryOptions{MaxEntries: 3, Shards: 1, Eviction: tt.eviction})
+			defer s.Close()
+
+			s.Set(ctx, "a", 1, time.Minute)
+			s.Set(ctx, "b", 1, time.Hour)
+			s.Get(ctx, "b")
+			s.Set(ctx, "c", 1, time.Hour)
+			// a is now the most recently used, and b the most frequently
+			s.Get(ctx, "a")
+			s.Set(ctx, "d", 1, time.Hour)
+
+			if _, err := s.Get(ctx, tt.evicted); !errors.Is(err, store.ErrNotFound) {
+				t.Errorf("got %v for %s, want it evicted", err, tt.evicted)
+			}
+			if got := survivors(t, s, "a", "b", "c", "d"); len(got) != 3 {
+				t.Errorf("got keys %v, want 3", got)
+			}
+			if stats := s.Stats(); stats.Entries != 3 || stats.Evictions != 1 {
+				t.Errorf("got %+v, want 3 entries and 1 eviction", stats)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreMaxEntriesAcrossShards(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStoreWithOptions(store.MemoryOptions{MaxEntries: 100})
+	defer s.Close()
+	limiter := NewFixedWindow(3, time.Minute, s)
+
+	// A client rotating through many keys cannot grow the store
+	for i := 0; i < 1000; i++ {
+		if _, err := limiter.Allow(ctx, "ip"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Allow returned error: %v", err)
+		}
+	}
+	stats := s.Stats()
+	if stats.Entries > 100 {
+		t.Errorf("got %d entries, want at most 100", stats.Entries)
+	}
+	if stats.Evictions != uint64(1000-stats.Entries) {
+		t.Errorf("got %d evictions for %d entries, want every other key evicted", stats.Evictions, stats.Entries)
+	}
+}
+
+func TestMemoryStoreMaxBytes(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStoreWithOptions(store.MemoryOptions{MaxBytes: 4096, Shards: 1})
+	defer s.Close()
+
+	for i := 0; i < 100; i++ {
+		s.Set(ctx, strconv.Itoa(i), make([]byte, 256), time.Minute)
+	}
+	stats := s.Stats()
+	if stats.Bytes > 4096 || stats.Bytes < 2048 {
+		t.Errorf("got %d bytes, want close to but within 4096", stats.Bytes)
+	}
+	if stats.Entries == 0 || stats.Evictions != uint64(100-stats.Entries) {
+		t.Errorf("got %+v, want the oldest entries evicted", stats)
+	}
+
+	// An entry larger than the bound is still kept, on its own
+	s.Set(ctx, "large", make([]byte, 8192), time.Minute)
+	if got := survivors(t, s, "large"); len(got) != 1 || s.Stats().Entries != 1 {
+		t.Errorf("got %+v, want only the large entry", s.Stats())
+	}
+}
+
+func TestMemoryStoreSmallMaxBytes(t *testing.T) {
+	ctx := context.Background()
+	// Fewer bytes than the default 16 shards must still bound the store
+	s := store.NewMemoryStoreWithOptions(store.MemoryOptions{MaxBytes: 8})
+	defer s.Close()
+
+	for i := 0; i < 100; i++ {
+		s.Set(ctx, strconv.Itoa(i), 1, time.Minute)
+	}
+	if stats := s.Stats(); stats.Entries > 8 {
+		t.Errorf("got %d entries, want at most one for each of 8 shards", stats.Entries)
+	}
+}
+
+func TestMemoryStoreCountsMaps(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStoreWithOptions(store.MemoryOptions{MaxBytes: 4096, Shards: 1})
+	defer s.Close()
+
+	bucket := &ConcurrencyBucket{Leases: make(map[string]int64)}
+	for i := 0; i < 100; i++ {
+		bucket.Leases["lease"+strconv.Itoa(i)] = int64(i)
+	}
+	s.Set(ctx, "small", 1, time.Minute)
+	s.Set(ctx, "leases", bucket, time.Minute)
+	// 100 leases of a string and an int64 each take more than 2,400 bytes
+	if stats := s.Stats(); stats.Bytes < 2400 {
+		t.Errorf("got %d bytes, want the map's keys and values counted", stats.Bytes)
+	}
+}
+
+func TestMemoryStoreSweepInterval(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStoreWithOptions(store.MemoryOptions{SweepInterval: 10 * time.Millisecond})
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		s.Set(ctx, strconv.Itoa(i), 1, time.Millisecond)
+	}
+	deadline := time.Now().Add(time.Second)
+	for s.Stats().Entries != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := s.Stats().Entries; n != 0 {
+		t.Errorf("got %d entries, want expired ones swept", n)
+	}
+}
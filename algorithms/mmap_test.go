@@ -0,0 +1,139 @@
+//go:build linux
+
+package algorithms
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+func newMmapStore(t *testing.T, path string, slots int) *store.MmapStore {
+	t.Helper()
+	s, err := store.NewMmapStore(path, slots, 256)
+	if err != nil {
+		t.Fatalf("NewMmapStore returned error: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestMmapStoreSharedBetweenProcesses(t *testing.T) {
+	for name, newLimiter := range rateLimiters() {
+		t.Run(name, func(t *testing.T) {
+			// Each store opens the file on its own, with its own file lock,
+			// as separate processes would
+			path := filepath.Join(t.TempDir(), "limits")
+			first := newLimiter(newMmapStore(t, path, 64))
+			second := newLimiter(newMmapStore(t, path, 64))
+			if got := allowedAcross(t, first, second); got != 3 {
+				t.Errorf("got %d allowed, want 3", got)
+			}
+
+			path = filepath.Join(t.TempDir(), "batches")
+			first = newLimiter(newMmapStore(t, path, 64))
+			second = newLimiter(newMmapStore(t, path, 64))
+			if got := allowedManyAcross(t, first, second); got != 3 {
+				t.Errorf("got %d allowed in batches, want 3", got)
+			}
+		})
+	}
+}
+
+func TestMmapStoreOperations(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "limits")
+	s := newMmapStore(t, path, 8)
+
+	if _, err := s.Get(ctx, "missing"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+	s.Set(ctx, "short", []byte("a"), time.Millisecond)
+	s.Set(ctx, "key", []byte("b"), time.Hour)
+	time.Sleep(2 * time.Millisecond)
+	if _, err := s.Get(ctx, "short"); !errors.Is(err, store.ErrExpired) {
+		t.Errorf("got %v, want ErrExpired", err)
+	}
+	if err := s.Delete(ctx, "key"); err != nil {
+		t.Errorf("Delete returned error: %v", err)
+	}
+	if ok, _ := s.Exists(ctx, "key"); ok {
+		t.Error("key exists after Delete")
+	}
+
+	// Deleted and expired slots are reused, so all 8 slots can be filled
+	for i := 0; i < 8; i++ {
+		if err := s.Set(ctx, strconv.Itoa(i), []byte("v"), time.Hour); err != nil {
+			t.Fatalf("Set %d returned error: %v", i, err)
+		}
+	}
+	if err := s.Set(ctx, "one more", []byte("v"), time.Hour); err == nil {
+		t.Error("want an error once every slot is in use")
+	}
+	if err := s.Set(ctx, "0", make([]byte, 512), time.Hour); err == nil {
+		t.Error("want an error for a value larger than a slot")
+	}
+
+	// The state outlives the store, for the next process to open the file
+	s.Close()
+	if _, err := s.Get(ctx, "7"); !errors.Is(err, store.ErrBackend) {
+		t.Errorf("got %v after Close, want a backend error", err)
+	}
+	reopened := newMmapStore(t, path, 8)
+	if val, err := reopened.Get(ctx, "7"); err != nil || string(val.([]byte)) != "v" {
+		t.Errorf("got %v, %v after reopening, want the stored value", val, err)
+	}
+	if _, err := store.NewMmapStore(path, 16, 256); err == nil {
+		t.Error("want an error when the sizes do not match the file")
+	}
+}
+
+func TestMmapStoreScan(t *testing.T) {
+	ctx := context.Background()
+	s := newMmapStore(t, filepath.Join(t.TempDir(), "limits"), 16)
+	s.Set(ctx, "tenant1:alice", []byte("v"), time.Hour)
+	s.Set(ctx, "tenant2:alice", []byte("v"), time.Hour)
+	s.Set(ctx, "tenant1:gone", []byte("v"), time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+
+	if got := scanned(t, s, store.PrefixPattern("tenant1:")); len(got) != 1 || got[0] != "tenant1:alice" {
+		t.Errorf("got %v, want the live tenant1 key", got)
+	}
+}
+
+func TestMmapStoreReclaimsDeletedSlots(t *testing.T) {
+	ctx := context.Background()
+	const slots = 20000
+	missTime := func(s *store.MmapStore) time.Duration {
+		start := time.Now()
+		for i := 0; i < 1000; i++ {
+			s.Exists(ctx, "missing"+strconv.Itoa(i))
+		}
+		return time.Since(start)
+	}
+	fresh := missTime(newMmapStore(t, filepath.Join(t.TempDir(), "fresh"), slots))
+
+	s := newMmapStore(t, filepath.Join(t.TempDir(), "churned"), slots)
+	for i := 0; i < slots; i++ {
+		if err := s.Set(ctx, strconv.Itoa(i), []byte("v"), time.Hour); err != nil {
+			t.Fatalf("Set %d returned error: %v", i, err)
+		}
+	}
+	for i := 0; i < slots; i++ {
+		if err := s.Delete(ctx, strconv.Itoa(i)); err != nil {
+			t.Fatalf("Delete %d returned error: %v", i, err)
+		}
+	}
+	// Each miss would otherwise probe all 20,000 deleted slots
+	if churned := missTime(s); churned > 20*fresh+5*time.Millisecond {
+		t.Errorf("1000 misses took %v after deleting every key, want close to the %v of a new store", churned, fresh)
+	}
+	if err := s.Set(ctx, "again", []byte("v"), time.Hour); err != nil {
+		t.Errorf("Set after deleting every key returned error: %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package algorithms
+
+import (
+	"context"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+var redisFixedWindowScript = store.NewScript(redisPrelude + `
+local limit = tonumber(ARGV[4])
+local size = tonumber(ARGV[5])
+local current = math.floor(now / size)
+
+local count, window = 0, current
+local state = redis.call('HMGET', KEYS[1], 'count', 'window')
+local found = state[1] ~= false
+if found then
+  count, window = tonumber(state[1]), tonumber(state[2])
+end
+
+-- Requests reserved beyond the limit of a past window carry over
+local elapsed = current - window
+if elapsed ~= 0 then
+  if elapsed < 0 or elapsed > math.floor(count / limit) then
+    count = 0
+  else
+    count = count - limit * elapsed
+  end
+  window = current
+end
+
+local function save()
+  redis.call('HSET', KEYS[1], 'count', count, 'window', window)
+  local ahead = math.floor(count / limit)
+  redis.call('PEXPIRE', KEYS[1], math.ceil((window + ahead + 1) * size / 1000 - now / 1000))
+end
+
+if mode == 'refund' then
+  if found then
+    count = math.max(count - n, 0)
+    save()
+  end
+  return {1, math.max(limit - count, 0), 0}
+end
+
+local delay = 0
+if count + n > limit then
+  local ahead = math.floor((count + n - 1) / limit)
+  delay = (window + ahead) * size - now
+end
+if mode == 'peek' or not fits(delay) then
+  return {fits(delay) and 1 or 0, math.max(limit - count, 0), delay}
+end
+
+count = count + n
+save()
+return {1, math.max(limit - count, 0), delay}
+`)
+
+// RedisFixedWindow is a FixedWindow that runs inside Redis. Each request is
+// checked and counted by one Lua script, so the limit holds exactly across
+// any number of processes sharing the store. Windows are aligned to the
+// Redis server's clock at microsecond resolution. Its state is a Redis hash
+// and is not compatible with FixedWindow's.
+type RedisFixedWindow struct {
+	Limit      int
+	WindowSize time.Duration
+	store      *store.RedisStore
+}
+
+func NewRedisFixedWindow(limit int, windowSize time.Duration, s *store.RedisStore) *RedisFixedWindow {
+	if windowSize < time.Microsecond {
+		panic("windowSize must be at least 1 microsecond")
+	}
+	if limit <= 0 {
+		panic("limit must be greater than 0")
+	}
+	return &RedisFixedWindow{
+		Limit:      limit,
+		WindowSize: windowSize,
+		store:      s,
+	}
+}
+
+func (fw *RedisFixedWindow) Allow(ctx context.Context, key string) (Result, error) {
+	return fw.AllowN(ctx, key, 1)
+}
+
+// AllowN checks if n requests fit in the current window and counts all of
+// them at once, or none of them.
+func (fw *RedisFixedWindow) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	res, err := fw.reserveN(ctx, key, n, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return res.result(), nil
+}
+
+// AllowMany checks a request for each of keys, sending the script runs for
+// the whole batch in one pipeline. Each request is still decided atomically.
+func (fw *RedisFixedWindow) AllowMany(ctx context.Context, keys []string) ([]Result, error) {
+	calls := make([]store.ScriptCall, len(keys))
+	for i, key := range keys {
+		calls[i] = fw.call(key, "reserve", 1, 0)
+	}
+	return allowManyRedis(ctx, fw.store, redisFixedWindowScript, fw.Limit, calls)
+}
+
+// Wait blocks until a request for key fits in a window.
+func (fw *RedisFixedWindow) Wait(ctx context.Context, key string) error {
+	return fw.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until n requests for key fit in a window.
+func (fw *RedisFixedWindow) WaitN(ctx context.Context, key string, n int) error {
+	return waitN(ctx, fw, key, n)
+}
+
+// Reserve books a request for key in the first window with room for it.
+func (fw *RedisFixedWindow) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return fw.ReserveN(ctx, key, 1)
+}
+
+// ReserveN books n requests for key in the first window with room for them.
+func (fw *RedisFixedWindow) ReserveN(ctx context.Context, key string, n int) (*Reservation, error) {
+	return fw.reserveN(ctx, key, n, maxWait)
+}
+
+func (fw *RedisFixedWindow) reserveN(ctx context.Context, key string, n int, maxDelay time.Duration) (*Reservation, error) {
+	if err := checkN(n, fw.Limit); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	reply, err := fw.eval(ctx, key, "reserve", n, maxDelay)
+	if err != nil {
+		return nil, err
+	}
+	return reply.reservation(fw.Limit, now, func(ctx context.Context) error {
+		_, err := fw.eval(ctx, key, "refund", n, 0)
+		return err
+	}), nil
+}
+
+// Peek reports whether a request for key would be allowed right now without
+// counting it.
+func (fw *RedisFixedWindow) Peek(ctx context.Context, key string) (Result, error) {
+	reply, err := fw.eval(ctx, key, "peek", 1, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return reply.result(fw.Limit), nil
+}
+
+func (fw *RedisFixedWindow) eval(ctx context.Context, key, mode string, n int, maxDelay time.Duration) (redisReply, error) {
+	return evalRedis(ctx, fw.store, redisFixedWindowScript, fw.call(key, mode, n, maxDelay))
+}
+
+func (fw *RedisFixedWindow) call(key, mode string, n int, maxDelay time.Duration) store.ScriptCall {
+	return redisCall(key, mode, n, maxDelay, fw.Limit, fw.WindowSize.Microseconds())
+}
+
+func (fw *RedisFixedWindow) Reset(ctx context.Context, key string) error {
+	return resetRedis(ctx, fw.store, key)
+}
+
+// ResetPrefix clears every key starting with prefix.
+func (fw *RedisFixedWindow) ResetPrefix(ctx context.Context, prefix string) error {
+	return resetPrefix(ctx, fw.store, nil, prefix)
+}
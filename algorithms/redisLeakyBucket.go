@@ -0,0 +1,175 @@
+package algorithms
+
+import (
+	"context"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+var redisLeakyBucketScript = store.NewScript(redisPrelude + `
+local capacity = tonumber(ARGV[4])
+local rate = tonumber(ARGV[5])
+
+local queue, last = 0, now
+local state = redis.call('HMGET', KEYS[1], 'queue', 'last')
+local found = state[1] ~= false
+if found then
+  queue, last = tonumber(state[1]), tonumber(state[2])
+end
+
+-- last only advances by the time the leaked requests took
+local leaked = math.floor((now - last) * rate / 1000000)
+if leaked > 0 then
+  queue = queue - leaked
+  last = last + math.floor(leaked * 1000000 / rate)
+end
+if queue <= 0 then
+  queue, last = 0, now
+end
+
+local function retry_after(k)
+  local wait = math.ceil((queue + k - capacity) * 1000000 / rate)
+  return math.max(last + wait - now, 0)
+end
+
+local function save()
+  redis.call('HSET', KEYS[1], 'queue', queue, 'last', last)
+  local ttl = 3600000
+  if queue > capacity then
+    ttl = ttl + math.ceil(retry_after(0) / 1000)
+  end
+  redis.call('PEXPIRE', KEYS[1], ttl)
+end
+
+if mode == 'refund' then
+  if found then
+    queue = math.max(queue - n, 0)
+    save()
+  end
+  return {1, math.max(capacity - queue, 0), 0}
+end
+
+local delay = 0
+if queue + n > capacity then
+  delay = retry_after(n)
+end
+if mode == 'peek' or not fits(delay) then
+  return {fits(delay) and 1 or 0, math.max(capacity - queue, 0), delay}
+end
+
+queue = queue + n
+save()
+return {1, math.max(capacity - queue, 0), delay}
+`)
+
+// RedisLeakyBucket is a LeakyBucket that runs inside Redis. Each request is
+// checked and enqueued by one Lua script, so the limit holds exactly across
+// any number of processes sharing the store. Its state is a Redis hash and
+// is not compatible with LeakyBucket's.
+type RedisLeakyBucket struct {
+	Capacity int
+	Rate     int
+	store    *store.RedisStore
+}
+
+func NewRedisLeakyBucket(capacity, rate int, s *store.RedisStore) *RedisLeakyBucket {
+	if capacity <= 0 {
+		panic("capacity must be greater than 0")
+	}
+	if rate <= 0 {
+		panic("rate must be greater than 0")
+	}
+	return &RedisLeakyBucket{
+		Capacity: capacity,
+		Rate:     rate,
+		store:    s,
+	}
+}
+
+func (lb *RedisLeakyBucket) Allow(ctx context.Context, key string) (Result, error) {
+	return lb.AllowN(ctx, key, 1)
+}
+
+// AllowN checks if n requests fit in the queue together and enqueues all of
+// them at once, or none of them.
+func (lb *RedisLeakyBucket) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	res, err := lb.reserveN(ctx, key, n, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return res.result(), nil
+}
+
+// AllowMany checks a request for each of keys, sending the script runs for
+// the whole batch in one pipeline. Each request is still decided atomically.
+func (lb *RedisLeakyBucket) AllowMany(ctx context.Context, keys []string) ([]Result, error) {
+	calls := make([]store.ScriptCall, len(keys))
+	for i, key := range keys {
+		calls[i] = lb.call(key, "reserve", 1, 0)
+	}
+	return allowManyRedis(ctx, lb.store, redisLeakyBucketScript, lb.Capacity, calls)
+}
+
+// Wait blocks until a request for key fits in the queue.
+func (lb *RedisLeakyBucket) Wait(ctx context.Context, key string) error {
+	return lb.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until n requests for key fit in the queue.
+func (lb *RedisLeakyBucket) WaitN(ctx context.Context, key string, n int) error {
+	return waitN(ctx, lb, key, n)
+}
+
+// Reserve books a place in the queue for key, see ReserveN.
+func (lb *RedisLeakyBucket) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return lb.ReserveN(ctx, key, 1)
+}
+
+// ReserveN books n places in the queue for key, letting it grow past its
+// capacity until it has leaked back down.
+func (lb *RedisLeakyBucket) ReserveN(ctx context.Context, key string, n int) (*Reservation, error) {
+	return lb.reserveN(ctx, key, n, maxWait)
+}
+
+func (lb *RedisLeakyBucket) reserveN(ctx context.Context, key string, n int, maxDelay time.Duration) (*Reservation, error) {
+	if err := checkN(n, lb.Capacity); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	reply, err := lb.eval(ctx, key, "reserve", n, maxDelay)
+	if err != nil {
+		return nil, err
+	}
+	return reply.reservation(lb.Capacity, now, func(ctx context.Context) error {
+		_, err := lb.eval(ctx, key, "refund", n, 0)
+		return err
+	}), nil
+}
+
+// Peek reports whether a request for key would be allowed right now without
+// enqueueing it.
+func (lb *RedisLeakyBucket) Peek(ctx context.Context, key string) (Result, error) {
+	reply, err := lb.eval(ctx, key, "peek", 1, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return reply.result(lb.Capacity), nil
+}
+
+func (lb *RedisLeakyBucket) eval(ctx context.Context, key, mode string, n int, maxDelay time.Duration) (redisReply, error) {
+	return evalRedis(ctx, lb.store, redisLeakyBucketScript, lb.call(key, mode, n, maxDelay))
+}
+
+func (lb *RedisLeakyBucket) call(key, mode string, n int, maxDelay time.Duration) store.ScriptCall {
+	return redisCall(key, mode, n, maxDelay, lb.Capacity, lb.Rate)
+}
+
+func (lb *RedisLeakyBucket) Reset(ctx context.Context, key string) error {
+	return resetRedis(ctx, lb.store, key)
+}
+
+// ResetPrefix clears every key starting with prefix.
+func (lb *RedisLeakyBucket) ResetPrefix(ctx context.Context, prefix string) error {
+	return resetPrefix(ctx, lb.store, nil, prefix)
+}
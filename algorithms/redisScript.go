@@ -0,0 +1,123 @@
+package algorithms
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+// redisPrelude starts every Redis script. ARGV[1] is the mode, one of
+// "reserve", "peek" or "refund", ARGV[2] is the cost n and ARGV[3] is the
+// longest delay a reservation may have in microseconds, or -1 for no limit.
+// The algorithm's own settings follow from ARGV[4].
+//
+// Time is read from the Redis server rather than the caller, so every process
+// sharing the store works from the same clock. All times are microseconds.
+const redisPrelude = `
+local mode = ARGV[1]
+local n = tonumber(ARGV[2])
+local max_delay = tonumber(ARGV[3])
+local clock = redis.call('TIME')
+local now = tonumber(clock[1]) * 1000000 + tonumber(clock[2])
+
+local function fits(delay)
+  return max_delay < 0 or delay <= max_delay
+end
+`
+
+// redisReply is what every script returns: whether the request was admitted,
+// the quota left, how long the request must wait, and a token the script
+// needs back to refund the request.
+type redisReply struct {
+	ok        bool
+	remaining int
+	delay     time.Duration
+	token     int64
+}
+
+// evalRedis runs one of the algorithm scripts.
+func evalRedis(ctx context.Context, s *store.RedisStore, script *store.Script, call store.ScriptCall) (redisReply, error) {
+	val, err := s.Eval(ctx, script, call.Keys, call.Args...)
+	if err != nil {
+		return redisReply{}, err
+	}
+	return parseRedisReply(val)
+}
+
+// redisCall builds the arguments of a script run for key, in the order
+// redisPrelude reads them.
+func redisCall(key, mode string, n int, maxDelay time.Duration, args ...interface{}) store.ScriptCall {
+	maxDelayMicros := int64(-1)
+	if maxDelay != maxWait {
+		maxDelayMicros = maxDelay.Microseconds()
+	}
+	return store.ScriptCall{
+		Keys: []string{key},
+		Args: append([]interface{}{mode, n, maxDelayMicros}, args...),
+	}
+}
+
+func parseRedisReply(val interface{}) (redisReply, error) {
+	fields, ok := val.([]interface{})
+	if !ok || len(fields) < 3 || len(fields) > 4 {
+		return redisReply{}, fmt.Errorf("unexpected reply from script: %v", val)
+	}
+	ints := make([]int64, 4)
+	for i, f := range fields {
+		v, ok := f.(int64)
+		if !ok {
+			return redisReply{}, fmt.Errorf("unexpected reply from script: %v", val)
+		}
+		ints[i] = v
+	}
+	return redisReply{
+		ok:        ints[0] == 1,
+		remaining: int(ints[1]),
+		delay:     time.Duration(ints[2]) * time.Microsecond,
+		token:     ints[3],
+	}, nil
+}
+
+// reservation turns the reply to a "reserve" call into a Reservation. The
+// script has already decided whether it fits, so ok is taken from the reply.
+func (r redisReply) reservation(limit int, now time.Time, cancel func(ctx context.Context) error) *Reservation {
+	res := newReservation(limit, now, r.delay, maxWait)
+	res.ok = r.ok
+	res.remaining = r.remaining
+	if r.ok {
+		res.cancel = cancel
+	}
+	return res
+}
+
+// result turns the reply to a "peek" call into a Result.
+func (r redisReply) result(limit int) Result {
+	if r.ok {
+		return Result{
+			Allowed:    true,
+			Limit:      limit,
+			Remaining:  r.remaining,
+			RetryAfter: 0,
+		}
+	}
+	return Result{
+		Allowed:    false,
+		Limit:      limit,
+		Remaining:  0,
+		RetryAfter: r.delay,
+	}
+}
+
+// resetRedis deletes key, failing if there is no state for it.
+func resetRedis(ctx context.Context, s *store.RedisStore, key string) error {
+	exists, err := s.Exists(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket for key %s does not exist", key)
+	}
+	return s.Delete(ctx, key)
+}
@@ -0,0 +1,231 @@
+package algorithms
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/codetesla51/limitz/store"
+)
+
+func newTestRedisStore(t *testing.T) *store.RedisStore {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	s, err := store.NewRedisStore(mr.Addr(), "", "")
+	if err != nil {
+		t.Fatalf("failed to connect to miniredis: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// redisLimiter is what every Redis variant implements.
+type redisLimiter interface {
+	RateLimiter
+	Waiter
+	Peeker
+	BatchLimiter
+}
+
+// newRedisLimiters builds every Redis variant with a limit of 3 over a
+// period long enough that nothing refills during a test.
+func newRedisLimiters(s *store.RedisStore) map[string]redisLimiter {
+	return map[string]redisLimiter{
+		"tokenBucket":          NewRedisTokenBucket(3, 1, s),
+		"leakyBucket":          NewRedisLeakyBucket(3, 1, s),
+		"fixedWindow":          NewRedisFixedWindow(3, time.Hour, s),
+		"slidingWindow":        NewRedisSlidingWindow(3, time.Hour, s),
+		"slidingWindowCounter": NewRedisSlidingWindowCounter(3, time.Hour, s),
+	}
+}
+
+func TestRedisLimitersAllow(t *testing.T) {
+	ctx := context.Background()
+	for name := range newRedisLimiters(nil) {
+		t.Run(name, func(t *testing.T) {
+			l := newRedisLimiters(newTestRedisStore(t))[name]
+			for i := 0; i < 3; i++ {
+				result, err := l.Allow(ctx, "user1")
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !result.Allowed {
+					t.Fatalf("request %d should be allowed", i+1)
+				}
+				if result.Remaining != 2-i {
+					t.Errorf("request %d: Remaining = %d, want %d", i+1, result.Remaining, 2-i)
+				}
+			}
+
+			result, err := l.Allow(ctx, "user1")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.Allowed {
+				t.Error("request over the limit should be denied")
+			}
+			if result.RetryAfter <= 0 {
+				t.Errorf("expected RetryAfter > 0, got %v", result.RetryAfter)
+			}
+
+			other, _ := l.Allow(ctx, "user2")
+			if !other.Allowed {
+				t.Error("another key should have its own limit")
+			}
+		})
+	}
+}
+
+func TestRedisLimitersAllowN(t *testing.T) {
+	ctx := context.Background()
+	for name := range newRedisLimiters(nil) {
+		t.Run(name, func(t *testing.T) {
+			l := newRedisLimiters(newTestRedisStore(t))[name]
+			result, _ := l.AllowN(ctx, "user1", 2)
+			if !result.Allowed {
+				t.Fatal("AllowN(2) should be allowed")
+			}
+			result, _ = l.AllowN(ctx, "user1", 2)
+			if result.Allowed {
+				t.Fatal("AllowN(2) over the limit should be denied")
+			}
+			// The denied request consumed nothing
+			result, _ = l.Allow(ctx, "user1")
+			if !result.Allowed {
+				t.Error("last unit should still be available")
+			}
+			if _, err := l.AllowN(ctx, "user1", 4); err == nil {
+				t.Error("expected error for n over the limit")
+			}
+		})
+	}
+}
+
+func TestRedisLimitersExactAcrossInstances(t *testing.T) {
+	ctx := context.Background()
+	for name := range newRedisLimiters(nil) {
+		t.Run(name, func(t *testing.T) {
+			// Two sets of limiters stand in for two processes sharing Redis
+			s := newTestRedisStore(t)
+			first, second := newRedisLimiters(s), newRedisLimiters(s)
+			var allowed atomic.Int32
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				l := first[name]
+				if i%2 == 1 {
+					l = second[name]
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					result, err := l.Allow(ctx, "shared")
+					if err == nil && result.Allowed {
+						allowed.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+			if allowed.Load() != 3 {
+				t.Errorf("got %d allowed across instances, want exactly 3", allowed.Load())
+			}
+		})
+	}
+}
+
+func TestRedisLimitersPeekAndReset(t *testing.T) {
+	ctx := context.Background()
+	for name := range newRedisLimiters(nil) {
+		t.Run(name, func(t *testing.T) {
+			l := newRedisLimiters(newTestRedisStore(t))[name]
+			l.Allow(ctx, "user1")
+			for i := 0; i < 3; i++ {
+				result, err := l.Peek(ctx, "user1")
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !result.Allowed || result.Remaining != 2 {
+					t.Fatalf("Peek = %+v, want allowed with 2 remaining", result)
+				}
+			}
+
+			if err := l.Reset(ctx, "user1"); err != nil {
+				t.Fatalf("Reset failed: %v", err)
+			}
+			result, _ := l.Peek(ctx, "user1")
+			if result.Remaining != 3 {
+				t.Errorf("Remaining after reset = %d, want 3", result.Remaining)
+			}
+			if err := l.Reset(ctx, "user1"); err == nil {
+				t.Error("expected error resetting a missing key")
+			}
+		})
+	}
+}
+
+func TestRedisLimitersReserveAndCancel(t *testing.T) {
+	ctx := context.Background()
+	for name := range newRedisLimiters(nil) {
+		t.Run(name, func(t *testing.T) {
+			l := newRedisLimiters(newTestRedisStore(t))[name]
+			l.AllowN(ctx, "user1", 3)
+
+			res, err := l.Reserve(ctx, "user1")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !res.OK() || res.Delay() <= 0 {
+				t.Fatalf("expected a delayed reservation, got ok=%v delay=%v", res.OK(), res.Delay())
+			}
+			if err := res.Cancel(ctx); err != nil {
+				t.Fatalf("Cancel failed: %v", err)
+			}
+
+			// With the reservation cancelled, the wait is back to what it
+			// was before
+			peek, _ := l.Peek(ctx, "user1")
+			if peek.RetryAfter > res.Delay()+500*time.Millisecond {
+				t.Errorf("RetryAfter %v after cancel, reservation delay was %v", peek.RetryAfter, res.Delay())
+			}
+		})
+	}
+}
+
+func TestRedisLimiterInComposite(t *testing.T) {
+	ctx := context.Background()
+	s := newTestRedisStore(t)
+	tb := NewRedisTokenBucket(5, 1, s)
+	c := NewComposite(
+		Policy{Name: "burst", Limiter: tb},
+		Policy{Name: "hourly", Limiter: NewRedisFixedWindow(2, time.Hour, s)},
+	)
+
+	c.Allow(ctx, "user1")
+	c.Allow(ctx, "user1")
+	result, _ := c.Allow(ctx, "user1")
+	if result.Allowed || result.DeniedBy != "hourly" {
+		t.Fatalf("got %+v, want denial by hourly", result)
+	}
+	peek, _ := tb.Peek(ctx, "burst:user1")
+	if peek.Remaining != 3 {
+		t.Errorf("token bucket Remaining = %d, want 3 after rollback", peek.Remaining)
+	}
+}
+
+func TestParseRedisReply(t *testing.T) {
+	if reply, err := parseRedisReply([]interface{}{int64(1), int64(4), int64(250), int64(7)}); err != nil || !reply.ok || reply.remaining != 4 || reply.delay != 250*time.Microsecond || reply.token != 7 {
+		t.Errorf("got %+v, %v, want every field parsed", reply, err)
+	}
+	for _, val := range []interface{}{
+		"OK",
+		[]interface{}{int64(1), int64(4)},
+		[]interface{}{int64(1), "4", int64(0)},
+		[]interface{}{int64(1), int64(4), int64(0), int64(7), int64(9)},
+	} {
+		if _, err := parseRedisReply(val); err == nil {
+			t.Errorf("got no error for %v", val)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package algorithms
+
+import (
+	"context"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+var redisSlidingWindowScript = store.NewScript(redisPrelude + `
+local limit = tonumber(ARGV[4])
+local size = tonumber(ARGV[5])
+local id = ARGV[6]
+
+if mode == 'refund' then
+  for i = 1, n do
+    redis.call('ZREM', KEYS[1], id .. ':' .. i)
+  end
+  return {1, 0, 0}
+end
+
+-- Scores are concatenated with string.format, as Lua's own number to
+-- string conversion would round timestamps this large
+local after_start = string.format('(%d', now - size)
+local count = redis.call('ZCOUNT', KEYS[1], after_start, '+inf')
+
+local delay = 0
+if count + n > limit then
+  local blocking = redis.call('ZRANGEBYSCORE', KEYS[1], after_start, '+inf',
+    'WITHSCORES', 'LIMIT', count + n - limit - 1, 1)
+  delay = math.max(tonumber(blocking[2]) + size - now, 0)
+end
+if mode == 'peek' or not fits(delay) then
+  return {fits(delay) and 1 or 0, math.max(limit - count, 0), delay}
+end
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', string.format('%d', now - size))
+local at = now + delay
+for i = 1, n do
+  redis.call('ZADD', KEYS[1], at, id .. ':' .. i)
+end
+count = count + n
+
+-- Keep the log until its newest entry, which may be a reservation in the
+-- future, has slid out of the window
+local newest = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+local ttl = size + math.max(tonumber(newest[2]) - now, 0)
+redis.call('PEXPIRE', KEYS[1], math.ceil(ttl / 1000))
+return {1, math.max(limit - count, 0), delay}
+`)
+
+// RedisSlidingWindow is a SlidingWindow that runs inside Redis, logging
+// requests in a sorted set scored by time. Each request is checked and
+// logged by one Lua script, so the limit holds exactly across any number of
+// processes sharing the store. Its state is not compatible with
+// SlidingWindow's.
+type RedisSlidingWindow struct {
+	Limit      int
+	WindowSize time.Duration
+	store      *store.RedisStore
+}
+
+func NewRedisSlidingWindow(limit int, windowSize time.Duration, s *store.RedisStore) *RedisSlidingWindow {
+	if windowSize < time.Microsecond {
+		panic("windowSize must be at least 1 microsecond")
+	}
+	if limit <= 0 {
+		panic("limit must be greater than 0")
+	}
+	return &RedisSlidingWindow{
+		Limit:      limit,
+		WindowSize: windowSize,
+		store:      s,
+	}
+}
+
+// Allow checks if a request is allowed under sliding window rate limit
+func (sw *RedisSlidingWindow) Allow(ctx context.Context, key string) (Result, error) {
+	return sw.AllowN(ctx, key, 1)
+}
+
+// AllowN checks if n requests fit in the sliding window and records all of
+// them at once, or none of them.
+func (sw *RedisSlidingWindow) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	res, err := sw.reserveN(ctx, key, n, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return res.result(), nil
+}
+
+// AllowMany checks a request for each of keys, sending the script runs for
+// the whole batch in one pipeline. Each request is still decided atomically
+// and logged under its own member.
+func (sw *RedisSlidingWindow) AllowMany(ctx context.Context, keys []string) ([]Result, error) {
+	calls := make([]store.ScriptCall, len(keys))
+	for i, key := range keys {
+		id, err := newLeaseID()
+		if err != nil {
+			return nil, err
+		}
+		calls[i] = sw.call(key, "reserve", 1, 0, id)
+	}
+	return allowManyRedis(ctx, sw.store, redisSlidingWindowScript, sw.Limit, calls)
+}
+
+// Wait blocks until a request for key fits in the sliding window.
+func (sw *RedisSlidingWindow) Wait(ctx context.Context, key string) error {
+	return sw.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until n requests for key fit in the sliding window.
+func (sw *RedisSlidingWindow) WaitN(ctx context.Context, key string, n int) error {
+	return waitN(ctx, sw, key, n)
+}
+
+// Reserve books a request for key at the earliest time it fits.
+func (sw *RedisSlidingWindow) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return sw.ReserveN(ctx, key, 1)
+}
+
+// ReserveN books n requests for key at the earliest time they fit, logging
+// them with that future timestamp.
+func (sw *RedisSlidingWindow) ReserveN(ctx context.Context, key string, n int) (*Reservation, error) {
+	return sw.reserveN(ctx, key, n, maxWait)
+}
+
+func (sw *RedisSlidingWindow) reserveN(ctx context.Context, key string, n int, maxDelay time.Duration) (*Reservation, error) {
+	if err := checkN(n, sw.Limit); err != nil {
+		return nil, err
+	}
+	// Each request is logged under a unique member, so a cancelled
+	// reservation can remove exactly its own entries
+	id, err := newLeaseID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	reply, err := sw.eval(ctx, key, "reserve", n, maxDelay, id)
+	if err != nil {
+		return nil, err
+	}
+	return reply.reservation(sw.Limit, now, func(ctx context.Context) error {
+		_, err := sw.eval(ctx, key, "refund", n, 0, id)
+		return err
+	}), nil
+}
+
+// Peek reports whether a request for key would be allowed right now without
+// logging it.
+func (sw *RedisSlidingWindow) Peek(ctx context.Context, key string) (Result, error) {
+	reply, err := sw.eval(ctx, key, "peek", 1, 0, "")
+	if err != nil {
+		return Result{}, err
+	}
+	return reply.result(sw.Limit), nil
+}
+
+func (sw *RedisSlidingWindow) eval(ctx context.Context, key, mode string, n int, maxDelay time.Duration, id string) (redisReply, error) {
+	return evalRedis(ctx, sw.store, redisSlidingWindowScript, sw.call(key, mode, n, maxDelay, id))
+}
+
+func (sw *RedisSlidingWindow) call(key, mode string, n int, maxDelay time.Duration, id string) store.ScriptCall {
+	return redisCall(key, mode, n, maxDelay, sw.Limit, sw.WindowSize.Microseconds(), id)
+}
+
+func (sw *RedisSlidingWindow) Reset(ctx context.Context, key string) error {
+	return resetRedis(ctx, sw.store, key)
+}
+
+// ResetPrefix clears every key starting with prefix.
+func (sw *RedisSlidingWindow) ResetPrefix(ctx context.Context, prefix string) error {
+	return resetPrefix(ctx, sw.store, nil, prefix)
+}
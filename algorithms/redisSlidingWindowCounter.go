@@ -0,0 +1,199 @@
+package algorithms
+
+import (
+	"context"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+var redisSlidingWindowCounterScript = store.NewScript(redisPrelude + `
+local limit = tonumber(ARGV[4])
+local size = tonumber(ARGV[5])
+local current = math.floor(now / size)
+local into = now - current * size
+
+local prev, cur, window = 0, 0, current
+local state = redis.call('HMGET', KEYS[1], 'prev', 'cur', 'window')
+local found = state[1] ~= false
+if found then
+  prev, cur, window = tonumber(state[1]), tonumber(state[2]), tonumber(state[3])
+end
+
+-- Requests reserved beyond the limit of a window carry over
+local elapsed = current - window
+if elapsed < 0 then
+  prev, cur = 0, 0
+end
+while elapsed > 0 and (prev > 0 or cur > 0) do
+  prev = math.min(cur, limit)
+  cur = math.max(cur - limit, 0)
+  elapsed = elapsed - 1
+end
+window = current
+
+local function save()
+  redis.call('HSET', KEYS[1], 'prev', prev, 'cur', cur, 'window', window)
+  redis.call('PEXPIRE', KEYS[1], math.ceil(size * (2 + math.floor(cur / limit)) / 1000))
+end
+
+if mode == 'refund' then
+  local made_in = tonumber(ARGV[6])
+  if found and current == made_in then
+    cur = math.max(cur - n, 0)
+    save()
+  elseif found and current == made_in + 1 then
+    prev = math.max(prev - n, 0)
+    save()
+  end
+  return {1, 0, 0}
+end
+
+local estimate = prev * (size - into) / size + cur
+
+-- Roll the counters forward one window at a time until the estimate drops
+-- below the limit
+local function retry_after()
+  local p, c, t, waited = prev, cur, into, 0
+  while true do
+    local room = limit - c - n + 1
+    if room > 0 then
+      local target = 0
+      if p > room then
+        target = math.floor(size * (1 - room / p)) + 1
+      end
+      if target >= t then
+        return waited + target - t
+      end
+    end
+    waited = waited + size - t
+    t = 0
+    p = math.min(c, limit)
+    c = math.max(c - limit, 0)
+  end
+end
+
+local delay = 0
+if estimate + n - 1 >= limit then
+  delay = retry_after()
+end
+if mode == 'peek' or not fits(delay) then
+  return {fits(delay) and 1 or 0, math.max(limit - math.floor(estimate), 0), delay, current}
+end
+
+cur = cur + n
+save()
+return {1, math.max(limit - math.floor(estimate) - n, 0), delay, current}
+`)
+
+// RedisSlidingWindowCounter is a SlidingWindowCounter that runs inside
+// Redis. Each request is checked and counted by one Lua script, so the limit
+// holds across any number of processes sharing the store, with the same
+// approximation as SlidingWindowCounter. Its state is a Redis hash and is
+// not compatible with SlidingWindowCounter's.
+type RedisSlidingWindowCounter struct {
+	Limit      int
+	WindowSize time.Duration
+	store      *store.RedisStore
+}
+
+func NewRedisSlidingWindowCounter(limit int, windowSize time.Duration, s *store.RedisStore) *RedisSlidingWindowCounter {
+	if windowSize < time.Microsecond {
+		panic("windowSize must be at least 1 microsecond")
+	}
+	if limit <= 0 {
+		panic("limit must be greater than 0")
+	}
+	return &RedisSlidingWindowCounter{
+		Limit:      limit,
+		WindowSize: windowSize,
+		store:      s,
+	}
+}
+
+func (swc *RedisSlidingWindowCounter) Allow(ctx context.Context, key string) (Result, error) {
+	return swc.AllowN(ctx, key, 1)
+}
+
+// AllowN checks if n requests fit under the estimated count and counts all
+// of them at once, or none of them.
+func (swc *RedisSlidingWindowCounter) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	res, err := swc.reserveN(ctx, key, n, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return res.result(), nil
+}
+
+// AllowMany checks a request for each of keys, sending the script runs for
+// the whole batch in one pipeline. Each request is still decided atomically.
+func (swc *RedisSlidingWindowCounter) AllowMany(ctx context.Context, keys []string) ([]Result, error) {
+	calls := make([]store.ScriptCall, len(keys))
+	for i, key := range keys {
+		calls[i] = swc.call(key, "reserve", 1, 0, 0)
+	}
+	return allowManyRedis(ctx, swc.store, redisSlidingWindowCounterScript, swc.Limit, calls)
+}
+
+// Wait blocks until a request for key fits under the estimated count.
+func (swc *RedisSlidingWindowCounter) Wait(ctx context.Context, key string) error {
+	return swc.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until n requests for key fit under the estimated count.
+func (swc *RedisSlidingWindowCounter) WaitN(ctx context.Context, key string, n int) error {
+	return waitN(ctx, swc, key, n)
+}
+
+// Reserve books a request for key at the earliest time it fits.
+func (swc *RedisSlidingWindowCounter) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return swc.ReserveN(ctx, key, 1)
+}
+
+// ReserveN books n requests for key at the earliest time they fit. They are
+// counted in the current window and any beyond its limit carry over.
+func (swc *RedisSlidingWindowCounter) ReserveN(ctx context.Context, key string, n int) (*Reservation, error) {
+	return swc.reserveN(ctx, key, n, maxWait)
+}
+
+func (swc *RedisSlidingWindowCounter) reserveN(ctx context.Context, key string, n int, maxDelay time.Duration) (*Reservation, error) {
+	if err := checkN(n, swc.Limit); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	reply, err := swc.eval(ctx, key, "reserve", n, maxDelay, 0)
+	if err != nil {
+		return nil, err
+	}
+	return reply.reservation(swc.Limit, now, func(ctx context.Context) error {
+		_, err := swc.eval(ctx, key, "refund", n, 0, reply.token)
+		return err
+	}), nil
+}
+
+// Peek reports whether a request for key would be allowed right now without
+// counting it.
+func (swc *RedisSlidingWindowCounter) Peek(ctx context.Context, key string) (Result, error) {
+	reply, err := swc.eval(ctx, key, "peek", 1, 0, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return reply.result(swc.Limit), nil
+}
+
+func (swc *RedisSlidingWindowCounter) eval(ctx context.Context, key, mode string, n int, maxDelay time.Duration, window int64) (redisReply, error) {
+	return evalRedis(ctx, swc.store, redisSlidingWindowCounterScript, swc.call(key, mode, n, maxDelay, window))
+}
+
+func (swc *RedisSlidingWindowCounter) call(key, mode string, n int, maxDelay time.Duration, window int64) store.ScriptCall {
+	return redisCall(key, mode, n, maxDelay, swc.Limit, swc.WindowSize.Microseconds(), window)
+}
+
+func (swc *RedisSlidingWindowCounter) Reset(ctx context.Context, key string) error {
+	return resetRedis(ctx, swc.store, key)
+}
+
+// ResetPrefix clears every key starting with prefix.
+func (swc *RedisSlidingWindowCounter) ResetPrefix(ctx context.Context, prefix string) error {
+	return resetPrefix(ctx, swc.store, nil, prefix)
+}
@@ -0,0 +1,86 @@
+package algorithms
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/codetesla51/limitz/store"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisStoreOptions(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	s, err := store.NewRedisStoreWithOptions(store.RedisOptions{
+		UniversalOptions: redis.UniversalOptions{Addrs: []string{mr.Addr()}, DB: 2},
+		KeyPrefix:        "app:",
+		HashTags:         true,
+	})
+	if err != nil {
+		t.Fatalf("failed to connect to miniredis: %v", err)
+	}
+	defer s.Close()
+
+	if _, err := NewFixedWindow(3, time.Minute, s).Allow(ctx, "user1"); err != nil {
+		t.Fatalf("Allow returned error: %v", err)
+	}
+	if _, err := NewRedisTokenBucket(3, 1, s).Allow(ctx, "user2"); err != nil {
+		t.Fatalf("Allow returned error: %v", err)
+	}
+	if err := s.Set(ctx, "order:{user1}:total", "1", time.Minute); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	want := []string{"app:order:{user1}:total", "app:{user1}", "app:{user2}"}
+	if got := mr.DB(2).Keys(); !slices.Equal(got, want) {
+		t.Errorf("got keys %v in DB 2, want %v", got, want)
+	}
+	if got := mr.Keys(); len(got) != 0 {
+		t.Errorf("got keys %v in DB 0, want none", got)
+	}
+	if _, err := s.Get(ctx, "order:{user1}:total"); err != nil {
+		t.Errorf("Get returned error: %v", err)
+	}
+}
+
+func TestRedisStoreFromClient(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	s, err := store.NewRedisStoreFromClient(client)
+	if err != nil {
+		t.Fatalf("NewRedisStoreFromClient returned error: %v", err)
+	}
+	if _, err := NewRedisSlidingWindow(3, time.Minute, s).Allow(ctx, "user1"); err != nil {
+		t.Fatalf("Allow returned error: %v", err)
+	}
+	s.Close()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Errorf("client was closed with the store: %v", err)
+	}
+}
+
+func TestRedisStoreCluster(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	s, err := store.NewRedisStoreWithOptions(store.RedisOptions{
+		UniversalOptions: redis.UniversalOptions{Addrs: []string{mr.Addr()}, IsClusterMode: true},
+		HashTags:         true,
+	})
+	if err != nil {
+		t.Fatalf("failed to connect to miniredis: %v", err)
+	}
+	defer s.Close()
+
+	for name, l := range newRedisLimiters(s) {
+		if result, err := l.Allow(ctx, name); err != nil || !result.Allowed {
+			t.Errorf("%s: got %+v, %v, want allowed", name, result, err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package algorithms
+
+import (
+	"context"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+var redisTokenBucketScript = store.NewScript(redisPrelude + `
+local capacity = tonumber(ARGV[4])
+local rate = tonumber(ARGV[5])
+
+local tokens, last = capacity, now
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local found = state[1] ~= false
+if found then
+  tokens, last = tonumber(state[1]), tonumber(state[2])
+end
+
+-- Only whole seconds are credited, the fraction carries over
+local seconds = math.floor((now - last) / 1000000)
+if seconds > 0 then
+  tokens = math.min(tokens + seconds * rate, capacity)
+  last = last + seconds * 1000000
+end
+if tokens >= capacity then
+  last = now
+end
+
+local function retry_after(k)
+  local wait = math.ceil((k - tokens) / rate)
+  return math.max(last + wait * 1000000 - now, 0)
+end
+
+local function save()
+  redis.call('HSET', KEYS[1], 'tokens', tokens, 'last', last)
+  local ttl = 3600000
+  if tokens < 0 then
+    ttl = ttl + math.ceil(retry_after(0) / 1000)
+  end
+  redis.call('PEXPIRE', KEYS[1], ttl)
+end
+
+if mode == 'refund' then
+  if found then
+    tokens = math.min(tokens + n, capacity)
+    save()
+  end
+  return {1, math.max(tokens, 0), 0}
+end
+
+local delay = 0
+if tokens < n then
+  delay = retry_after(n)
+end
+if mode == 'peek' or not fits(delay) then
+  return {fits(delay) and 1 or 0, math.max(tokens, 0), delay}
+end
+
+tokens = tokens - n
+save()
+return {1, math.max(tokens, 0), delay}
+`)
+
+// RedisTokenBucket is a TokenBucket that runs inside Redis. Each request is
+// checked and counted by one Lua script, so the limit holds exactly across
+// any number of processes sharing the store. Its state is a Redis hash and
+// is not compatible with TokenBucket's.
+type RedisTokenBucket struct {
+	Capacity   int
+	RefillRate int
+	store      *store.RedisStore
+}
+
+func NewRedisTokenBucket(capacity, refillRate int, s *store.RedisStore) *RedisTokenBucket {
+	if capacity <= 0 {
+		panic("capacity must be greater than 0")
+	}
+	if refillRate <= 0 {
+		panic("refillRate must be greater than 0")
+	}
+	return &RedisTokenBucket{
+		Capacity:   capacity,
+		RefillRate: refillRate,
+		store:      s,
+	}
+}
+
+// Allow checks if a request is allowed using token bucket rate limiting.
+func (tb *RedisTokenBucket) Allow(ctx context.Context, key string) (Result, error) {
+	return tb.AllowN(ctx, key, 1)
+}
+
+// AllowN checks if a request costing n tokens is allowed, consuming all n
+// tokens at once or none of them.
+func (tb *RedisTokenBucket) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	res, err := tb.reserveN(ctx, key, n, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return res.result(), nil
+}
+
+// AllowMany checks a request for each of keys, sending the script runs for
+// the whole batch in one pipeline. Each request is still decided atomically.
+func (tb *RedisTokenBucket) AllowMany(ctx context.Context, keys []string) ([]Result, error) {
+	calls := make([]store.ScriptCall, len(keys))
+	for i, key := range keys {
+		calls[i] = tb.call(key, "reserve", 1, 0)
+	}
+	return allowManyRedis(ctx, tb.store, redisTokenBucketScript, tb.Capacity, calls)
+}
+
+// Wait blocks until a token for key is available.
+func (tb *RedisTokenBucket) Wait(ctx context.Context, key string) error {
+	return tb.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until n tokens for key are available.
+func (tb *RedisTokenBucket) WaitN(ctx context.Context, key string, n int) error {
+	return waitN(ctx, tb, key, n)
+}
+
+// Reserve books a token for key, see ReserveN.
+func (tb *RedisTokenBucket) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return tb.ReserveN(ctx, key, 1)
+}
+
+// ReserveN books n tokens for key, taking the bucket into debt when it does
+// not hold enough.
+func (tb *RedisTokenBucket) ReserveN(ctx context.Context, key string, n int) (*Reservation, error) {
+	return tb.reserveN(ctx, key, n, maxWait)
+}
+
+func (tb *RedisTokenBucket) reserveN(ctx context.Context, key string, n int, maxDelay time.Duration) (*Reservation, error) {
+	if err := checkN(n, tb.Capacity); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	reply, err := tb.eval(ctx, key, "reserve", n, maxDelay)
+	if err != nil {
+		return nil, err
+	}
+	return reply.reservation(tb.Capacity, now, func(ctx context.Context) error {
+		_, err := tb.eval(ctx, key, "refund", n, 0)
+		return err
+	}), nil
+}
+
+// Peek reports whether a request for key would be allowed right now without
+// consuming a token.
+func (tb *RedisTokenBucket) Peek(ctx context.Context, key string) (Result, error) {
+	reply, err := tb.eval(ctx, key, "peek", 1, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return reply.result(tb.Capacity), nil
+}
+
+func (tb *RedisTokenBucket) eval(ctx context.Context, key, mode string, n int, maxDelay time.Duration) (redisReply, error) {
+	return evalRedis(ctx, tb.store, redisTokenBucketScript, tb.call(key, mode, n, maxDelay))
+}
+
+func (tb *RedisTokenBucket) call(key, mode string, n int, maxDelay time.Duration) store.ScriptCall {
+	return redisCall(key, mode, n, maxDelay, tb.Capacity, tb.RefillRate)
+}
+
+func (tb *RedisTokenBucket) Reset(ctx context.Context, key string) error {
+	return resetRedis(ctx, tb.store, key)
+}
+
+// ResetPrefix clears every key starting with prefix.
+func (tb *RedisTokenBucket) ResetPrefix(ctx context.Context, prefix string) error {
+	return resetPrefix(ctx, tb.store, nil, prefix)
+}
@@ -0,0 +1,149 @@
+package algorithms
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// maxWait is the delay limit used by Reserve, which books capacity no matter
+// how far in the future it becomes available.
+const maxWait = time.Duration(math.MaxInt64)
+
+// Reservation holds capacity booked ahead of time by Reserve. The caller must
+// wait Delay() before acting on it, or Cancel it to hand the capacity back.
+type Reservation struct {
+	ok        bool
+	limit     int
+	remaining int
+	delay     time.Duration
+	timeToAct time.Time
+	deniedBy  string
+	degraded  bool
+
+	mu       sync.Mutex
+	canceled bool
+	cancel   func(ctx context.Context) error
+}
+
+func newReservation(limit int, now time.Time, delay, maxDelay time.Duration) *Reservation {
+	return &Reservation{
+		ok:        delay <= maxDelay,
+		limit:     limit,
+		delay:     delay,
+		timeToAct: now.Add(delay),
+	}
+}
+
+// OK reports whether the capacity was booked. A reservation that is not OK
+// holds nothing and does not need to be cancelled.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay returns how long the caller must wait before acting. For a
+// reservation that is not OK it is the wait that would have been needed.
+func (r *Reservation) Delay() time.Duration {
+	return r.DelayFrom(time.Now())
+}
+
+// DelayFrom returns how long the caller must wait from now before acting.
+func (r *Reservation) DelayFrom(now time.Time) time.Duration {
+	return max(r.timeToAct.Sub(now), 0)
+}
+
+// Cancel hands the booked capacity back to the limiter. It does nothing for
+// a reservation that is not OK, has already been cancelled or whose time to
+// act has come, since the caller may have used the capacity by then.
+func (r *Reservation) Cancel(ctx context.Context) error {
+	if r.DelayFrom(time.Now()) == 0 {
+		return nil
+	}
+	return r.refund(ctx)
+}
+
+// refund hands the booked capacity back even once the time to act has come,
+// for limiters undoing a reservation they have just booked.
+func (r *Reservation) refund(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.ok || r.canceled || r.cancel == nil {
+		return nil
+	}
+	if err := r.cancel(ctx); err != nil {
+		return fmt.Errorf("failed to cancel reservation: %w", err)
+	}
+	r.canceled = true
+	return nil
+}
+
+// result describes the reservation as the outcome of a request made at the
+// time it was booked.
+func (r *Reservation) result() Result {
+	if r.ok && r.delay == 0 {
+		return Result{
+			Allowed:    true,
+			Limit:      r.limit,
+			Remaining:  r.remaining,
+			RetryAfter: 0,
+			Degraded:   r.degraded,
+		}
+	}
+	return Result{
+		Allowed:    false,
+		Limit:      r.limit,
+		Remaining:  r.remaining,
+		RetryAfter: r.delay,
+		DeniedBy:   r.deniedBy,
+		Degraded:   r.degraded,
+	}
+}
+
+// reserver is implemented by every algorithm. reserveN books n units for key
+// if they become available within maxDelay, and leaves the state untouched
+// otherwise. AllowN is reserveN with a maxDelay of zero.
+type reserver interface {
+	reserveN(ctx context.Context, key string, n int, maxDelay time.Duration) (*Reservation, error)
+}
+
+// waitN blocks until n units for key are available. It fails fast, without
+// booking anything, when the wait would outlast the context's deadline.
+func waitN(ctx context.Context, r reserver, key string, n int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	maxDelay := maxWait
+	if deadline, ok := ctx.Deadline(); ok {
+		maxDelay = time.Until(deadline)
+	}
+
+	res, err := r.reserveN(ctx, key, n, maxDelay)
+	if err != nil {
+		return err
+	}
+	if !res.OK() {
+		return fmt.Errorf("waiting %v for key %s would exceed context deadline: %w", res.delay, key, context.DeadlineExceeded)
+	}
+
+	delay := res.Delay()
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// The slot is still booked, give it back for other callers
+		if err := res.Cancel(context.WithoutCancel(ctx)); err != nil {
+			return fmt.Errorf("%w (%v)", ctx.Err(), err)
+		}
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,150 @@
+package algorithms
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+type waitingLimiter interface {
+	RateLimiter
+	Waiter
+}
+
+// Every limiter admits 2 requests and then frees room within about 200ms
+func newWaitingLimiters() map[string]waitingLimiter {
+	return map[string]waitingLimiter{
+		"token bucket":           NewTokenBucket(2, 5, store.NewMemoryStore()),
+		"leaky bucket":           NewLeakyBucket(2, 5, store.NewMemoryStore()),
+		"fixed window":           NewFixedWindow(2, 200*time.Millisecond, store.NewMemoryStore()),
+		"sliding window":         NewSlidingWindow(2, 200*time.Millisecond, store.NewMemoryStore()),
+		"sliding window counter": NewSlidingWindowCounter(2, 200*time.Millisecond, store.NewMemoryStore()),
+		"gcra":                   NewGCRA(5, 1*time.Second, 2, store.NewMemoryStore()),
+	}
+}
+
+func TestWaitBlocksUntilAdmitted(t *testing.T) {
+	for name, limiter := range newWaitingLimiters() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			_, _ = limiter.AllowN(ctx, "user1", 2)
+
+			result, _ := limiter.Allow(ctx, "user1")
+			if result.Allowed {
+				t.Fatal("limiter should be full before Wait")
+			}
+
+			start := time.Now()
+			if err := limiter.Wait(ctx, "user1"); err != nil {
+				t.Fatalf("Wait returned error: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed < result.RetryAfter-10*time.Millisecond {
+				t.Errorf("Wait returned after %v, before RetryAfter %v", elapsed, result.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestWaitFailsFastOnShortDeadline(t *testing.T) {
+	for name, limiter := range newWaitingLimiters() {
+		t.Run(name, func(t *testing.T) {
+			_, _ = limiter.AllowN(context.Background(), "user1", 2)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			err := limiter.Wait(ctx, "user1")
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("expected deadline error, got %v", err)
+			}
+			if time.Since(start) > 5*time.Millisecond {
+				t.Errorf("Wait should fail without blocking, took %v", time.Since(start))
+			}
+		})
+	}
+}
+
+func TestReserveAndCancel(t *testing.T) {
+	for name, limiter := range newWaitingLimiters() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			_, _ = limiter.Allow(ctx, "user1")
+
+			res, err := limiter.Reserve(ctx, "user1")
+			if err != nil {
+				t.Fatalf("Reserve returned error: %v", err)
+			}
+			if !res.OK() || res.Delay() != 0 {
+				t.Fatalf("reservation with room left should be immediate, got delay %v", res.Delay())
+			}
+
+			res, err = limiter.Reserve(ctx, "user1")
+			if err != nil {
+				t.Fatalf("Reserve returned error: %v", err)
+			}
+			if !res.OK() || res.Delay() <= 0 {
+				t.Fatalf("reservation on a full limiter should be delayed, got %v", res.Delay())
+			}
+
+			// The booked slot blocks other callers until it is handed back
+			result, _ := limiter.Allow(ctx, "user1")
+			if result.Allowed {
+				t.Error("request should be denied while the slot is reserved")
+			}
+			if err := res.Cancel(ctx); err != nil {
+				t.Fatalf("Cancel returned error: %v", err)
+			}
+			if err := res.Cancel(ctx); err != nil {
+				t.Fatalf("second Cancel returned error: %v", err)
+			}
+		})
+	}
+}
+
+func TestCancelAfterDueKeepsCapacity(t *testing.T) {
+	for name, limiter := range newWaitingLimiters() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			_, _ = limiter.Allow(ctx, "user1")
+
+			res, err := limiter.Reserve(ctx, "user1")
+			if err != nil || !res.OK() || res.Delay() != 0 {
+				t.Fatalf("got %v, %v, want an immediate reservation", res, err)
+			}
+			// The caller may already have acted on the slot, so it cannot be
+			// handed back
+			if err := res.Cancel(ctx); err != nil {
+				t.Fatalf("Cancel returned error: %v", err)
+			}
+			if result, _ := limiter.Allow(ctx, "user1"); result.Allowed {
+				t.Error("request allowed after cancelling a reservation that was due")
+			}
+		})
+	}
+}
+
+func TestWaitCancelledReleasesSlot(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	limiter := NewSlidingWindow(1, 200*time.Millisecond, s)
+	_, _ = limiter.Allow(ctx, "user1")
+
+	waitCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if err := limiter.Wait(waitCtx, "user1"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation error, got %v", err)
+	}
+
+	bucketData, _ := s.Get(ctx, "user1")
+	bucket := bucketData.(*SlidingWindowBucket)
+	if len(bucket.Timestamps) != 1 {
+		t.Errorf("timestamps after cancelled wait: got %d, want 1", len(bucket.Timestamps))
+	}
+}
@@ -0,0 +1,37 @@
+package algorithms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+// resetPrefix deletes every key in s that starts with prefix. When locks is
+// not nil, each key's mutex is held while it is deleted, as Reset holds it.
+// Keys that expire or are deleted between the scan and the delete are
+// skipped.
+func resetPrefix(ctx context.Context, s store.Store, locks *keyLocks, prefix string) error {
+	scanner, ok := s.(store.Scanner)
+	if !ok {
+		return fmt.Errorf("store %T cannot list its keys", s)
+	}
+	for key, err := range scanner.Scan(ctx, store.PrefixPattern(prefix)) {
+		if err != nil {
+			return err
+		}
+		if locks != nil {
+			mu := locks.mutex(key)
+			mu.Lock()
+			err = s.Delete(ctx, key)
+			mu.Unlock()
+		} else {
+			err = s.Delete(ctx, key)
+		}
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
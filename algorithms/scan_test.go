@@ -0,0 +1,230 @@
+package algorithms
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/codetesla51/limitz/store"
+	"github.com/redis/go-redis/v9"
+)
+
+type scanningStore interface {
+	store.Store
+	store.Scanner
+}
+
+// scanned collects the keys s yields for pattern, sorted and without the
+// repeats SCAN may return.
+func scanned(t *testing.T, s store.Scanner, pattern string) []string {
+	t.Helper()
+	var keys []string
+	for key, err := range s.Scan(context.Background(), pattern) {
+		if err != nil {
+			t.Fatalf("Scan returned error: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+// newRedisScanStore builds a Redis store over miniredis, which only expires
+// keys when its clock is moved forward.
+func newRedisScanStore(t *testing.T, opts store.RedisOptions) (scanningStore, func(time.Duration)) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	opts.Addrs = []string{mr.Addr()}
+	s, err := store.NewRedisStoreWithOptions(opts)
+	if err != nil {
+		t.Fatalf("failed to connect to miniredis: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if opts.KeyPrefix != "" {
+		// A key outside the store's KeyPrefix, which Scan must not yield
+		mr.Set("other:tenant1:alice", "v")
+	}
+	return s, mr.FastForward
+}
+
+func TestStoresScan(t *testing.T) {
+	stores := map[string]func(t *testing.T) (scanningStore, func(time.Duration)){
+		"memory": func(t *testing.T) (scanningStore, func(time.Duration)) {
+			s := store.NewMemoryStoreWithOptions(store.MemoryOptions{Shards: 4})
+			t.Cleanup(s.Close)
+			return s, time.Sleep
+		},
+		"redis": func(t *testing.T) (scanningStore, func(time.Duration)) {
+			return newRedisScanStore(t, store.RedisOptions{})
+		},
+		"redis with prefix and hash tags": func(t *testing.T) (scanningStore, func(time.Duration)) {
+			return newRedisScanStore(t, store.RedisOptions{KeyPrefix: "app:", HashTags: true})
+		},
+		"redis cluster": func(t *testing.T) (scanningStore, func(time.Duration)) {
+			return newRedisScanStore(t, store.RedisOptions{
+				UniversalOptions: redis.UniversalOptions{IsClusterMode: true},
+				KeyPrefix:        "app:",
+			})
+		},
+		"sqlite": func(t *testing.T) (scanningStore, func(time.Duration)) {
+			s := newSQLiteStore(t, newSQLite(t), store.DatabaseOptions{})
+			return s, time.Sleep
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s, elapse := newStore(t)
+			for _, key := range []string{"tenant1:alice", "tenant1:bob", "tenant2:alice", "tenant10:x", "lit*eral", "50%_off"} {
+				if err := s.Set(ctx, key, []byte("v"), time.Hour); err != nil {
+					t.Fatalf("Set returned error: %v", err)
+				}
+			}
+			s.Set(ctx, "tenant1:gone", []byte("v"), time.Millisecond)
+			elapse(5 * time.Millisecond)
+
+			patterns := map[string][]string{
+				store.PrefixPattern("tenant1:"): {"tenant1:alice", "tenant1:bob"},
+				"tenant?:alice":                 {"tenant1:alice", "tenant2:alice"},
+				"tenant[^1]*":                   {"tenant2:alice"},
+				"tenant[0-9][0-9]:*":            {"tenant10:x"},
+				store.PrefixPattern("lit*"):     {"lit*eral"},
+				store.PrefixPattern("50%_"):     {"50%_off"},
+				"*:alice":                       {"tenant1:alice", "tenant2:alice"},
+			}
+			for pattern, want := range patterns {
+				if got := scanned(t, s, pattern); !slices.Equal(got, want) {
+					t.Errorf("%q: got %v, want %v", pattern, got, want)
+				}
+			}
+
+			n := 0
+			for range s.Scan(ctx, "*") {
+				n++
+				break
+			}
+			if n != 1 {
+				t.Errorf("got %d keys after breaking out of the loop, want 1", n)
+			}
+		})
+	}
+}
+
+func TestScanPatternsMatchRedis(t *testing.T) {
+	ctx := context.Background()
+	mem := store.NewMemoryStore()
+	t.Cleanup(mem.Close)
+	rs, _ := newRedisScanStore(t, store.RedisOptions{})
+	keys := []string{"abc", "aXbXc", "ab", "a*c", "a\\c", "ba", "aaab", "a-c"}
+	for _, key := range keys {
+		mem.Set(ctx, key, []byte("v"), time.Hour)
+		rs.Set(ctx, key, []byte("v"), time.Hour)
+	}
+
+	for _, pattern := range []string{"a*c", "*b*", "a*b*c", "a**c", "*a", "a?c", "a[*-]c", "a\\*c", "a\\\\c", "[^a]*", "*[bc]", "a*", "*"} {
+		got, want := scanned(t, mem, pattern), scanned(t, rs, pattern)
+		if !slices.Equal(got, want) {
+			t.Errorf("%q: got %v, Redis gives %v", pattern, got, want)
+		}
+	}
+}
+
+func TestScanManyStars(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	t.Cleanup(s.Close)
+	s.Set(ctx, strings.Repeat("a", 100), []byte("v"), time.Hour)
+
+	// Trying every split of the key between the stars would take forever
+	start := time.Now()
+	if got := scanned(t, s, "a*a*a*a*a*a*a*a*a*a*b"); len(got) != 0 {
+		t.Errorf("got %v, want no match", got)
+	}
+	if got := scanned(t, s, "a*a*a*a*a*a*a*a*a*a*a"); len(got) != 1 {
+		t.Errorf("got %v, want the key", got)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %v to match", elapsed)
+	}
+}
+
+func TestResetPrefix(t *testing.T) {
+	for name, newLimiter := range rateLimiters() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			limiter := newLimiter(store.NewMemoryStore())
+			for _, key := range []string{"tenant1:alice", "tenant1:bob", "tenant2:alice"} {
+				for i := 0; i < 3; i++ {
+					limiter.Allow(ctx, key)
+				}
+			}
+
+			if err := limiter.(PrefixResetter).ResetPrefix(ctx, "tenant1:"); err != nil {
+				t.Fatalf("ResetPrefix returned error: %v", err)
+			}
+			for key, want := range map[string]bool{"tenant1:alice": true, "tenant1:bob": true, "tenant2:alice": false} {
+				if result, _ := limiter.Allow(ctx, key); result.Allowed != want {
+					t.Errorf("%s: got Allowed %v, want %v", key, result.Allowed, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisResetPrefix(t *testing.T) {
+	ctx := context.Background()
+	for name := range newRedisLimiters(nil) {
+		t.Run(name, func(t *testing.T) {
+			limiter := newRedisLimiters(newTestRedisStore(t))[name]
+			for _, key := range []string{"tenant1:alice", "tenant2:alice"} {
+				for i := 0; i < 3; i++ {
+					limiter.Allow(ctx, key)
+				}
+			}
+
+			if err := limiter.(PrefixResetter).ResetPrefix(ctx, "tenant1:"); err != nil {
+				t.Fatalf("ResetPrefix returned error: %v", err)
+			}
+			if result, _ := limiter.Allow(ctx, "tenant1:alice"); !result.Allowed {
+				t.Error("tenant1:alice was not reset")
+			}
+			if result, _ := limiter.Allow(ctx, "tenant2:alice"); result.Allowed {
+				t.Error("tenant2:alice was reset")
+			}
+		})
+	}
+}
+
+func TestHierarchyResetPrefixKeepsParentPool(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	h := NewHierarchy(orgOf,
+		Policy{Name: "org", Limiter: NewFixedWindow(5, time.Minute, s)},
+		0,
+		Policy{Name: "user", Limiter: NewFixedWindow(3, time.Minute, s)},
+	)
+	for _, user := range []string{"acme:alice", "acme:alice", "acme:alice", "acme:bob"} {
+		h.Allow(ctx, user)
+	}
+
+	if err := h.ResetPrefix(ctx, "acme:"); err != nil {
+		t.Fatalf("ResetPrefix returned error: %v", err)
+	}
+	if got := scanned(t, s, store.PrefixPattern("user:")); len(got) != 0 {
+		t.Errorf("got user keys %v after ResetPrefix, want none", got)
+	}
+	if got := scanned(t, s, store.PrefixPattern("org:")); !slices.Equal(got, []string{"org:acme"}) {
+		t.Errorf("got org keys %v, want the shared pool kept", got)
+	}
+}
+
+func TestResetPrefixNeedsScanner(t *testing.T) {
+	limiter := NewTokenBucket(3, 1, struct{ store.Store }{store.NewMemoryStore()})
+	if err := limiter.ResetPrefix(context.Background(), "tenant1:"); err == nil {
+		t.Error("want an error for a store that cannot list its keys")
+	}
+}
@@ -2,9 +2,8 @@ package algorithms
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"sync"
+	"slices"
 	"time"
 
 	"github.com/codetesla51/limitz/store"
@@ -19,7 +18,8 @@ type SlidingWindow struct {
 	Limit      int           // Max requests allowed
 	WindowSize time.Duration // How long to track (e.g., 1 minute)
 	store      store.Store   // Where to persist request timestamps
-	mu         sync.Mutex
+	state      *store.Typed[SlidingWindowBucket]
+	locks      keyLocks
 }
 
 func NewSlidingWindow(limit int, windowSize time.Duration, s store.Store) *SlidingWindow {
@@ -30,51 +30,128 @@ func NewSlidingWindow(limit int, windowSize time.Duration, s store.Store) *Slidi
 		Limit:      limit,
 		WindowSize: windowSize,
 		store:      s,
+		state:      store.NewTyped[SlidingWindowBucket](s),
 	}
 }
 
 // Allow checks if a request is allowed under sliding window rate limit
 func (sw *SlidingWindow) Allow(ctx context.Context, key string) (Result, error) {
-	sw.mu.Lock()
-	defer sw.mu.Unlock()
+	return sw.AllowN(ctx, key, 1)
+}
+
+// AllowN checks if n requests fit in the sliding window and records all of
+// them at once, or none of them.
+func (sw *SlidingWindow) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	res, err := sw.reserveN(ctx, key, n, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return res.result(), nil
+}
+
+// AllowMany logs a request for each of keys whose window has room. With a
+// store.BatchUpdater, the logs of the whole batch are updated in one atomic
+// step.
+func (sw *SlidingWindow) AllowMany(ctx context.Context, keys []string) ([]Result, error) {
+	return allowMany(ctx, sw.state, &sw.locks, keys, sw.reserve)
+}
+
+// Wait blocks until a request for key fits in the sliding window.
+func (sw *SlidingWindow) Wait(ctx context.Context, key string) error {
+	return sw.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until n requests for key fit in the sliding window.
+func (sw *SlidingWindow) WaitN(ctx context.Context, key string, n int) error {
+	return waitN(ctx, sw, key, n)
+}
+
+// Reserve books a request for key at the earliest time it fits.
+func (sw *SlidingWindow) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return sw.ReserveN(ctx, key, 1)
+}
+
+// ReserveN books n requests for key at the earliest time they fit. The
+// requests are logged with that future timestamp, so they count against
+// every window they will fall in.
+func (sw *SlidingWindow) ReserveN(ctx context.Context, key string, n int) (*Reservation, error) {
+	return sw.reserveN(ctx, key, n, maxWait)
+}
 
-	now := time.Now().UnixNano()
-	windowStart := now - sw.WindowSize.Nanoseconds()
+func (sw *SlidingWindow) reserveN(ctx context.Context, key string, n int, maxDelay time.Duration) (*Reservation, error) {
+	if err := checkN(n, sw.Limit); err != nil {
+		return nil, err
+	}
+
+	mu := sw.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
 
-	bucketData, err := sw.store.Get(ctx, key)
-	var bucket *SlidingWindowBucket
+	var res *Reservation
+	err := update(ctx, sw.state, key, func(bucket *SlidingWindowBucket) (*SlidingWindowBucket, time.Duration, error) {
+		var ttl time.Duration
+		bucket, ttl, res = sw.reserve(bucket, n, now, maxDelay)
+		return bucket, ttl, nil
+	})
 	if err != nil {
-		bucket = &SlidingWindowBucket{
-			Timestamps: []int64{},
-		}
-	} else {
-		// Handle both MemoryStore (returns struct) and RedisStore (returns JSON string)
-		switch v := bucketData.(type) {
-		case *SlidingWindowBucket:
-			bucket = v
-		case string:
-			bucket = &SlidingWindowBucket{}
-			if err := json.Unmarshal([]byte(v), bucket); err != nil {
-				bucket = &SlidingWindowBucket{Timestamps: []int64{}}
-			}
-		default:
-			bucket = &SlidingWindowBucket{Timestamps: []int64{}}
+		return nil, err
+	}
+	if res.ok {
+		at := now.UnixNano() + res.delay.Nanoseconds()
+		res.cancel = func(ctx context.Context) error {
+			return sw.refund(ctx, key, n, at)
 		}
 	}
+	return res, nil
+}
 
-	validTimestamps := []int64{}
-	for _, ts := range bucket.Timestamps {
-		if ts > windowStart {
-			validTimestamps = append(validTimestamps, ts)
-		}
+// reserve logs n requests in bucket, the key's log or nil if it has none,
+// at the earliest time within maxDelay of now that they fit. It returns the
+// log to store, or nil when nothing was logged.
+func (sw *SlidingWindow) reserve(bucket *SlidingWindowBucket, n int, now time.Time, maxDelay time.Duration) (*SlidingWindowBucket, time.Duration, *Reservation) {
+	nowNanos := now.UnixNano()
+
+	if bucket == nil {
+		bucket = sw.newBucket()
 	}
-	bucket.Timestamps = validTimestamps
+	sw.slide(bucket, nowNanos)
 
-	if len(bucket.Timestamps) < sw.Limit {
-		bucket.Timestamps = append(bucket.Timestamps, now)
-		if err := sw.store.Set(ctx, key, bucket, sw.WindowSize); err != nil {
-			return Result{}, fmt.Errorf("failed to save bucket state: %v", err)
-		}
+	var delay time.Duration
+	if len(bucket.Timestamps)+n > sw.Limit {
+		delay = sw.retryAfter(bucket, n, nowNanos)
+	}
+
+	res := newReservation(sw.Limit, now, delay, maxDelay)
+	if !res.ok {
+		res.remaining = max(sw.Limit-len(bucket.Timestamps), 0)
+		return nil, 0, res
+	}
+
+	at := nowNanos + delay.Nanoseconds()
+	for i := 0; i < n; i++ {
+		bucket.Timestamps = append(bucket.Timestamps, at)
+	}
+	slices.Sort(bucket.Timestamps)
+	res.remaining = max(sw.Limit-len(bucket.Timestamps), 0)
+	return bucket, sw.ttl(bucket, nowNanos), res
+}
+
+// Peek reports whether a request for key would be allowed right now without
+// logging it. Remaining is the room currently left in the window.
+func (sw *SlidingWindow) Peek(ctx context.Context, key string) (Result, error) {
+	mu := sw.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	nowNanos := time.Now().UnixNano()
+	bucket, err := sw.inspect(ctx, key, nowNanos)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if len(bucket.Timestamps)+1 <= sw.Limit {
 		return Result{
 			Allowed:    true,
 			Limit:      sw.Limit,
@@ -82,25 +159,114 @@ func (sw *SlidingWindow) Allow(ctx context.Context, key string) (Result, error)
 			RetryAfter: 0,
 		}, nil
 	}
-
-	oldestTimestamp := bucket.Timestamps[0]
-	timeSinceOldest := now - oldestTimestamp
-	retryAfter := time.Duration(sw.WindowSize.Nanoseconds() - timeSinceOldest)
-
-	if err := sw.store.Set(ctx, key, bucket, sw.WindowSize); err != nil {
-		return Result{}, fmt.Errorf("failed to save bucket state: %v", err)
-	}
 	return Result{
 		Allowed:    false,
 		Limit:      sw.Limit,
 		Remaining:  0,
-		RetryAfter: retryAfter,
+		RetryAfter: sw.retryAfter(bucket, 1, nowNanos),
 	}, nil
 }
 
+// Inspect returns key's log without the timestamps that have slid out of
+// the window. A key with no state yet gets an empty log. Nothing is written
+// back to the store.
+func (sw *SlidingWindow) Inspect(ctx context.Context, key string) (*SlidingWindowBucket, error) {
+	mu := sw.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+	return sw.inspect(ctx, key, time.Now().UnixNano())
+}
+
+// inspect slides a copy of key's log, so the state held by the store is left
+// as it was.
+func (sw *SlidingWindow) inspect(ctx context.Context, key string, nowNanos int64) (*SlidingWindowBucket, error) {
+	stored, err := sw.load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	bucket := &SlidingWindowBucket{Timestamps: stored.Timestamps}
+	sw.slide(bucket, nowNanos)
+	return bucket, nil
+}
+
+// refund removes the n timestamps logged at by a cancelled reservation.
+func (sw *SlidingWindow) refund(ctx context.Context, key string, n int, at int64) error {
+	mu := sw.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	nowNanos := time.Now().UnixNano()
+	return update(ctx, sw.state, key, func(bucket *SlidingWindowBucket) (*SlidingWindowBucket, time.Duration, error) {
+		if bucket == nil {
+			return nil, 0, nil
+		}
+		sw.slide(bucket, nowNanos)
+		left := n
+		bucket.Timestamps = slices.DeleteFunc(bucket.Timestamps, func(ts int64) bool {
+			if ts == at && left > 0 {
+				left--
+				return true
+			}
+			return false
+		})
+		return bucket, sw.ttl(bucket, nowNanos), nil
+	})
+}
+
+// load fetches key's timestamp log, starting an empty one when the key is new.
+func (sw *SlidingWindow) load(ctx context.Context, key string) (*SlidingWindowBucket, error) {
+	bucket, err := sw.state.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bucket state: %w", err)
+	}
+	if bucket == nil {
+		bucket = sw.newBucket()
+	}
+	return bucket, nil
+}
+
+// newBucket starts an empty timestamp log for a key with no state.
+func (sw *SlidingWindow) newBucket() *SlidingWindowBucket {
+	return &SlidingWindowBucket{
+		Timestamps: []int64{},
+	}
+}
+
+// slide drops the timestamps that have fallen out of the window.
+func (sw *SlidingWindow) slide(bucket *SlidingWindowBucket, nowNanos int64) {
+	windowStart := nowNanos - sw.WindowSize.Nanoseconds()
+
+	validTimestamps := []int64{}
+	for _, ts := range bucket.Timestamps {
+		if ts > windowStart {
+			validTimestamps = append(validTimestamps, ts)
+		}
+	}
+	bucket.Timestamps = validTimestamps
+}
+
+// retryAfter returns how long until enough of the oldest timestamps have
+// slid out of the window to make room for n.
+func (sw *SlidingWindow) retryAfter(bucket *SlidingWindowBucket, n int, nowNanos int64) time.Duration {
+	blocking := bucket.Timestamps[len(bucket.Timestamps)+n-sw.Limit-1]
+	return time.Duration(blocking + sw.WindowSize.Nanoseconds() - nowNanos)
+}
+
+// ttl keeps the log until its newest timestamp, which may be a reservation
+// in the future, has slid out of the window. An empty log behaves the same
+// as a missing one, so it is only kept briefly.
+func (sw *SlidingWindow) ttl(bucket *SlidingWindowBucket, nowNanos int64) time.Duration {
+	if len(bucket.Timestamps) == 0 {
+		return time.Millisecond
+	}
+	newest := bucket.Timestamps[len(bucket.Timestamps)-1]
+	return sw.WindowSize + time.Duration(max(newest-nowNanos, 0))
+}
+
 func (sw *SlidingWindow) Reset(ctx context.Context, key string) error {
-	sw.mu.Lock()
-	defer sw.mu.Unlock()
+	mu := sw.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
 
 	exists, err := sw.store.Exists(ctx, key)
 	if err != nil {
@@ -112,3 +278,8 @@ func (sw *SlidingWindow) Reset(ctx context.Context, key string) error {
 
 	return sw.store.Delete(ctx, key)
 }
+
+// ResetPrefix clears every key starting with prefix.
+func (sw *SlidingWindow) ResetPrefix(ctx context.Context, prefix string) error {
+	return resetPrefix(ctx, sw.store, &sw.locks, prefix)
+}
@@ -2,9 +2,7 @@ package algorithms
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"sync"
 	"time"
 
 	"github.com/codetesla51/limitz/store"
@@ -20,7 +18,8 @@ type SlidingWindowCounter struct {
 	Limit      int
 	WindowSize time.Duration
 	store      store.Store
-	mu         sync.Mutex
+	state      *store.Typed[SlidingWindowCounterBucket]
+	locks      keyLocks
 }
 
 func NewSlidingWindowCounter(limit int, windowSize time.Duration, s store.Store) *SlidingWindowCounter {
@@ -31,73 +30,136 @@ func NewSlidingWindowCounter(limit int, windowSize time.Duration, s store.Store)
 		Limit:      limit,
 		WindowSize: windowSize,
 		store:      s,
+		state:      store.NewTyped[SlidingWindowCounterBucket](s),
 	}
 }
 
 func (swc *SlidingWindowCounter) Allow(ctx context.Context, key string) (Result, error) {
-	swc.mu.Lock()
-	defer swc.mu.Unlock()
+	return swc.AllowN(ctx, key, 1)
+}
 
-	nowNanos := time.Now().UnixNano()
-	windowSizeNanos := swc.WindowSize.Nanoseconds()
+// AllowN checks if n requests fit under the estimated sliding window count
+// and counts all of them at once, or none of them.
+func (swc *SlidingWindowCounter) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	res, err := swc.reserveN(ctx, key, n, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return res.result(), nil
+}
 
-	currentWindow := int(nowNanos / windowSizeNanos)
+// AllowMany counts a request for each of keys whose estimate is below the
+// limit. With a store.BatchUpdater, the counters of the whole batch are
+// updated in one atomic step.
+func (swc *SlidingWindowCounter) AllowMany(ctx context.Context, keys []string) ([]Result, error) {
+	return allowMany(ctx, swc.state, &swc.locks, keys, swc.reserve)
+}
+
+// Wait blocks until a request for key fits under the estimated count.
+func (swc *SlidingWindowCounter) Wait(ctx context.Context, key string) error {
+	return swc.WaitN(ctx, key, 1)
+}
 
-	bucketData, err := swc.store.Get(ctx, key)
-	var bucket *SlidingWindowCounterBucket
+// WaitN blocks until n requests for key fit under the estimated count.
+func (swc *SlidingWindowCounter) WaitN(ctx context.Context, key string, n int) error {
+	return waitN(ctx, swc, key, n)
+}
+
+// Reserve books a request for key at the earliest time it fits.
+func (swc *SlidingWindowCounter) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return swc.ReserveN(ctx, key, 1)
+}
+
+// ReserveN books n requests for key at the earliest time they fit. Like the
+// estimate itself this is approximate: the requests are counted in the
+// current window, and any beyond its limit carry over into the next ones.
+func (swc *SlidingWindowCounter) ReserveN(ctx context.Context, key string, n int) (*Reservation, error) {
+	return swc.reserveN(ctx, key, n, maxWait)
+}
+
+func (swc *SlidingWindowCounter) reserveN(ctx context.Context, key string, n int, maxDelay time.Duration) (*Reservation, error) {
+	if err := checkN(n, swc.Limit); err != nil {
+		return nil, err
+	}
+
+	mu := swc.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	currentWindow := int(now.UnixNano() / swc.WindowSize.Nanoseconds())
+
+	var res *Reservation
+	err := update(ctx, swc.state, key, func(bucket *SlidingWindowCounterBucket) (*SlidingWindowCounterBucket, time.Duration, error) {
+		var ttl time.Duration
+		bucket, ttl, res = swc.reserve(bucket, n, now, maxDelay)
+		return bucket, ttl, nil
+	})
 	if err != nil {
-		bucket = &SlidingWindowCounterBucket{
-			PreviousCount: 0,
-			CurrentCount:  0,
-			CurrentWindow: currentWindow,
-		}
-	} else {
-		switch v := bucketData.(type) {
-		case *SlidingWindowCounterBucket:
-			bucket = v
-		case string:
-			bucket = &SlidingWindowCounterBucket{}
-			if err := json.Unmarshal([]byte(v), bucket); err != nil {
-				bucket = &SlidingWindowCounterBucket{
-					PreviousCount: 0,
-					CurrentCount:  0,
-					CurrentWindow: currentWindow,
-				}
-			}
-		default:
-			bucket = &SlidingWindowCounterBucket{
-				PreviousCount: 0,
-				CurrentCount:  0,
-				CurrentWindow: currentWindow,
-			}
+		return nil, err
+	}
+	if res.ok {
+		res.cancel = func(ctx context.Context) error {
+			return swc.refund(ctx, key, n, currentWindow)
 		}
 	}
+	return res, nil
+}
 
-	// Did we move to a new window?
-	if currentWindow != bucket.CurrentWindow {
-		bucket.PreviousCount = bucket.CurrentCount
-		bucket.CurrentCount = 0
-		bucket.CurrentWindow = currentWindow
-	}
+// reserve counts n requests in bucket, the key's counters or nil if it has
+// none, if they fit under the estimate within maxDelay of now. It returns
+// the counters to store, or nil when nothing was counted.
+func (swc *SlidingWindowCounter) reserve(bucket *SlidingWindowCounterBucket, n int, now time.Time, maxDelay time.Duration) (*SlidingWindowCounterBucket, time.Duration, *Reservation) {
+	nowNanos := now.UnixNano()
+	windowSizeNanos := swc.WindowSize.Nanoseconds()
+
+	currentWindow := int(nowNanos / windowSizeNanos)
 
 	// How far into current window are we?
 	timeIntoWindow := nowNanos % windowSizeNanos
 
-	// How much of previous window overlaps with our sliding window?
-	overlap := windowSizeNanos - timeIntoWindow
-	overlapPercentage := float64(overlap) / float64(windowSizeNanos)
+	if bucket == nil {
+		bucket = swc.newBucket(currentWindow)
+	}
+	swc.advance(bucket, currentWindow)
 
 	// Estimate total requests in the sliding window
-	estimate := float64(bucket.PreviousCount)*overlapPercentage + float64(bucket.CurrentCount)
+	estimate := swc.estimate(bucket, timeIntoWindow)
 
-	// Check if allowed
-	if estimate < float64(swc.Limit) {
-		bucket.CurrentCount++
-		err := swc.store.Set(ctx, key, bucket, swc.WindowSize*2) // Store for 2 windows
-		if err != nil {
-			return Result{}, fmt.Errorf("failed to save bucket state: %v", err)
-		}
+	// Check if allowed. A single request is admitted while the estimate
+	// is below the limit, and each extra unit needs one more slot on top.
+	var delay time.Duration
+	if estimate+float64(n-1) >= float64(swc.Limit) {
+		delay = swc.retryAfter(bucket, n, timeIntoWindow)
+	}
 
+	res := newReservation(swc.Limit, now, delay, maxDelay)
+	if !res.ok {
+		res.remaining = max(swc.Limit-int(estimate), 0)
+		return nil, 0, res
+	}
+
+	bucket.CurrentCount += n
+	res.remaining = max(swc.Limit-int(estimate)-n, 0)
+	return bucket, swc.ttl(bucket), res // Store for at least 2 windows
+}
+
+// Peek reports whether a request for key would be allowed right now without
+// counting it. Remaining is the room currently left under the estimate.
+func (swc *SlidingWindowCounter) Peek(ctx context.Context, key string) (Result, error) {
+	mu := swc.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	nowNanos := time.Now().UnixNano()
+	bucket, err := swc.inspect(ctx, key, nowNanos)
+	if err != nil {
+		return Result{}, err
+	}
+	timeIntoWindow := nowNanos % swc.WindowSize.Nanoseconds()
+	estimate := swc.estimate(bucket, timeIntoWindow)
+
+	if estimate < float64(swc.Limit) {
 		return Result{
 			Allowed:    true,
 			Limit:      swc.Limit,
@@ -105,26 +167,151 @@ func (swc *SlidingWindowCounter) Allow(ctx context.Context, key string) (Result,
 			RetryAfter: 0,
 		}, nil
 	}
-
-	nextWindowStart := int64(currentWindow+1) * windowSizeNanos
-	retryAfter := time.Duration(nextWindowStart-nowNanos) * time.Nanosecond
-
-	err = swc.store.Set(ctx, key, bucket, swc.WindowSize*2)
-	if err != nil {
-		return Result{}, fmt.Errorf("failed to save bucket state: %v", err)
-	}
-
 	return Result{
 		Allowed:    false,
 		Limit:      swc.Limit,
 		Remaining:  0,
-		RetryAfter: retryAfter,
+		RetryAfter: swc.retryAfter(bucket, 1, timeIntoWindow),
 	}, nil
 }
 
+// Inspect returns key's counters rolled forward to the current window. A key
+// with no state yet gets empty counters. Nothing is written back to the store.
+func (swc *SlidingWindowCounter) Inspect(ctx context.Context, key string) (*SlidingWindowCounterBucket, error) {
+	mu := swc.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+	return swc.inspect(ctx, key, time.Now().UnixNano())
+}
+
+// inspect rolls a copy of key's counters forward, so the state held by the
+// store is left as it was.
+func (swc *SlidingWindowCounter) inspect(ctx context.Context, key string, nowNanos int64) (*SlidingWindowCounterBucket, error) {
+	currentWindow := int(nowNanos / swc.WindowSize.Nanoseconds())
+	stored, err := swc.load(ctx, key, currentWindow)
+	if err != nil {
+		return nil, err
+	}
+	bucket := *stored
+	swc.advance(&bucket, currentWindow)
+	return &bucket, nil
+}
+
+// refund uncounts n requests made in window after a reservation is
+// cancelled. If that window has since become the previous one, they are
+// taken from the previous count instead.
+func (swc *SlidingWindowCounter) refund(ctx context.Context, key string, n int, window int) error {
+	mu := swc.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	currentWindow := int(time.Now().UnixNano() / swc.WindowSize.Nanoseconds())
+	return update(ctx, swc.state, key, func(bucket *SlidingWindowCounterBucket) (*SlidingWindowCounterBucket, time.Duration, error) {
+		if bucket == nil {
+			return nil, 0, nil
+		}
+		swc.advance(bucket, currentWindow)
+
+		switch currentWindow - window {
+		case 0:
+			bucket.CurrentCount = max(bucket.CurrentCount-n, 0)
+		case 1:
+			bucket.PreviousCount = max(bucket.PreviousCount-n, 0)
+		default:
+			return nil, 0, nil
+		}
+		return bucket, swc.ttl(bucket), nil
+	})
+}
+
+// load fetches key's counters, starting empty ones when the key is new.
+func (swc *SlidingWindowCounter) load(ctx context.Context, key string, currentWindow int) (*SlidingWindowCounterBucket, error) {
+	bucket, err := swc.state.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bucket state: %w", err)
+	}
+	if bucket == nil {
+		bucket = swc.newBucket(currentWindow)
+	}
+	return bucket, nil
+}
+
+// newBucket starts empty counters for a key with no state.
+func (swc *SlidingWindowCounter) newBucket(currentWindow int) *SlidingWindowCounterBucket {
+	return &SlidingWindowCounterBucket{
+		PreviousCount: 0,
+		CurrentCount:  0,
+		CurrentWindow: currentWindow,
+	}
+}
+
+// advance rolls the counters forward to currentWindow. Requests reserved
+// beyond the limit of a window carry over into the windows that follow it.
+func (swc *SlidingWindowCounter) advance(bucket *SlidingWindowCounterBucket, currentWindow int) {
+	elapsed := currentWindow - bucket.CurrentWindow
+	if elapsed < 0 {
+		bucket.PreviousCount = 0
+		bucket.CurrentCount = 0
+	}
+	for ; elapsed > 0; elapsed-- {
+		if bucket.PreviousCount == 0 && bucket.CurrentCount == 0 {
+			break
+		}
+		bucket.PreviousCount = min(bucket.CurrentCount, swc.Limit)
+		bucket.CurrentCount = max(bucket.CurrentCount-swc.Limit, 0)
+	}
+	bucket.CurrentWindow = currentWindow
+}
+
+// estimate weighs the previous window by how much of it still overlaps the
+// sliding window ending now.
+func (swc *SlidingWindowCounter) estimate(bucket *SlidingWindowCounterBucket, timeIntoWindow int64) float64 {
+	windowSizeNanos := swc.WindowSize.Nanoseconds()
+
+	// How much of previous window overlaps with our sliding window?
+	overlap := windowSizeNanos - timeIntoWindow
+	overlapPercentage := float64(overlap) / float64(windowSizeNanos)
+
+	return float64(bucket.PreviousCount)*overlapPercentage + float64(bucket.CurrentCount)
+}
+
+// retryAfter estimates how long until n requests would be admitted, rolling
+// the counters forward one window at a time. Within a window the estimate
+// drops below the limit once enough of the previous window has slid out.
+func (swc *SlidingWindowCounter) retryAfter(bucket *SlidingWindowCounterBucket, n int, timeIntoWindow int64) time.Duration {
+	windowSizeNanos := swc.WindowSize.Nanoseconds()
+	previous, current := bucket.PreviousCount, bucket.CurrentCount
+	var waited int64
+
+	for {
+		room := float64(swc.Limit - current - n + 1)
+		if room > 0 {
+			// estimate is below the limit once overlap < room/previous
+			target := int64(0)
+			if float64(previous) > room {
+				target = int64(float64(windowSizeNanos)*(1-room/float64(previous))) + 1
+			}
+			if target >= timeIntoWindow {
+				return time.Duration(waited + target - timeIntoWindow)
+			}
+		}
+		waited += windowSizeNanos - timeIntoWindow
+		timeIntoWindow = 0
+		previous = min(current, swc.Limit)
+		current = max(current-swc.Limit, 0)
+	}
+}
+
+// ttl keeps the counters for two windows, plus one more for every window
+// that reservations have carried over into.
+func (swc *SlidingWindowCounter) ttl(bucket *SlidingWindowCounterBucket) time.Duration {
+	return swc.WindowSize * time.Duration(2+bucket.CurrentCount/swc.Limit)
+}
+
 func (swc *SlidingWindowCounter) Reset(ctx context.Context, key string) error {
-	swc.mu.Lock()
-	defer swc.mu.Unlock()
+	mu := swc.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
 
 	exists, err := swc.store.Exists(ctx, key)
 	if err != nil {
@@ -136,3 +323,8 @@ func (swc *SlidingWindowCounter) Reset(ctx context.Context, key string) error {
 
 	return swc.store.Delete(ctx, key)
 }
+
+// ResetPrefix clears every key starting with prefix.
+func (swc *SlidingWindowCounter) ResetPrefix(ctx context.Context, prefix string) error {
+	return resetPrefix(ctx, swc.store, &swc.locks, prefix)
+}
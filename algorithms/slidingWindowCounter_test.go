@@ -327,3 +327,60 @@ func TestSlidingWindowCounterSliding(t *testing.T) {
 		t.Errorf("request after window expires should be allowed")
 	}
 }
+
+func TestSlidingWindowCounterAllowN(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	swc := NewSlidingWindowCounter(10, 1*time.Second, s)
+
+	result, err := swc.AllowN(ctx, "user1", 6)
+	if err != nil || !result.Allowed {
+		t.Fatal("request of 6 should be allowed")
+	}
+	if result.Remaining != 4 {
+		t.Errorf("remaining: got %d, want 4", result.Remaining)
+	}
+
+	result, err = swc.AllowN(ctx, "user1", 5)
+	if err != nil || result.Allowed {
+		t.Error("request of 5 should be denied")
+	}
+
+	result, err = swc.AllowN(ctx, "user1", 4)
+	if err != nil || !result.Allowed {
+		t.Error("request of 4 should be allowed")
+	}
+
+	bucketData, _ := s.Get(ctx, "user1")
+	bucket := bucketData.(*SlidingWindowCounterBucket)
+	if bucket.CurrentCount != 10 {
+		t.Errorf("current count: got %d, want 10", bucket.CurrentCount)
+	}
+}
+
+func TestSlidingWindowCounterPeekAndInspect(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	swc := NewSlidingWindowCounter(5, 1*time.Second, s)
+
+	_, _ = swc.AllowN(ctx, "user1", 2)
+
+	result, err := swc.Peek(ctx, "user1")
+	if err != nil || !result.Allowed {
+		t.Fatalf("peek should be allowed, got %+v", result)
+	}
+
+	bucket, err := swc.Inspect(ctx, "user1")
+	if err != nil {
+		t.Fatalf("inspect failed: %v", err)
+	}
+	if bucket.CurrentCount+bucket.PreviousCount != 2 {
+		t.Errorf("inspected counts: got %d, want 2", bucket.CurrentCount+bucket.PreviousCount)
+	}
+
+	// Peeking and inspecting did not count anything
+	result, _ = swc.AllowN(ctx, "user1", 3)
+	if !result.Allowed {
+		t.Error("remaining 3 requests should still be allowed")
+	}
+}
@@ -272,3 +272,64 @@ func TestSlidingWindowFairness(t *testing.T) {
 	// This shows fairness: you get 2 requests per 100ms on a sliding basis
 	// NOT 2 at 0ms, then blocked until 100ms boundary (FixedWindow problem)
 }
+
+func TestSlidingWindowAllowN(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	sw := NewSlidingWindow(5, 200*time.Millisecond, s)
+
+	result, err := sw.AllowN(ctx, "user1", 2)
+	if err != nil || !result.Allowed {
+		t.Fatal("first request of 2 should be allowed")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	result, err = sw.AllowN(ctx, "user1", 3)
+	if err != nil || !result.Allowed {
+		t.Fatal("second request of 3 should be allowed")
+	}
+
+	// Needs the first batch of 2 to slide out, not the second
+	result, err = sw.AllowN(ctx, "user1", 2)
+	if err != nil || result.Allowed {
+		t.Error("request of 2 should be denied")
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > 100*time.Millisecond {
+		t.Errorf("RetryAfter: got %v, want within 100ms", result.RetryAfter)
+	}
+
+	bucketData, _ := s.Get(ctx, "user1")
+	bucket := bucketData.(*SlidingWindowBucket)
+	if len(bucket.Timestamps) != 5 {
+		t.Errorf("timestamps after denial: got %d, want 5", len(bucket.Timestamps))
+	}
+}
+
+func TestSlidingWindowPeekAndInspect(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	sw := NewSlidingWindow(3, 100*time.Millisecond, s)
+
+	_, _ = sw.AllowN(ctx, "user1", 3)
+
+	result, err := sw.Peek(ctx, "user1")
+	if err != nil || result.Allowed {
+		t.Errorf("peek on a full window should be denied, got %+v", result)
+	}
+
+	bucket, _ := sw.Inspect(ctx, "user1")
+	if len(bucket.Timestamps) != 3 {
+		t.Errorf("inspected timestamps: got %d, want 3", len(bucket.Timestamps))
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	bucket, err = sw.Inspect(ctx, "user1")
+	if err != nil {
+		t.Fatalf("inspect failed: %v", err)
+	}
+	if len(bucket.Timestamps) != 0 {
+		t.Errorf("inspected timestamps: got %d, want 0 after sliding", len(bucket.Timestamps))
+	}
+}
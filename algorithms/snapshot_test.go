@@ -0,0 +1,138 @@
+package algorithms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+func TestMemoryStoreSnapshotRestore(t *testing.T) {
+	for name, newLimiter := range rateLimiters() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			before := store.NewMemoryStore()
+			defer before.Close()
+			limiter := newLimiter(before)
+			limiter.Allow(ctx, "user1")
+			limiter.Allow(ctx, "user1")
+
+			var buf bytes.Buffer
+			if err := before.Snapshot(&buf); err != nil {
+				t.Fatalf("Snapshot returned error: %v", err)
+			}
+
+			after := store.NewMemoryStore()
+			defer after.Close()
+			if err := after.Restore(&buf); err != nil {
+				t.Fatalf("Restore returned error: %v", err)
+			}
+			limiter = newLimiter(after)
+			if result, err := limiter.Allow(ctx, "user1"); err != nil || !result.Allowed || result.Remaining != 0 {
+				t.Errorf("got %+v, %v, want the last request of the restored quota", result, err)
+			}
+			if result, err := limiter.Allow(ctx, "user1"); err != nil || result.Allowed {
+				t.Errorf("got %+v, %v, want the quota used up", result, err)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreSnapshotKeepsExpirations(t *testing.T) {
+	ctx := context.Background()
+	before := store.NewMemoryStore()
+	defer before.Close()
+	before.Set(ctx, "short", "a", 20*time.Millisecond)
+	before.Set(ctx, "long", "b", time.Hour)
+	before.Set(ctx, "bytes", []byte{1, 2, 3}, time.Hour)
+
+	var buf bytes.Buffer
+	if err := before.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot returned error: %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	after := store.NewMemoryStore()
+	defer after.Close()
+	if err := after.Restore(&buf); err != nil {
+		t.Fatalf("Restore returned error: %v", err)
+	}
+	if _, err := after.Get(ctx, "short"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("got %v, want the entry that expired since the snapshot skipped", err)
+	}
+	if val, err := after.Get(ctx, "long"); err != nil || val != "b" {
+		t.Errorf("got %v, %v, want the string value", val, err)
+	}
+	if val, err := after.Get(ctx, "bytes"); err != nil || !bytes.Equal(val.([]byte), []byte{1, 2, 3}) {
+		t.Errorf("got %v, %v, want the []byte value", val, err)
+	}
+}
+
+func TestMemoryStoreSnapshotUnregisteredType(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	s.Set(context.Background(), "key", struct{ N int }{1}, time.Hour)
+
+	if err := s.Snapshot(&bytes.Buffer{}); err == nil {
+		t.Error("want an error for a value gob cannot encode")
+	}
+	if err := s.Restore(bytes.NewReader([]byte("not a snapshot"))); err == nil {
+		t.Error("want an error for a corrupt snapshot")
+	}
+}
+
+func TestMemoryStoreSnapshotFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "limits.snapshot")
+
+	fresh := store.NewMemoryStore()
+	defer fresh.Close()
+	if err := fresh.RestoreFile(path); err != nil {
+		t.Fatalf("got %v for a missing file, want nil", err)
+	}
+
+	var snapshotErr error
+	before := store.NewMemoryStoreWithOptions(store.MemoryOptions{
+		SnapshotPath:     path,
+		SnapshotInterval: 10 * time.Millisecond,
+		OnSnapshotError:  func(err error) { snapshotErr = err },
+	})
+	limiter := NewTokenBucket(3, 1, before)
+	limiter.Allow(ctx, "user1")
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("no periodic snapshot was written: %v", err)
+	}
+
+	// Close writes the final state
+	limiter.Allow(ctx, "user1")
+	before.Close()
+	if snapshotErr != nil {
+		t.Fatalf("snapshot failed: %v", snapshotErr)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("got %d files, want the temporary files renamed or removed", len(entries))
+	}
+
+	after := store.NewMemoryStore()
+	defer after.Close()
+	if err := after.RestoreFile(path); err != nil {
+		t.Fatalf("RestoreFile returned error: %v", err)
+	}
+	if result, err := NewTokenBucket(3, 1, after).Peek(ctx, "user1"); err != nil || result.Remaining != 1 {
+		t.Errorf("got %+v, %v, want the state from before Close", result, err)
+	}
+}
@@ -0,0 +1,363 @@
+package algorithms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+// tieredScript adds ARGV[1], which may be negative or zero, to a window's
+// count across all processes and returns the new total. ARGV[2] is the
+// count's TTL in milliseconds.
+var tieredScript = store.NewScript(`
+local total = redis.call('INCRBY', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) < 0 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return total
+`)
+
+// TieredCounter is a Tiered limiter's local view of a key's window.
+type TieredCounter struct {
+	Window  int64 // Window number, Unix nanoseconds divided by WindowSize
+	Global  int   // Count across every process as of the last sync
+	Pending int   // Requests admitted by this process since the last sync
+}
+
+// Tiered is a fixed window limiter that decides requests from a local
+// MemoryStore and reconciles with Redis in the background, so most calls
+// never leave the process.
+//
+// Each process counts the requests it admits and, every SyncInterval, adds
+// them to the window's count in Redis and reads back the total from every
+// process, for each key it has seen in the current window. Between syncs it
+// admits requests against that total plus its own unsynced ones, but never
+// more than MaxOvershoot unsynced requests per key: once that many are
+// pending, the next request syncs before it is decided.
+//
+// The trade-off is accuracy. Denials are always correct, since counts only
+// grow within a window, but admissions are not: every process may admit up
+// to MaxOvershoot requests the others have not seen, so a key can get up to
+// Limit + processes*MaxOvershoot requests in a window. A MaxOvershoot of 0
+// syncs on every request, which is close to exact but saves no round trips.
+// Windows follow each process's own clock.
+type Tiered struct {
+	Limit        int
+	WindowSize   time.Duration
+	SyncInterval time.Duration
+	MaxOvershoot int
+
+	store      *store.RedisStore
+	localStore *store.MemoryStore
+	counters   *store.Typed[TieredCounter]
+	locks      keyLocks
+
+	mu   sync.Mutex
+	keys map[string]struct{} // Keys synced every SyncInterval until their window ends
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewTiered(limit int, windowSize, syncInterval time.Duration, maxOvershoot int, s *store.RedisStore) *Tiered {
+	if limit <= 0 {
+		panic("limit must be greater than 0")
+	}
+	if windowSize < time.Millisecond {
+		panic("windowSize must be at least 1 millisecond")
+	}
+	if syncInterval <= 0 {
+		panic("syncInterval must be greater than 0")
+	}
+	if maxOvershoot < 0 {
+		panic("maxOvershoot must not be negative")
+	}
+	local := store.NewMemoryStore()
+	t := &Tiered{
+		Limit:        limit,
+		WindowSize:   windowSize,
+		SyncInterval: syncInterval,
+		MaxOvershoot: maxOvershoot,
+		store:        s,
+		localStore:   local,
+		counters:     store.NewTyped[TieredCounter](local),
+		keys:         map[string]struct{}{},
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	go t.syncLoop()
+
+	return t
+}
+
+// Allow checks a request for key against the local view of its window.
+func (t *Tiered) Allow(ctx context.Context, key string) (Result, error) {
+	return t.AllowN(ctx, key, 1)
+}
+
+// AllowN checks n requests for key against the local view of its window,
+// syncing with Redis first if they would take the key past MaxOvershoot
+// unsynced requests.
+func (t *Tiered) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	res, err := t.reserveN(ctx, key, n, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return res.result(), nil
+}
+
+// AllowMany checks a request for each of keys, one at a time. Requests are
+// decided from the local counters, which only go to Redis when they need a
+// sync, so there are no round trips to batch.
+func (t *Tiered) AllowMany(ctx context.Context, keys []string) ([]Result, error) {
+	return allowEach(ctx, t, keys)
+}
+
+// reserveN admits n requests in the current window. Tiered cannot book
+// requests in later windows, so Composite.Wait and Reserve over it fail
+// instead of waiting.
+func (t *Tiered) reserveN(ctx context.Context, key string, n int, maxDelay time.Duration) (*Reservation, error) {
+	if err := checkN(n, t.Limit); err != nil {
+		return nil, err
+	}
+
+	mu := t.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	c, err := t.load(ctx, key, now)
+	if err != nil {
+		return nil, err
+	}
+	if c.Pending+n > t.MaxOvershoot {
+		if err := t.push(ctx, key, c); err != nil {
+			return nil, err
+		}
+	}
+
+	used := c.Global + c.Pending
+	var delay time.Duration
+	if used+n > t.Limit {
+		delay = t.windowEnd(c.Window).Sub(now)
+	}
+	res := newReservation(t.Limit, now, delay, 0)
+	if !res.ok && maxDelay > 0 {
+		return nil, fmt.Errorf("tiered limiter cannot book requests for key %s in a later window", key)
+	}
+	if res.ok {
+		c.Pending += n
+		window := c.Window
+		res.cancel = func(ctx context.Context) error {
+			return t.refund(ctx, key, n, window)
+		}
+	}
+	res.remaining = max(t.Limit-c.Global-c.Pending, 0)
+	if err := t.save(ctx, key, c, now); err != nil {
+		return nil, err
+	}
+	t.track(key)
+	return res, nil
+}
+
+// Peek reports whether a request for key would be admitted right now, going
+// by the local view of its window.
+func (t *Tiered) Peek(ctx context.Context, key string) (Result, error) {
+	mu := t.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	c, err := t.load(ctx, key, now)
+	if err != nil {
+		return Result{}, err
+	}
+	used := c.Global + c.Pending
+	if used+1 <= t.Limit {
+		return Result{
+			Allowed:    true,
+			Limit:      t.Limit,
+			Remaining:  t.Limit - used,
+			RetryAfter: 0,
+		}, nil
+	}
+	return Result{
+		Allowed:    false,
+		Limit:      t.Limit,
+		Remaining:  0,
+		RetryAfter: t.windowEnd(c.Window).Sub(now),
+	}, nil
+}
+
+// Reset clears key's current window, locally and in Redis.
+func (t *Tiered) Reset(ctx context.Context, key string) error {
+	mu := t.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	window := t.window(time.Now())
+	err := t.store.Delete(ctx, t.redisKey(key, window))
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	localErr := t.counters.Delete(ctx, key)
+	if err != nil && localErr != nil {
+		return fmt.Errorf("bucket for key %s does not exist", key)
+	}
+	return nil
+}
+
+// ResetPrefix clears every key starting with prefix, in all of its windows
+// in Redis and locally.
+func (t *Tiered) ResetPrefix(ctx context.Context, prefix string) error {
+	if err := resetPrefix(ctx, t.store, nil, prefix); err != nil {
+		return err
+	}
+	return resetPrefix(ctx, t.localStore, &t.locks, prefix)
+}
+
+// Sync pushes the pending requests of every key used in its current window
+// to Redis, and refreshes their counts from it. It runs every SyncInterval
+// on its own.
+func (t *Tiered) Sync(ctx context.Context) error {
+	t.mu.Lock()
+	keys := slices.Collect(maps.Keys(t.keys))
+	t.mu.Unlock()
+
+	var errs []error
+	for _, key := range keys {
+		if err := t.syncKey(ctx, key); err != nil {
+			errs = append(errs, fmt.Errorf("key %s: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops the background sync and pushes what is still pending.
+func (t *Tiered) Close() error {
+	close(t.stop)
+	<-t.done
+	err := t.Sync(context.Background())
+	t.localStore.Close()
+	return err
+}
+
+func (t *Tiered) syncLoop() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			t.Sync(context.Background())
+		}
+	}
+}
+
+func (t *Tiered) syncKey(ctx context.Context, key string) error {
+	mu := t.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	c, err := t.counters.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if c == nil || c.Window != t.window(now) {
+		// A window that has ended no longer limits anything
+		t.mu.Lock()
+		delete(t.keys, key)
+		t.mu.Unlock()
+		return nil
+	}
+	if err := t.push(ctx, key, c); err != nil {
+		return err
+	}
+	return t.save(ctx, key, c, now)
+}
+
+// refund takes n requests admitted in window back out of key's count.
+func (t *Tiered) refund(ctx context.Context, key string, n int, window int64) error {
+	mu := t.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now()
+	c, err := t.counters.Get(ctx, key)
+	if err != nil || c == nil || c.Window != window {
+		return err
+	}
+	// Pending may go negative, taking already synced requests back out of
+	// Redis on the next sync
+	c.Pending -= n
+	return t.save(ctx, key, c, now)
+}
+
+// push adds c's pending requests to the window's count in Redis and takes
+// the new total as c's global count.
+func (t *Tiered) push(ctx context.Context, key string, c *TieredCounter) error {
+	ttl := t.windowEnd(c.Window).Sub(time.Now()) + t.WindowSize
+	val, err := t.store.Eval(ctx, tieredScript, []string{t.redisKey(key, c.Window)}, c.Pending, ttl.Milliseconds())
+	if err != nil {
+		return err
+	}
+	total, ok := val.(int64)
+	if !ok {
+		return fmt.Errorf("unexpected reply from script: %v", val)
+	}
+	c.Global = int(total)
+	c.Pending = 0
+	return nil
+}
+
+// load fetches key's counter for the current window, starting an empty one
+// when the key is new or its window has ended.
+func (t *Tiered) load(ctx context.Context, key string, now time.Time) (*TieredCounter, error) {
+	c, err := t.counters.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bucket state: %w", err)
+	}
+	window := t.window(now)
+	if c == nil || c.Window != window {
+		c = &TieredCounter{Window: window}
+	}
+	return c, nil
+}
+
+func (t *Tiered) save(ctx context.Context, key string, c *TieredCounter, now time.Time) error {
+	ttl := t.windowEnd(c.Window).Sub(now) + t.SyncInterval
+	if err := t.counters.Set(ctx, key, c, ttl); err != nil {
+		return fmt.Errorf("failed to save bucket state: %w", err)
+	}
+	return nil
+}
+
+// track adds key to the keys synced every SyncInterval.
+func (t *Tiered) track(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.keys[key] = struct{}{}
+}
+
+func (t *Tiered) window(now time.Time) int64 {
+	return now.UnixNano() / t.WindowSize.Nanoseconds()
+}
+
+func (t *Tiered) windowEnd(window int64) time.Time {
+	return time.Unix(0, (window+1)*t.WindowSize.Nanoseconds())
+}
+
+func (t *Tiered) redisKey(key string, window int64) string {
+	return key + ":" + strconv.FormatInt(window, 10)
+}
@@ -0,0 +1,183 @@
+package algorithms
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/codetesla51/limitz/store"
+)
+
+func newTieredRedis(t *testing.T) (*miniredis.Miniredis, *store.RedisStore) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	s, err := store.NewRedisStore(mr.Addr(), "", "")
+	if err != nil {
+		t.Fatalf("failed to connect to miniredis: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return mr, s
+}
+
+// redisCount returns the count Redis holds for key's current window.
+func redisCount(mr *miniredis.Miniredis, tl *Tiered, key string) int {
+	v, err := mr.Get(tl.redisKey(key, tl.window(time.Now())))
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(v)
+	return n
+}
+
+func TestTieredDecidesLocally(t *testing.T) {
+	ctx := context.Background()
+	mr, s := newTieredRedis(t)
+	tl := NewTiered(10, time.Minute, time.Hour, 5, s)
+	defer tl.Close()
+
+	before := mr.CommandCount()
+	for i := 0; i < 5; i++ {
+		if result, err := tl.Allow(ctx, "user1"); err != nil || !result.Allowed {
+			t.Fatalf("request %d: got %+v, %v, want allowed", i+1, result, err)
+		}
+	}
+	if n := mr.CommandCount() - before; n != 0 {
+		t.Errorf("got %d Redis commands, want none", n)
+	}
+
+	// The 6th request would leave 6 unsynced, so it syncs first
+	if result, err := tl.Allow(ctx, "user1"); err != nil || !result.Allowed {
+		t.Fatalf("got %+v, %v, want allowed", result, err)
+	}
+	if got := redisCount(mr, tl, "user1"); got != 5 {
+		t.Errorf("Redis holds %d, want the 5 requests synced before the 6th", got)
+	}
+
+	for i := 0; i < 4; i++ {
+		tl.Allow(ctx, "user1")
+	}
+	result, err := tl.Allow(ctx, "user1")
+	if err != nil {
+		t.Fatalf("Allow returned error: %v", err)
+	}
+	if result.Allowed || result.RetryAfter <= 0 {
+		t.Errorf("got %+v, want the 11th request denied until the window ends", result)
+	}
+}
+
+func TestTieredOvershootIsBounded(t *testing.T) {
+	ctx := context.Background()
+	mr, s := newTieredRedis(t)
+	first := NewTiered(10, time.Minute, time.Hour, 3, s)
+	defer first.Close()
+	second := NewTiered(10, time.Minute, time.Hour, 3, s)
+	defer second.Close()
+
+	allowed := 0
+	for i := 0; i < 40; i++ {
+		l := first
+		if i%2 == 1 {
+			l = second
+		}
+		result, err := l.Allow(ctx, "user1")
+		if err != nil {
+			t.Fatalf("Allow returned error: %v", err)
+		}
+		if result.Allowed {
+			allowed++
+		}
+	}
+	if allowed < 10 || allowed > 10+2*3 {
+		t.Errorf("got %d allowed, want between 10 and the limit plus 2 instances' overshoot", allowed)
+	}
+
+	if err := first.Sync(ctx); err != nil {
+		t.Fatalf("Sync returned error: %v", err)
+	}
+	if err := second.Sync(ctx); err != nil {
+		t.Fatalf("Sync returned error: %v", err)
+	}
+	if got := redisCount(mr, first, "user1"); got != allowed {
+		t.Errorf("Redis holds %d after syncing, want all %d admitted requests", got, allowed)
+	}
+}
+
+func TestTieredBackgroundSync(t *testing.T) {
+	ctx := context.Background()
+	mr, s := newTieredRedis(t)
+	first := NewTiered(10, time.Minute, 10*time.Millisecond, 5, s)
+	defer first.Close()
+	second := NewTiered(10, time.Minute, 10*time.Millisecond, 5, s)
+	defer second.Close()
+
+	for i := 0; i < 4; i++ {
+		first.Allow(ctx, "user1")
+	}
+	second.Allow(ctx, "user1")
+
+	deadline := time.Now().Add(time.Second)
+	for redisCount(mr, first, "user1") != 5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := redisCount(mr, first, "user1"); got != 5 {
+		t.Fatalf("Redis holds %d, want 5 after the background sync", got)
+	}
+
+	// Wait for the second limiter's next sync to see the first one's requests
+	time.Sleep(50 * time.Millisecond)
+	result, err := second.Peek(ctx, "user1")
+	if err != nil {
+		t.Fatalf("Peek returned error: %v", err)
+	}
+	if result.Remaining != 5 {
+		t.Errorf("got Remaining %d, want 5 once the other instance's requests are synced", result.Remaining)
+	}
+}
+
+func TestTieredCancelAndReset(t *testing.T) {
+	ctx := context.Background()
+	mr, s := newTieredRedis(t)
+	tl := NewTiered(3, time.Minute, time.Hour, 0, s)
+	defer tl.Close()
+
+	res, err := tl.reserveN(ctx, "user1", 2, 0)
+	if err != nil || !res.OK() {
+		t.Fatalf("got %v, %v, want a booked reservation", res, err)
+	}
+	if err := res.refund(ctx); err != nil {
+		t.Fatalf("refund returned error: %v", err)
+	}
+	if err := tl.Sync(ctx); err != nil {
+		t.Fatalf("Sync returned error: %v", err)
+	}
+	if got := redisCount(mr, tl, "user1"); got != 0 {
+		t.Errorf("Redis holds %d after the refund, want 0", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		tl.Allow(ctx, "user1")
+	}
+	if err := tl.Reset(ctx, "user1"); err != nil {
+		t.Fatalf("Reset returned error: %v", err)
+	}
+	if result, err := tl.Allow(ctx, "user1"); err != nil || !result.Allowed || result.Remaining != 2 {
+		t.Errorf("got %+v, %v after Reset, want a fresh window", result, err)
+	}
+}
+
+func TestTieredCloseSyncs(t *testing.T) {
+	ctx := context.Background()
+	mr, s := newTieredRedis(t)
+	tl := NewTiered(10, time.Minute, time.Hour, 5, s)
+
+	tl.Allow(ctx, "user1")
+	tl.Allow(ctx, "user1")
+	if err := tl.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if got := redisCount(mr, tl, "user1"); got != 2 {
+		t.Errorf("Redis holds %d after Close, want 2", got)
+	}
+}
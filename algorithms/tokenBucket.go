@@ -2,9 +2,7 @@ package algorithms
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"sync"
 	"time"
 
 	"github.com/codetesla51/limitz/store"
@@ -19,7 +17,8 @@ type TokenBucket struct {
 	Capacity   int
 	RefillRate int
 	store      store.Store
-	mu         sync.Mutex
+	state      *store.Typed[Buckets]
+	locks      keyLocks
 }
 
 func NewTokenBucket(capacity, refillRate int, s store.Store) *TokenBucket {
@@ -27,47 +26,119 @@ func NewTokenBucket(capacity, refillRate int, s store.Store) *TokenBucket {
 		Capacity:   capacity,
 		RefillRate: refillRate,
 		store:      s,
+		state:      store.NewTyped[Buckets](s),
 	}
 }
 
 // Allow checks if a request is allowed using token bucket rate limiting.
 func (tb *TokenBucket) Allow(ctx context.Context, key string) (Result, error) {
-	tb.mu.Lock()
-	defer tb.mu.Unlock()
+	return tb.AllowN(ctx, key, 1)
+}
+
+// AllowN checks if a request costing n tokens is allowed, consuming all n
+// tokens at once or none of them.
+func (tb *TokenBucket) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	res, err := tb.reserveN(ctx, key, n, 0)
+	if err != nil {
+		return Result{}, err
+	}
+	return res.result(), nil
+}
+
+// AllowMany takes a token for each of keys that has one available. With a
+// store.BatchUpdater, the buckets of the whole batch are updated in one
+// atomic step.
+func (tb *TokenBucket) AllowMany(ctx context.Context, keys []string) ([]Result, error) {
+	return allowMany(ctx, tb.state, &tb.locks, keys, tb.reserve)
+}
+
+// Wait blocks until a token is available for key.
+func (tb *TokenBucket) Wait(ctx context.Context, key string) error {
+	return tb.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until n tokens are available for key.
+func (tb *TokenBucket) WaitN(ctx context.Context, key string, n int) error {
+	return waitN(ctx, tb, key, n)
+}
+
+// Reserve books a token for key.
+func (tb *TokenBucket) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return tb.ReserveN(ctx, key, 1)
+}
+
+// ReserveN books n tokens for key, taking the bucket into debt when it does
+// not hold enough. Later requests are denied until the debt is refilled.
+func (tb *TokenBucket) ReserveN(ctx context.Context, key string, n int) (*Reservation, error) {
+	return tb.reserveN(ctx, key, n, maxWait)
+}
+
+func (tb *TokenBucket) reserveN(ctx context.Context, key string, n int, maxDelay time.Duration) (*Reservation, error) {
+	if err := checkN(n, tb.Capacity); err != nil {
+		return nil, err
+	}
+
+	mu := tb.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+
 	now := time.Now()
-	tokenBucketData, err := tb.store.Get(ctx, key)
-	var bucket *Buckets
+
+	var res *Reservation
+	err := update(ctx, tb.state, key, func(bucket *Buckets) (*Buckets, time.Duration, error) {
+		var ttl time.Duration
+		bucket, ttl, res = tb.reserve(bucket, n, now, maxDelay)
+		return bucket, ttl, nil
+	})
 	if err != nil {
-		bucket = &Buckets{
-			Tokens:       tb.Capacity,
-			LastRefillTs: now,
-		}
-	} else {
-		switch v := tokenBucketData.(type) {
-		case *Buckets:
-			bucket = v
-		case string:
-			bucket = &Buckets{}
-			if err := json.Unmarshal([]byte(v), bucket); err != nil {
-				bucket = &Buckets{Tokens: tb.Capacity, LastRefillTs: now}
-			}
-		default:
-			bucket = &Buckets{Tokens: tb.Capacity, LastRefillTs: now}
+		return nil, err
+	}
+	if res.ok {
+		res.cancel = func(ctx context.Context) error {
+			return tb.refund(ctx, key, n)
 		}
 	}
+	return res, nil
+}
 
-	timePassed := now.Sub(bucket.LastRefillTs)
-	tokensToAdd := int(timePassed.Seconds()) * tb.RefillRate
-	tokensToAdd = min(tokensToAdd, tb.Capacity-bucket.Tokens)
-	bucket.Tokens += tokensToAdd
-	bucket.LastRefillTs = now
+// reserve takes n tokens from bucket, the key's state or nil if it has
+// none, if they are available within maxDelay of now. It returns the state
+// to store, or nil when nothing was taken.
+func (tb *TokenBucket) reserve(bucket *Buckets, n int, now time.Time, maxDelay time.Duration) (*Buckets, time.Duration, *Reservation) {
+	if bucket == nil {
+		bucket = tb.newBucket(now)
+	}
+	tb.refill(bucket, now)
 
-	if bucket.Tokens > 0 {
-		bucket.Tokens--
-		err := tb.store.Set(ctx, key, bucket, 1*time.Hour)
-		if err != nil {
-			return Result{}, fmt.Errorf("failed to save bucket state: %v", err)
-		}
+	var delay time.Duration
+	if bucket.Tokens < n {
+		delay = tb.retryAfter(bucket, n, now)
+	}
+
+	res := newReservation(tb.Capacity, now, delay, maxDelay)
+	if !res.ok {
+		res.remaining = max(bucket.Tokens, 0)
+		return nil, 0, res
+	}
+
+	bucket.Tokens -= n
+	res.remaining = max(bucket.Tokens, 0)
+	return bucket, tb.ttl(bucket, now), res
+}
+
+// Peek reports whether a request for key would be allowed right now without
+// consuming a token. Remaining is the number of tokens currently held.
+func (tb *TokenBucket) Peek(ctx context.Context, key string) (Result, error) {
+	mu := tb.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+	now := time.Now()
+	bucket, err := tb.inspect(ctx, key, now)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if bucket.Tokens >= 1 {
 		return Result{
 			Allowed:    true,
 			Limit:      tb.Capacity,
@@ -75,21 +146,106 @@ func (tb *TokenBucket) Allow(ctx context.Context, key string) (Result, error) {
 			RetryAfter: 0,
 		}, nil
 	}
-
-	err = tb.store.Set(ctx, key, bucket, 1*time.Hour)
-	if err != nil {
-		return Result{}, fmt.Errorf("failed to save bucket state: %v", err)
-	}
 	return Result{
 		Allowed:    false,
 		Limit:      tb.Capacity,
-		Remaining:  bucket.Tokens,
-		RetryAfter: time.Duration(float64(time.Second) / float64(tb.RefillRate)),
+		Remaining:  0,
+		RetryAfter: tb.retryAfter(bucket, 1, now),
 	}, nil
 }
+
+// Inspect returns key's bucket with the refill applied up to now. A key with
+// no state yet gets a full bucket. Nothing is written back to the store.
+func (tb *TokenBucket) Inspect(ctx context.Context, key string) (*Buckets, error) {
+	mu := tb.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+	return tb.inspect(ctx, key, time.Now())
+}
+
+// inspect refills a copy of key's bucket, so the state held by the store is
+// left as it was.
+func (tb *TokenBucket) inspect(ctx context.Context, key string, now time.Time) (*Buckets, error) {
+	stored, err := tb.load(ctx, key, now)
+	if err != nil {
+		return nil, err
+	}
+	bucket := *stored
+	tb.refill(&bucket, now)
+	return &bucket, nil
+}
+
+// refund hands n tokens back to key's bucket after a reservation is
+// cancelled.
+func (tb *TokenBucket) refund(ctx context.Context, key string, n int) error {
+	mu := tb.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+	now := time.Now()
+	return update(ctx, tb.state, key, func(bucket *Buckets) (*Buckets, time.Duration, error) {
+		if bucket == nil {
+			return nil, 0, nil
+		}
+		tb.refill(bucket, now)
+		bucket.Tokens = min(bucket.Tokens+n, tb.Capacity)
+		return bucket, tb.ttl(bucket, now), nil
+	})
+}
+
+// load fetches key's bucket, starting a full one when the key is new.
+func (tb *TokenBucket) load(ctx context.Context, key string, now time.Time) (*Buckets, error) {
+	bucket, err := tb.state.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bucket state: %w", err)
+	}
+	if bucket == nil {
+		bucket = tb.newBucket(now)
+	}
+	return bucket, nil
+}
+
+// newBucket starts a full bucket for a key with no state.
+func (tb *TokenBucket) newBucket(now time.Time) *Buckets {
+	return &Buckets{
+		Tokens:       tb.Capacity,
+		LastRefillTs: now,
+	}
+}
+
+// refill adds the tokens earned since the last refill. Only whole seconds
+// are credited, so the leftover fraction carries over to the next call
+// instead of being dropped.
+func (tb *TokenBucket) refill(bucket *Buckets, now time.Time) {
+	seconds := int(now.Sub(bucket.LastRefillTs) / time.Second)
+	if seconds > 0 {
+		bucket.Tokens = min(bucket.Tokens+seconds*tb.RefillRate, tb.Capacity)
+		bucket.LastRefillTs = bucket.LastRefillTs.Add(time.Duration(seconds) * time.Second)
+	}
+	if bucket.Tokens >= tb.Capacity {
+		bucket.LastRefillTs = now
+	}
+}
+
+// retryAfter returns how long until the bucket holds at least n tokens.
+func (tb *TokenBucket) retryAfter(bucket *Buckets, n int, now time.Time) time.Duration {
+	missing := n - bucket.Tokens
+	seconds := (missing + tb.RefillRate - 1) / tb.RefillRate
+	return max(bucket.LastRefillTs.Add(time.Duration(seconds)*time.Second).Sub(now), 0)
+}
+
+// ttl keeps the bucket around for an hour past the point where any debt
+// from reservations has been refilled.
+func (tb *TokenBucket) ttl(bucket *Buckets, now time.Time) time.Duration {
+	if bucket.Tokens >= 0 {
+		return 1 * time.Hour
+	}
+	return 1*time.Hour + tb.retryAfter(bucket, 0, now)
+}
+
 func (tb *TokenBucket) Reset(ctx context.Context, key string) error {
-	tb.mu.Lock()
-	defer tb.mu.Unlock()
+	mu := tb.locks.mutex(key)
+	mu.Lock()
+	defer mu.Unlock()
 	exists, err := tb.store.Exists(ctx, key)
 	if err != nil {
 		return err
@@ -99,3 +255,8 @@ func (tb *TokenBucket) Reset(ctx context.Context, key string) error {
 	}
 	return tb.store.Delete(ctx, key)
 }
+
+// ResetPrefix clears every key starting with prefix.
+func (tb *TokenBucket) ResetPrefix(ctx context.Context, prefix string) error {
+	return resetPrefix(ctx, tb.store, &tb.locks, prefix)
+}
@@ -255,3 +255,117 @@ func TestSeparateKeysHaveSeparateBuckets(t *testing.T) {
 		t.Errorf("User B should have 2 tokens, got %d", bucket.Tokens)
 	}
 }
+
+// Test that AllowN consumes n tokens at once
+func TestAllowNConsumesTokens(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	limiter := NewTokenBucket(10, 1, s)
+
+	result, err := limiter.AllowN(ctx, "user-a", 7)
+	if err != nil {
+		t.Fatalf("AllowN returned error: %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected request of 7 to be allowed")
+	}
+	if result.Remaining != 3 {
+		t.Errorf("Expected 3 tokens remaining, got %d", result.Remaining)
+	}
+}
+
+// Test that a denied AllowN leaves the bucket untouched
+func TestAllowNDeniedConsumesNothing(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	limiter := NewTokenBucket(10, 2, s)
+
+	_, _ = limiter.AllowN(ctx, "user-a", 6)
+
+	result, err := limiter.AllowN(ctx, "user-a", 5)
+	if err != nil {
+		t.Fatalf("AllowN returned error: %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request of 5 to be denied with 4 tokens left")
+	}
+	if result.Remaining != 4 {
+		t.Errorf("Expected 4 tokens remaining, got %d", result.Remaining)
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > 1*time.Second {
+		t.Errorf("Expected RetryAfter within 1s for 1 missing token, got %v", result.RetryAfter)
+	}
+
+	// The 4 remaining tokens are still available
+	result, err = limiter.AllowN(ctx, "user-a", 4)
+	if err != nil || !result.Allowed {
+		t.Error("Expected request of 4 to be allowed")
+	}
+}
+
+// Test that AllowN rejects costs the bucket can never hold
+func TestAllowNInvalidCost(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	limiter := NewTokenBucket(5, 1, s)
+
+	if _, err := limiter.AllowN(ctx, "user-a", 0); err == nil {
+		t.Error("Expected error for n=0")
+	}
+	if _, err := limiter.AllowN(ctx, "user-a", 6); err == nil {
+		t.Error("Expected error for n greater than capacity")
+	}
+}
+
+// Test that Peek reports the bucket without consuming a token
+func TestPeekDoesNotConsume(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	limiter := NewTokenBucket(5, 1, s)
+
+	_, _ = limiter.AllowN(ctx, "user-a", 2)
+
+	for i := 0; i < 3; i++ {
+		result, err := limiter.Peek(ctx, "user-a")
+		if err != nil {
+			t.Fatalf("Peek returned error: %v", err)
+		}
+		if !result.Allowed || result.Remaining != 3 {
+			t.Errorf("Expected allowed with 3 remaining, got allowed=%v remaining=%d", result.Allowed, result.Remaining)
+		}
+	}
+
+	_, _ = limiter.AllowN(ctx, "user-a", 3)
+	result, _ := limiter.Peek(ctx, "user-a")
+	if result.Allowed || result.RetryAfter <= 0 {
+		t.Errorf("Expected denied with RetryAfter on empty bucket, got %+v", result)
+	}
+}
+
+// Test that Inspect applies the refill to a copy of the stored bucket
+func TestInspectAppliesRefill(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	limiter := NewTokenBucket(5, 2, s)
+
+	_, _ = limiter.AllowN(ctx, "user-a", 5)
+	time.Sleep(1 * time.Second)
+
+	bucket, err := limiter.Inspect(ctx, "user-a")
+	if err != nil {
+		t.Fatalf("Inspect returned error: %v", err)
+	}
+	if bucket.Tokens != 2 {
+		t.Errorf("Expected 2 refilled tokens, got %d", bucket.Tokens)
+	}
+
+	bucketData, _ := s.Get(ctx, "user-a")
+	if stored := bucketData.(*Buckets); stored.Tokens != 0 {
+		t.Errorf("Inspect should not modify the stored bucket, got %d tokens", stored.Tokens)
+	}
+
+	fresh, _ := limiter.Inspect(ctx, "user-b")
+	if fresh.Tokens != 5 {
+		t.Errorf("Expected a full bucket for a new key, got %d tokens", fresh.Tokens)
+	}
+}
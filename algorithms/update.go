@@ -0,0 +1,24 @@
+package algorithms
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/codetesla51/limitz/store"
+)
+
+// update reads key's state, lets fn decide on it and writes back what fn
+// returns: fn gets nil when the key has no state, and returning nil leaves
+// the key alone. When the store is a store.Updater the whole step is atomic
+// in the store, so the limit holds across processes. Otherwise it is a Get
+// followed by a Set, which is only safe within the process that holds the
+// key's lock.
+//
+// fn may be called more than once and must not keep state between calls.
+func update[T any](ctx context.Context, s *store.Typed[T], key string, fn func(current *T) (*T, time.Duration, error)) error {
+	if err := s.Update(ctx, key, fn); err != nil {
+		return fmt.Errorf("failed to update bucket state: %w", err)
+	}
+	return nil
+}
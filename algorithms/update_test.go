@@ -0,0 +1,226 @@
+package algorithms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/codetesla51/limitz/store"
+)
+
+// updaterStore is a MemoryStore that also implements store.Updater, with a
+// lock of its own standing in for a database row lock. It fails the test if
+// a limiter writes with Set or SetMany instead of going through Update.
+type updaterStore struct {
+	*store.MemoryStore
+	t       *testing.T
+	mu      sync.Mutex
+	updates atomic.Int32
+}
+
+func newUpdaterStore(t *testing.T) *updaterStore {
+	return &updaterStore{MemoryStore: store.NewMemoryStore(), t: t}
+}
+
+func (s *updaterStore) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	s.t.Error("Set called on a store.Updater")
+	return s.MemoryStore.Set(ctx, key, value, ttl)
+}
+
+func (s *updaterStore) SetMany(ctx context.Context, entries []store.Entry) error {
+	s.t.Error("SetMany called on a store.Updater")
+	return s.MemoryStore.SetMany(ctx, entries)
+}
+
+func (s *updaterStore) Update(ctx context.Context, key string, fn store.UpdateFunc) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updates.Add(1)
+
+	current, err := s.MemoryStore.Get(ctx, key)
+	if err != nil {
+		current = nil
+	}
+	next, ttl, err := fn(current)
+	if err != nil || next == nil {
+		return err
+	}
+	return s.MemoryStore.Set(ctx, key, next, ttl)
+}
+
+// allowedAcross sends 10 concurrent requests for one key, alternating
+// between two limiters that stand in for two app servers, so their own
+// mutexes do not protect the shared state. It returns how many were allowed.
+func allowedAcross(t *testing.T, first, second RateLimiter) int {
+	t.Helper()
+	ctx := context.Background()
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		l := first
+		if i%2 == 1 {
+			l = second
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := l.Allow(ctx, "shared")
+			if err != nil {
+				t.Errorf("Allow returned error: %v", err)
+			}
+			if result.Allowed {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	return int(allowed.Load())
+}
+
+func TestAlgorithmsUseUpdater(t *testing.T) {
+	for name, newLimiter := range rateLimiters() {
+		t.Run(name, func(t *testing.T) {
+			s := newUpdaterStore(t)
+			if got := allowedAcross(t, newLimiter(s), newLimiter(s)); got != 3 {
+				t.Errorf("got %d allowed, want exactly 3", got)
+			}
+			if s.updates.Load() != 10 {
+				t.Errorf("got %d calls to Update, want 10", s.updates.Load())
+			}
+		})
+	}
+}
+
+func TestStoresUpdateAtomically(t *testing.T) {
+	stores := map[string]func(t *testing.T) store.Store{
+		"memory": func(t *testing.T) store.Store {
+			s := store.NewMemoryStore()
+			t.Cleanup(s.Close)
+			return s
+		},
+		"redis": func(t *testing.T) store.Store { return newTestRedisStore(t) },
+	}
+	for storeName, newStore := range stores {
+		for name, newLimiter := range rateLimiters() {
+			t.Run(storeName+"/"+name, func(t *testing.T) {
+				s := newStore(t)
+				if got := allowedAcross(t, newLimiter(s), newLimiter(s)); got != 3 {
+					t.Errorf("got %d allowed, want exactly 3", got)
+				}
+			})
+		}
+	}
+}
+
+func TestMemoryUpdateCopiesState(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	defer s.Close()
+	s.Set(ctx, "key", &SlidingWindowBucket{Timestamps: []int64{1, 2}}, time.Minute)
+	read, _ := s.Get(ctx, "key")
+
+	err := s.Update(ctx, "key", func(current interface{}) (interface{}, time.Duration, error) {
+		b := current.(*SlidingWindowBucket)
+		b.Timestamps[0] = 99
+		return nil, 0, errors.New("denied")
+	})
+	if err == nil || err.Error() != "denied" {
+		t.Fatalf("got %v, want fn's error", err)
+	}
+	stored, _ := s.Get(ctx, "key")
+	if got := stored.(*SlidingWindowBucket).Timestamps; got[0] != 1 || stored != read {
+		t.Errorf("got %v, want the stored state untouched by a failed update", got)
+	}
+
+	s.Update(ctx, "key", func(current interface{}) (interface{}, time.Duration, error) {
+		b := current.(*SlidingWindowBucket)
+		b.Timestamps = append(b.Timestamps[:0], 3)
+		return b, time.Minute, nil
+	})
+	if got := read.(*SlidingWindowBucket).Timestamps; got[0] != 1 {
+		t.Errorf("got %v, want a value read earlier to keep its contents", got)
+	}
+}
+
+func TestMemoryUpdateCopiesMaps(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	defer s.Close()
+	cl := NewConcurrencyLimiter(2, time.Minute, s)
+
+	lease, _, _ := cl.Acquire(ctx, "user1")
+	read, _ := s.Get(ctx, "user1")
+	if err := lease.Release(ctx); err != nil {
+		t.Fatalf("Release returned error: %v", err)
+	}
+	if got := len(read.(*ConcurrencyBucket).Leases); got != 1 {
+		t.Errorf("got %d leases in a value read before Release, want it to keep 1", got)
+	}
+
+	cl.Acquire(ctx, "user1")
+	err := s.Update(ctx, "user1", func(current interface{}) (interface{}, time.Duration, error) {
+		clear(current.(*ConcurrencyBucket).Leases)
+		return nil, 0, errors.New("denied")
+	})
+	if err == nil {
+		t.Fatal("want fn's error")
+	}
+	stored, _ := s.Get(ctx, "user1")
+	if got := len(stored.(*ConcurrencyBucket).Leases); got != 1 {
+		t.Errorf("got %d leases after a failed update, want 1", got)
+	}
+}
+
+func TestRedisUpdateRetriesOnConflict(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	s, err := store.NewRedisStore(mr.Addr(), "", "")
+	if err != nil {
+		t.Fatalf("failed to connect to miniredis: %v", err)
+	}
+	defer s.Close()
+
+	calls := 0
+	err = s.Update(ctx, "key", func(current interface{}) (interface{}, time.Duration, error) {
+		calls++
+		if calls == 1 {
+			// Another client writes between the read and the write
+			mr.Set("key", "other")
+		}
+		return []byte(fmt.Sprintf("%v+1", current)), time.Minute, nil
+	})
+	if err != nil {
+		t.Fatalf("Update returned error: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("fn was called %d times, want a retry after the conflict", calls)
+	}
+	if got, _ := mr.Get("key"); got != "other+1" {
+		t.Errorf("got %q, want the update applied to the other client's value", got)
+	}
+}
+
+func TestConcurrencyLimiterUsesUpdater(t *testing.T) {
+	ctx := context.Background()
+	s := newUpdaterStore(t)
+	cl := NewConcurrencyLimiter(1, time.Minute, s)
+
+	lease, _, err := cl.Acquire(ctx, "user1")
+	if err != nil || lease == nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	if err := lease.Renew(ctx); err != nil {
+		t.Fatalf("Renew failed: %v", err)
+	}
+	if err := lease.Release(ctx); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if s.updates.Load() != 3 {
+		t.Errorf("got %d calls to Update, want 3", s.updates.Load())
+	}
+}
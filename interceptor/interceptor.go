@@ -0,0 +1,261 @@
+// Package interceptor limits gRPC servers with any limiter from the
+// algorithms package.
+package interceptor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codetesla51/limitz/algorithms"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// ErrorHandler turns the error of a call that could not be checked, because
+// its key could not be found or the limiter returned an error, into the
+// error returned to the client.
+type ErrorHandler func(ctx context.Context, fullMethod string, err error) error
+
+// Policy is how calls to a method are limited.
+type Policy struct {
+	Limiter algorithms.RateLimiter // Checked once per call, nil to not limit the method
+	KeyFunc KeyFunc                // Defaults to the Options' KeyFunc
+
+	// MessageLimiter, when set, also limits the messages a client sends on
+	// a stream, each one checked under the call's key. Give it its own
+	// store or key space if it uses a different algorithm from Limiter.
+	MessageLimiter algorithms.RateLimiter
+	// WaitForMessages makes a stream wait for MessageLimiter, which must
+	// then be an algorithms.Waiter, instead of failing once it runs out. A
+	// message that would have to wait past the call's deadline still fails.
+	WaitForMessages bool
+}
+
+type Options struct {
+	KeyFunc KeyFunc      // Defaults to PeerAddress
+	OnError ErrorHandler // Defaults to InvalidArgument for ErrNoKey and Internal otherwise
+
+	// MessageLimiter and WaitForMessages are those of the default policy.
+	MessageLimiter  algorithms.RateLimiter
+	WaitForMessages bool
+
+	// Methods holds the policies of methods that are not limited by the
+	// default one, by full method name such as "/pkg.Service/Method", or by
+	// service such as "/pkg.Service/" for every method of it.
+	Methods map[string]Policy
+	// ExemptMethods are never limited, by full method name or service.
+	ExemptMethods []string
+}
+
+// Interceptor checks every call to a gRPC server against a policy before
+// passing it on.
+type Interceptor struct {
+	policy  *Policy
+	methods map[string]*Policy
+	exempt  map[string]bool
+	onError ErrorHandler
+}
+
+// New returns an Interceptor that limits every call with limiter unless
+// opts has another policy for the method. A nil limiter leaves the methods
+// without a policy in opts unlimited.
+func New(limiter algorithms.RateLimiter, opts Options) *Interceptor {
+	if opts.KeyFunc == nil {
+		opts.KeyFunc = PeerAddress
+	}
+	i := &Interceptor{
+		methods: make(map[string]*Policy, len(opts.Methods)),
+		exempt:  make(map[string]bool, len(opts.ExemptMethods)),
+		onError: opts.OnError,
+	}
+	if i.onError == nil {
+		i.onError = defaultError
+	}
+	newPolicy := func(p Policy) *Policy {
+		if p.Limiter == nil {
+			return nil
+		}
+		if p.KeyFunc == nil {
+			p.KeyFunc = opts.KeyFunc
+		}
+		if _, ok := p.MessageLimiter.(algorithms.Waiter); p.WaitForMessages && !ok {
+			panic(fmt.Sprintf("message limiter %T cannot wait", p.MessageLimiter))
+		}
+		return &p
+	}
+	i.policy = newPolicy(Policy{
+		Limiter:         limiter,
+		MessageLimiter:  opts.MessageLimiter,
+		WaitForMessages: opts.WaitForMessages,
+	})
+	for method, p := range opts.Methods {
+		i.methods[method] = newPolicy(p)
+	}
+	for _, method := range opts.ExemptMethods {
+		i.exempt[method] = true
+	}
+	return i
+}
+
+// Unary returns the interceptor for unary calls.
+func (i *Interceptor) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		p := i.lookup(info.FullMethod)
+		if p == nil {
+			return handler(ctx, req)
+		}
+		if _, err := i.check(ctx, p, info.FullMethod, func(md metadata.MD) { grpc.SetTrailer(ctx, md) }); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Stream returns the interceptor for streaming calls. The call is checked
+// when the stream opens and, with a MessageLimiter, every message the client
+// sends after that.
+func (i *Interceptor) Stream() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		p := i.lookup(info.FullMethod)
+		if p == nil {
+			return handler(srv, ss)
+		}
+		key, err := i.check(ss.Context(), p, info.FullMethod, ss.SetTrailer)
+		if err != nil {
+			return err
+		}
+		if p.MessageLimiter != nil {
+			ss = &limitedStream{ServerStream: ss, i: i, p: p, method: info.FullMethod, key: key}
+		}
+		return handler(srv, ss)
+	}
+}
+
+// lookup returns the policy of a method, or nil if it is not limited.
+func (i *Interceptor) lookup(fullMethod string) *Policy {
+	service := fullMethod[:strings.LastIndexByte(fullMethod, '/')+1]
+	if i.exempt[fullMethod] || i.exempt[service] {
+		return nil
+	}
+	if p, ok := i.methods[fullMethod]; ok {
+		return p
+	}
+	if p, ok := i.methods[service]; ok {
+		return p
+	}
+	return i.policy
+}
+
+// check runs a call through its policy and returns the key it was checked
+// under. The quota is passed to setTrailer.
+func (i *Interceptor) check(ctx context.Context, p *Policy, method string, setTrailer func(metadata.MD)) (string, error) {
+	key, err := p.KeyFunc(ctx, method)
+	if err != nil {
+		return "", i.onError(ctx, method, fmt.Errorf("failed to get rate limit key: %w", err))
+	}
+	result, err := p.Limiter.Allow(ctx, key)
+	if err != nil {
+		return "", i.onError(ctx, method, err)
+	}
+	setTrailer(trailer(result))
+	if !result.Allowed {
+		return "", denied(result)
+	}
+	return key, nil
+}
+
+// limitedStream checks every message received against a MessageLimiter.
+type limitedStream struct {
+	grpc.ServerStream
+	i      *Interceptor
+	p      *Policy
+	method string
+	key    string
+}
+
+func (s *limitedStream) RecvMsg(m interface{}) error {
+	// Only messages that arrive count, not the end of the stream
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	ctx := s.Context()
+	if s.p.WaitForMessages {
+		if err := s.p.MessageLimiter.(algorithms.Waiter).Wait(ctx, s.key); err != nil {
+			if ctx.Err() != nil {
+				return status.FromContextError(ctx.Err()).Err()
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				// The wait would outlast the call, so the message is
+				// denied as it is without waiting
+				return s.deny(ctx)
+			}
+			return s.i.onError(ctx, s.method, err)
+		}
+		return nil
+	}
+	result, err := s.p.MessageLimiter.Allow(ctx, s.key)
+	if err != nil {
+		return s.i.onError(ctx, s.method, err)
+	}
+	if !result.Allowed {
+		s.SetTrailer(trailer(result))
+		return denied(result)
+	}
+	return nil
+}
+
+// deny fails a message that would have to wait past the call's deadline,
+// with the key's quota as it stands.
+func (s *limitedStream) deny(ctx context.Context) error {
+	var result algorithms.Result
+	if p, ok := s.p.MessageLimiter.(algorithms.Peeker); ok {
+		if peeked, err := p.Peek(ctx, s.key); err == nil {
+			result = peeked
+		}
+	}
+	result.Allowed = false
+	s.SetTrailer(trailer(result))
+	return denied(result)
+}
+
+// denied returns the ResourceExhausted error for a denied call, with a
+// RetryInfo detail saying when to come back.
+func denied(result algorithms.Result) error {
+	st := status.New(codes.ResourceExhausted, "rate limit exceeded")
+	if result.RetryAfter > 0 {
+		if withInfo, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(result.RetryAfter)}); err == nil {
+			st = withInfo
+		}
+	}
+	return st.Err()
+}
+
+// trailer describes result with the legacy HTTP header names, for clients
+// that read trailers instead of status details.
+func trailer(result algorithms.Result) metadata.MD {
+	md := metadata.MD{}
+	if result.Limit > 0 {
+		md.Set("x-ratelimit-limit", strconv.Itoa(result.Limit))
+		md.Set("x-ratelimit-remaining", strconv.Itoa(max(result.Remaining, 0)))
+	}
+	if !result.Allowed && result.RetryAfter > 0 {
+		// Rounded up, so that a client waiting that long is never early
+		md.Set("retry-after", strconv.Itoa(int((result.RetryAfter+time.Second-1)/time.Second)))
+	}
+	return md
+}
+
+func defaultError(ctx context.Context, fullMethod string, err error) error {
+	if errors.Is(err, ErrNoKey) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.Internal, "rate limit check failed")
+}
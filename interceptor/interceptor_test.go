@@ -0,0 +1,271 @@
+package interceptor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codetesla51/limitz/algorithms"
+	"github.com/codetesla51/limitz/store"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const (
+	checkMethod = "/grpc.health.v1.Health/Check"
+	watchMethod = "/grpc.health.v1.Health/Watch"
+)
+
+func newLimiter(t *testing.T, limit int) *algorithms.FixedWindow {
+	t.Helper()
+	s := store.NewMemoryStore()
+	t.Cleanup(s.Close)
+	return algorithms.NewFixedWindow(limit, time.Minute, s)
+}
+
+// newHealthClient serves the health service through i and returns a client
+// connected to it.
+func newHealthClient(t *testing.T, i *Interceptor) healthpb.HealthClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpc.UnaryInterceptor(i.Unary()), grpc.StreamInterceptor(i.Stream()))
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("NewClient returned error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn)
+}
+
+func TestUnary(t *testing.T) {
+	client := newHealthClient(t, New(newLimiter(t, 2), Options{}))
+	ctx := context.Background()
+
+	var trailer metadata.MD
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Trailer(&trailer)); err != nil {
+		t.Fatalf("Check returned error: %v", err)
+	}
+	if got := trailer.Get("x-ratelimit-remaining"); len(got) != 1 || got[0] != "1" {
+		t.Errorf("got remaining %v, want 1", got)
+	}
+
+	client.Check(ctx, &healthpb.HealthCheckRequest{})
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Trailer(&trailer))
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted", err)
+	}
+	var info *errdetails.RetryInfo
+	for _, d := range st.Details() {
+		info, _ = d.(*errdetails.RetryInfo)
+	}
+	if info == nil || info.RetryDelay.AsDuration() <= 0 || info.RetryDelay.AsDuration() > time.Minute {
+		t.Errorf("got details %v, want a RetryInfo within the window", st.Details())
+	}
+	if got := trailer.Get("retry-after"); len(got) != 1 || got[0] == "0" {
+		t.Errorf("got retry-after %v, want the seconds to wait", got)
+	}
+}
+
+func TestStreamOpen(t *testing.T) {
+	client := newHealthClient(t, New(newLimiter(t, 1), Options{}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch returned error: %v", err)
+	}
+	if _, err := first.Recv(); err != nil {
+		t.Fatalf("Recv returned error: %v", err)
+	}
+	second, _ := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if _, err := second.Recv(); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("got %v for the second stream, want ResourceExhausted", err)
+	}
+}
+
+func TestMethodPolicies(t *testing.T) {
+	client := newHealthClient(t, New(nil, Options{
+		KeyFunc: Metadata("x-tenant"),
+		Methods: map[string]Policy{
+			checkMethod: {Limiter: newLimiter(t, 1)},
+		},
+	}))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-tenant", "acme")
+
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatalf("Check returned error: %v", err)
+	}
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("got %v, want ResourceExhausted", err)
+	}
+	other := metadata.AppendToOutgoingContext(context.Background(), "x-tenant", "globex")
+	if _, err := client.Check(other, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Errorf("got %v for another tenant, want it allowed", err)
+	}
+	if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v without the metadata, want InvalidArgument", err)
+	}
+
+	// Watch has no policy and the default limiter is nil
+	for n := 0; n < 3; n++ {
+		stream, _ := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+		if _, err := stream.Recv(); err != nil {
+			t.Errorf("got %v for a method without a policy, want it allowed", err)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	limited := Policy{Limiter: newLimiter(t, 1)}
+	i := New(newLimiter(t, 1), Options{
+		Methods: map[string]Policy{
+			"/pkg.Admin/":     limited,
+			"/pkg.Admin/Ping": {},
+		},
+		ExemptMethods: []string{"/pkg.Public/", watchMethod},
+	})
+	tests := map[string]*Policy{
+		"/pkg.Admin/Delete":  i.methods["/pkg.Admin/"],
+		"/pkg.Admin/Ping":    nil,
+		"/pkg.Public/Search": nil,
+		watchMethod:          nil,
+		checkMethod:          i.policy,
+	}
+	for method, want := range tests {
+		if got := i.lookup(method); got != want {
+			t.Errorf("%s: got policy %p, want %p", method, got, want)
+		}
+	}
+}
+
+// fakeStream is a server stream whose client has sent n messages.
+type fakeStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	n       int
+	trailer metadata.MD
+}
+
+func (s *fakeStream) Context() context.Context { return s.ctx }
+
+func (s *fakeStream) SetTrailer(md metadata.MD) { s.trailer = metadata.Join(s.trailer, md) }
+
+func (s *fakeStream) RecvMsg(m interface{}) error {
+	if s.n == 0 {
+		return errors.New("EOF")
+	}
+	s.n--
+	return nil
+}
+
+// recvAll runs a stream of n messages through i under ctx and returns the
+// stream, how many messages the handler got and the error that ended it.
+func recvAll(ctx context.Context, i *Interceptor, n int) (*fakeStream, int, error) {
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}})
+	stream := &fakeStream{ctx: ctx, n: n}
+	got := 0
+	err := i.Stream()(nil, stream, &grpc.StreamServerInfo{FullMethod: "/pkg.Chat/Send"},
+		func(srv interface{}, ss grpc.ServerStream) error {
+			for {
+				if err := ss.RecvMsg(nil); err != nil {
+					return err
+				}
+				got++
+			}
+		})
+	return stream, got, err
+}
+
+func TestStreamMessages(t *testing.T) {
+	i := New(newLimiter(t, 10), Options{MessageLimiter: newLimiter(t, 3)})
+	_, got, err := recvAll(context.Background(), i, 5)
+	if got != 3 || status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("got %d messages and %v, want 3 and ResourceExhausted", got, err)
+	}
+
+	// The end of the stream is not counted against the limit
+	i = New(newLimiter(t, 10), Options{MessageLimiter: newLimiter(t, 3)})
+	if _, got, err := recvAll(context.Background(), i, 3); got != 3 || err == nil || status.Code(err) == codes.ResourceExhausted {
+		t.Errorf("got %d messages and %v, want all 3 and the end of the stream", got, err)
+	}
+}
+
+func TestStreamMessagesWait(t *testing.T) {
+	s := store.NewMemoryStore()
+	t.Cleanup(s.Close)
+	messages := algorithms.NewGCRA(100, time.Second, 2, s)
+	i := New(newLimiter(t, 10), Options{MessageLimiter: messages, WaitForMessages: true})
+
+	start := time.Now()
+	_, got, _ := recvAll(context.Background(), i, 6)
+	if got != 6 {
+		t.Errorf("got %d messages, want all 6", got)
+	}
+	// 4 messages past the burst of 2, at 100 per second
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond || elapsed > time.Second {
+		t.Errorf("took %v, want the stream slowed down", elapsed)
+	}
+}
+
+func TestStreamMessagesWaitPastDeadline(t *testing.T) {
+	s := store.NewMemoryStore()
+	t.Cleanup(s.Close)
+	messages := algorithms.NewGCRA(1, time.Second, 1, s)
+	i := New(newLimiter(t, 10), Options{MessageLimiter: messages, WaitForMessages: true})
+
+	// The second message would wait a second, past the stream's deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	stream, got, err := recvAll(ctx, i, 2)
+	st := status.Convert(err)
+	if got != 1 || st.Code() != codes.ResourceExhausted {
+		t.Fatalf("got %d messages and %v, want 1 and ResourceExhausted", got, err)
+	}
+	var info *errdetails.RetryInfo
+	for _, d := range st.Details() {
+		info, _ = d.(*errdetails.RetryInfo)
+	}
+	if info == nil || info.RetryDelay.AsDuration() <= 0 || info.RetryDelay.AsDuration() > time.Second {
+		t.Errorf("got details %v, want a RetryInfo within a second", st.Details())
+	}
+	if got := stream.trailer.Get("retry-after"); len(got) != 1 || got[0] != "1" {
+		t.Errorf("got retry-after %v, want 1", got)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 443}})
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("x-api-key", "k1"))
+
+	key := Composite(Metadata("x-api-key"), Method, PeerAddress)
+	if got, err := key(ctx, checkMethod); err != nil || got != "k1:/grpc.health.v1.Health/Check:2001%3Adb8%3A%3A7" {
+		t.Errorf("got %q, %v, want the escaped parts joined", got, err)
+	}
+	if _, err := PeerAddress(context.Background(), checkMethod); !errors.Is(err, ErrNoKey) {
+		t.Errorf("got %v without a peer, want ErrNoKey", err)
+	}
+	if _, err := Metadata("x-tenant")(ctx, checkMethod); !errors.Is(err, ErrNoKey) {
+		t.Errorf("got %v for missing metadata, want ErrNoKey", err)
+	}
+}
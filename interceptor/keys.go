@@ -0,0 +1,74 @@
+package interceptor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// KeyFunc returns the key a call is limited by. An error is passed to the
+// interceptor's OnError handler and the call is not served.
+type KeyFunc func(ctx context.Context, fullMethod string) (string, error)
+
+// ErrNoKey is returned, possibly wrapped, by key functions for a call that
+// does not carry what they key by, such as missing metadata.
+var ErrNoKey = errors.New("call has no rate limit key")
+
+// PeerAddress keys calls by the IP address of the client connection, or the
+// whole address for connections that are not over IP.
+func PeerAddress(ctx context.Context, fullMethod string) (string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "", fmt.Errorf("%w: no peer", ErrNoKey)
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String(), nil
+	}
+	return host, nil
+}
+
+// Metadata keys calls by the first value of a metadata key, such as an API
+// key or tenant ID sent by the client.
+func Metadata(name string) KeyFunc {
+	return func(ctx context.Context, fullMethod string) (string, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if v := md.Get(name); len(v) > 0 && v[0] != "" {
+			return v[0], nil
+		}
+		return "", fmt.Errorf("%w: no %s metadata", ErrNoKey, name)
+	}
+}
+
+// Method keys calls by their full method name, such as
+// "/pkg.Service/Method", for a limit shared by every client of the method.
+func Method(ctx context.Context, fullMethod string) (string, error) {
+	return fullMethod, nil
+}
+
+// Composite keys calls by all of keys, joined with colons, such as
+// "/pkg.Service/Method:192.0.2.1" for a limit per client and method. Colons
+// and percent signs in each part are escaped, so that different parts never
+// make the same key. The call fails with the first error of any of keys.
+func Composite(keys ...KeyFunc) KeyFunc {
+	if len(keys) == 0 {
+		panic("composite key needs at least one key function")
+	}
+	escape := strings.NewReplacer("%", "%25", ":", "%3A")
+	return func(ctx context.Context, fullMethod string) (string, error) {
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			part, err := key(ctx, fullMethod)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = escape.Replace(part)
+		}
+		return strings.Join(parts, ":"), nil
+	}
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codetesla51/limitz/algorithms"
+)
+
+// Headers selects which rate limit headers the middleware sends. Retry-After
+// is always sent on a denied request that has a RetryAfter.
+type Headers int
+
+const (
+	// AllHeaders sends both the IETF draft and the legacy headers.
+	AllHeaders Headers = iota
+	// DraftHeaders sends RateLimit-Policy and RateLimit, as in the IETF
+	// httpapi-ratelimit-headers draft.
+	DraftHeaders
+	// LegacyHeaders sends X-RateLimit-Limit, X-RateLimit-Remaining and
+	// X-RateLimit-Reset.
+	LegacyHeaders
+	// NoHeaders sends no quota headers.
+	NoHeaders
+)
+
+// setHeaders describes result in h. A Result only says when to come back
+// once a request is denied, so the reset is only sent then. Results without
+// a Limit, such as those of FailSafe's FailOpen, get no quota headers.
+func (m *Middleware) setHeaders(h http.Header, result algorithms.Result, now time.Time) {
+	reset := 0
+	if !result.Allowed && result.RetryAfter > 0 {
+		reset = seconds(result.RetryAfter)
+		h.Set("Retry-After", strconv.Itoa(reset))
+	}
+	if result.Limit <= 0 {
+		return
+	}
+	remaining := strconv.Itoa(max(result.Remaining, 0))
+
+	if m.headers == AllHeaders || m.headers == DraftHeaders {
+		policy := m.policy + ";q=" + strconv.Itoa(result.Limit)
+		if m.window > 0 {
+			policy += ";w=" + strconv.Itoa(m.window)
+		}
+		h.Set("RateLimit-Policy", policy)
+		limit := m.policy + ";r=" + remaining
+		if reset > 0 {
+			limit += ";t=" + strconv.Itoa(reset)
+		}
+		h.Set("RateLimit", limit)
+	}
+
+	if m.headers == AllHeaders || m.headers == LegacyHeaders {
+		h.Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+		h.Set("X-RateLimit-Remaining", remaining)
+		if reset > 0 {
+			// Unix time, as most APIs sending these headers use
+			h.Set("X-RateLimit-Reset", strconv.FormatInt(now.Unix()+int64(reset), 10))
+		}
+	}
+}
+
+// seconds rounds d up to whole seconds, so that a client waiting that long
+// is never early.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// quote returns s as a structured field string, which may only hold
+// printable ASCII.
+func quote(s string) (string, bool) {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c > 0x7e {
+			return "", false
+		}
+		if c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte('"')
+	return b.String(), true
+}
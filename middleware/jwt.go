@@ -0,0 +1,172 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JWTClaim keys requests by a claim, "sub" if claim is empty, of the bearer
+// token in their Authorization header, without checking the token's
+// signature or expiry. A client can put anything in an unverified token, so
+// only use it behind a gateway that has already verified the token.
+func JWTClaim(claim string) KeyFunc {
+	return jwtClaim(claim, nil)
+}
+
+// VerifiedJWTClaim is like JWTClaim, but only uses tokens signed with key
+// that have not expired. key is a []byte secret for HS256, HS384 and HS512,
+// an *rsa.PublicKey for RS* and PS*, an *ecdsa.PublicKey for ES* or an
+// ed25519.PublicKey for EdDSA. Tokens signed with any other algorithm than
+// the key's are rejected.
+func VerifiedJWTClaim(claim string, key interface{}) KeyFunc {
+	switch key.(type) {
+	case []byte, *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+	default:
+		panic(fmt.Sprintf("unsupported JWT key type %T", key))
+	}
+	return jwtClaim(claim, key)
+}
+
+// jwtClaim reads claim from the request's token, checking it with key
+// unless key is nil.
+func jwtClaim(claim string, key interface{}) KeyFunc {
+	if claim == "" {
+		claim = "sub"
+	}
+	return func(r *http.Request) (string, error) {
+		auth := r.Header.Get("Authorization")
+		if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+			return "", fmt.Errorf("%w: no bearer token", ErrNoKey)
+		}
+		claims, err := parseJWT(strings.TrimSpace(auth[7:]), key, time.Now())
+		if err != nil {
+			return "", fmt.Errorf("%w: invalid token: %v", ErrNoKey, err)
+		}
+		switch v := claims[claim].(type) {
+		case string:
+			if v != "" {
+				return v, nil
+			}
+		case json.Number:
+			return v.String(), nil
+		}
+		return "", fmt.Errorf("%w: token has no %s claim", ErrNoKey, claim)
+	}
+}
+
+// parseJWT returns the claims of a compact JWS token. When key is not nil
+// the signature, exp and nbf are checked.
+func parseJWT(token string, key interface{}, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("want 3 parts, got %d", len(parts))
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("failed to decode header: %w", err)
+	}
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("failed to decode claims: %w", err)
+	}
+	if key == nil {
+		return claims, nil
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode signature: %w", err)
+	}
+	if err := verifyJWS(header.Alg, parts[0]+"."+parts[1], sig, key); err != nil {
+		return nil, err
+	}
+	if exp, ok := claims["exp"].(json.Number); ok {
+		if t, err := exp.Float64(); err != nil || float64(now.Unix()) >= t {
+			return nil, fmt.Errorf("token has expired")
+		}
+	}
+	if nbf, ok := claims["nbf"].(json.Number); ok {
+		if t, err := nbf.Float64(); err != nil || float64(now.Unix()) < t {
+			return nil, fmt.Errorf("token is not valid yet")
+		}
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// verifyJWS checks the signature sig of input, made with alg.
+func verifyJWS(alg, input string, sig []byte, key interface{}) error {
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, []byte(input), sig) {
+			return fmt.Errorf("invalid %s signature", alg)
+		}
+		return nil
+	}
+
+	var hash crypto.Hash
+	if len(alg) == 5 {
+		hash = map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[2:]]
+	}
+	if hash == 0 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(input))
+	digest := h.Sum(nil)
+
+	valid := false
+	switch pub := key.(type) {
+	case []byte:
+		if alg[:2] == "HS" {
+			mac := hmac.New(hash.New, pub)
+			mac.Write([]byte(input))
+			valid = hmac.Equal(sig, mac.Sum(nil))
+		}
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			valid = rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil
+		case "PS":
+			opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+			valid = rsa.VerifyPSS(pub, hash, digest, sig, opts) == nil
+		}
+	case *ecdsa.PublicKey:
+		// ES256 is on P-256, ES384 on P-384 and ES512 on P-521
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		curveHash := map[int]crypto.Hash{32: crypto.SHA256, 48: crypto.SHA384, 66: crypto.SHA512}[size]
+		if alg[:2] == "ES" && curveHash == hash && len(sig) == 2*size {
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			valid = ecdsa.Verify(pub, digest, r, s)
+		}
+	}
+	if !valid {
+		return fmt.Errorf("invalid %s signature", alg)
+	}
+	return nil
+}
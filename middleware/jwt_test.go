@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT builds a token with the given claims, signed by sign.
+func signJWT(alg, claims string, sign func(input []byte) []byte) string {
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString([]byte(`{"alg":"`+alg+`","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims))
+	return input + "." + enc.EncodeToString(sign([]byte(input)))
+}
+
+func bearer(key KeyFunc, token string) (string, error) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return key(r)
+}
+
+func TestJWTClaim(t *testing.T) {
+	token := signJWT("none", `{"sub":"alice","org":"acme","uid":42}`, func([]byte) []byte { return nil })
+	for claim, want := range map[string]string{"": "alice", "org": "acme", "uid": "42"} {
+		if got, err := bearer(JWTClaim(claim), token); err != nil || got != want {
+			t.Errorf("claim %q: got %q, %v, want %q", claim, got, err, want)
+		}
+	}
+	if _, err := bearer(JWTClaim("team"), token); !errors.Is(err, ErrNoKey) {
+		t.Errorf("got %v for a missing claim, want ErrNoKey", err)
+	}
+	if _, err := bearer(JWTClaim(""), "not-a-token"); !errors.Is(err, ErrNoKey) {
+		t.Errorf("got %v for a malformed token, want ErrNoKey", err)
+	}
+	if _, err := JWTClaim("")(httptest.NewRequest("GET", "/", nil)); !errors.Is(err, ErrNoKey) {
+		t.Errorf("got %v without a token, want ErrNoKey", err)
+	}
+}
+
+func TestVerifiedJWTClaim(t *testing.T) {
+	secret := []byte("secret")
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	digest := func(input []byte) []byte {
+		sum := sha256.Sum256(input)
+		return sum[:]
+	}
+
+	signers := map[string]struct {
+		key  interface{}
+		sign func(input []byte) []byte
+	}{
+		"HS256": {secret, func(input []byte) []byte {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(input)
+			return mac.Sum(nil)
+		}},
+		"RS256": {&rsaKey.PublicKey, func(input []byte) []byte {
+			sig, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest(input))
+			return sig
+		}},
+		"PS256": {&rsaKey.PublicKey, func(input []byte) []byte {
+			sig, _ := rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA256, digest(input), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+			return sig
+		}},
+		"ES256": {&ecKey.PublicKey, func(input []byte) []byte {
+			r, s, _ := ecdsa.Sign(rand.Reader, ecKey, digest(input))
+			sig := make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+			return sig
+		}},
+		"EdDSA": {edPub, func(input []byte) []byte {
+			return ed25519.Sign(edKey, input)
+		}},
+	}
+
+	exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	for alg, signer := range signers {
+		key := VerifiedJWTClaim("", signer.key)
+		token := signJWT(alg, `{"sub":"alice","exp":`+exp+`}`, signer.sign)
+		if got, err := bearer(key, token); err != nil || got != "alice" {
+			t.Errorf("%s: got %q, %v, want alice", alg, got, err)
+		}
+
+		// Another subject with alice's signature
+		parts := strings.Split(token, ".")
+		parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory","exp":` + exp + `}`))
+		if _, err := bearer(key, strings.Join(parts, ".")); !errors.Is(err, ErrNoKey) {
+			t.Errorf("%s: got %v for a bad signature, want ErrNoKey", alg, err)
+		}
+
+		expired := signJWT(alg, `{"sub":"alice","exp":1}`, signer.sign)
+		if _, err := bearer(key, expired); !errors.Is(err, ErrNoKey) {
+			t.Errorf("%s: got %v for an expired token, want ErrNoKey", alg, err)
+		}
+
+		unsigned := signJWT("none", `{"sub":"alice"}`, func([]byte) []byte { return nil })
+		if _, err := bearer(key, unsigned); !errors.Is(err, ErrNoKey) {
+			t.Errorf("%s: got %v for an unsigned token, want ErrNoKey", alg, err)
+		}
+	}
+
+	// An HMAC token signed with the RSA public key as its secret, which
+	// a verifier trusting the token's alg would accept
+	pub, _ := rsaKey.PublicKey.N.MarshalText()
+	confused := signJWT("HS256", `{"sub":"mallory"}`, func(input []byte) []byte {
+		mac := hmac.New(sha256.New, pub)
+		mac.Write(input)
+		return mac.Sum(nil)
+	})
+	if _, err := bearer(VerifiedJWTClaim("", &rsaKey.PublicKey), confused); !errors.Is(err, ErrNoKey) {
+		t.Errorf("got %v for a token with another key type's alg, want ErrNoKey", err)
+	}
+}
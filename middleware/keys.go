@@ -0,0 +1,206 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ErrNoKey is returned, possibly wrapped, by key functions for a request
+// that does not carry what they key by, such as a missing API key or an
+// invalid token. The default OnError answers it with 400 Bad Request.
+var ErrNoKey = errors.New("request has no rate limit key")
+
+// RemoteIP keys requests by the IP address of the connection they came on.
+// Behind a proxy or load balancer this is the proxy's address; use ClientIP
+// there instead.
+func RemoteIP(r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr, nil
+	}
+	return host, nil
+}
+
+// ProxyHeader names the header proxies record the client address in.
+type ProxyHeader int
+
+const (
+	// XForwardedFor reads X-Forwarded-For: client, proxy1, proxy2.
+	XForwardedFor ProxyHeader = iota
+	// Forwarded reads the for= parameters of the RFC 7239 Forwarded header.
+	Forwarded
+)
+
+type ClientIPOptions struct {
+	// TrustedProxies are the addresses or CIDR ranges of the proxies in
+	// front of the server, such as "10.0.0.0/8".
+	TrustedProxies []string
+	// Header is the header the trusted proxies append to. Only use the one
+	// they actually set, since a client can send the other one itself.
+	Header ProxyHeader
+}
+
+// ClientIP keys requests by the address of the client behind the trusted
+// proxies. The proxy header is only read when the connection comes from a
+// trusted proxy, and from the right, skipping trusted hops, so that the
+// addresses a client puts in the header itself are never used. When every
+// hop is trusted, the first one is the client.
+//
+// A Forwarded hop that is not an address, such as "unknown" or an
+// obfuscated identifier, is used as the key as it is.
+func ClientIP(opts ClientIPOptions) KeyFunc {
+	trusted := make([]netip.Prefix, 0, len(opts.TrustedProxies))
+	for _, p := range opts.TrustedProxies {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(p)
+			if addrErr != nil {
+				panic(fmt.Sprintf("invalid trusted proxy %q: %v", p, err))
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		trusted = append(trusted, prefix.Masked())
+	}
+	isTrusted := func(hop string) bool {
+		addr, err := parseHop(hop)
+		if err != nil {
+			return false
+		}
+		for _, p := range trusted {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(r *http.Request) (string, error) {
+		remote, _ := RemoteIP(r)
+		if !isTrusted(remote) {
+			return remote, nil
+		}
+		var hops []string
+		switch opts.Header {
+		case Forwarded:
+			hops = forwardedFor(r.Header.Values("Forwarded"))
+		default:
+			for _, v := range r.Header.Values("X-Forwarded-For") {
+				for _, hop := range strings.Split(v, ",") {
+					hops = append(hops, strings.TrimSpace(hop))
+				}
+			}
+		}
+
+		client := remote
+		for i := len(hops) - 1; i >= 0; i-- {
+			if hops[i] == "" {
+				continue
+			}
+			client = hops[i]
+			if !isTrusted(client) {
+				break
+			}
+		}
+		if addr, err := parseHop(client); err == nil {
+			return addr.String(), nil
+		}
+		return client, nil
+	}
+}
+
+// forwardedFor returns the for= parameters of Forwarded header values, in
+// the order of the hops.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					hops = append(hops, strings.Trim(value, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop parses an address as proxies write it, possibly with a port and
+// with IPv6 addresses in brackets.
+func parseHop(hop string) (netip.Addr, error) {
+	if addrPort, err := netip.ParseAddrPort(hop); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+// Header keys requests by the value of a request header, such as a tenant
+// ID set by a gateway.
+func Header(name string) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		if v := r.Header.Get(name); v != "" {
+			return v, nil
+		}
+		return "", fmt.Errorf("%w: no %s header", ErrNoKey, name)
+	}
+}
+
+// APIKey keys requests by an API key read from a header or, if the request
+// has none, from a query parameter. Either name may be empty to not look
+// there.
+func APIKey(header, param string) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		if header != "" {
+			if v := r.Header.Get(header); v != "" {
+				return v, nil
+			}
+		}
+		if param != "" {
+			if v := r.URL.Query().Get(param); v != "" {
+				return v, nil
+			}
+		}
+		return "", fmt.Errorf("%w: no API key", ErrNoKey)
+	}
+}
+
+// ClientCertSubject keys requests by the subject of their TLS client
+// certificate, such as "CN=billing,O=Acme". Only certificates the server
+// verified are used, so the server's tls.Config must verify client
+// certificates, for example with tls.RequireAndVerifyClientCert.
+func ClientCertSubject(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", fmt.Errorf("%w: no verified client certificate", ErrNoKey)
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.String(), nil
+}
+
+// Composite keys requests by all of keys, joined with colons, such as
+// "acme:192.0.2.1" for a tenant header and a client IP. Colons and percent
+// signs in each part are escaped, so that different parts never make the
+// same key. The request fails with the first error of any of keys.
+func Composite(keys ...KeyFunc) KeyFunc {
+	if len(keys) == 0 {
+		panic("composite key needs at least one key function")
+	}
+	escape := strings.NewReplacer("%", "%25", ":", "%3A")
+	return func(r *http.Request) (string, error) {
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			part, err := key(r)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = escape.Replace(part)
+		}
+		return strings.Join(parts, ":"), nil
+	}
+}
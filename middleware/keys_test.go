@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	xff := ClientIP(ClientIPOptions{TrustedProxies: []string{"10.0.0.0/8", "2001:db8::1"}})
+	forwarded := ClientIP(ClientIPOptions{TrustedProxies: []string{"10.0.0.0/8"}, Header: Forwarded})
+
+	tests := []struct {
+		name   string
+		key    KeyFunc
+		remote string
+		header string
+		value  string
+		want   string
+	}{
+		{"untrusted peer", xff, "192.0.2.1:1234", "X-Forwarded-For", "198.51.100.7", "192.0.2.1"},
+		{"one proxy", xff, "10.0.0.1:1234", "X-Forwarded-For", "198.51.100.7", "198.51.100.7"},
+		{"spoofed by client", xff, "10.0.0.1:1234", "X-Forwarded-For", "203.0.113.9, 198.51.100.7, 10.0.0.2", "198.51.100.7"},
+		{"all trusted", xff, "10.0.0.1:1234", "X-Forwarded-For", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"no header", xff, "10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"IPv6 proxy", xff, "[2001:db8::1]:443", "X-Forwarded-For", "198.51.100.7", "198.51.100.7"},
+		{"forwarded", forwarded, "10.0.0.1:1234", "Forwarded", `for=203.0.113.9, for="[2001:db8::7]:4711";proto=https, For=10.0.0.2`, "2001:db8::7"},
+		{"forwarded obfuscated", forwarded, "10.0.0.1:1234", "Forwarded", "for=_hidden;by=10.0.0.1", "_hidden"},
+		{"forwarded ignores XFF", forwarded, "10.0.0.1:1234", "X-Forwarded-For", "198.51.100.7", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		if got, err := tt.key(r); err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestClientIPInvalidProxy(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("want a panic for an invalid trusted proxy")
+		}
+	}()
+	ClientIP(ClientIPOptions{TrustedProxies: []string{"10.0.0.0/33"}})
+}
+
+func TestAPIKeyAndHeader(t *testing.T) {
+	key := APIKey("X-API-Key", "api_key")
+
+	r := httptest.NewRequest("GET", "/?api_key=from-query", nil)
+	if got, _ := key(r); got != "from-query" {
+		t.Errorf("got %q, want the query parameter", got)
+	}
+	r.Header.Set("X-API-Key", "from-header")
+	if got, _ := key(r); got != "from-header" {
+		t.Errorf("got %q, want the header before the query parameter", got)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	if _, err := key(r); !errors.Is(err, ErrNoKey) {
+		t.Errorf("got %v, want ErrNoKey", err)
+	}
+	if _, err := Header("X-Tenant")(r); !errors.Is(err, ErrNoKey) {
+		t.Errorf("got %v, want ErrNoKey", err)
+	}
+}
+
+func TestClientCertSubject(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	if _, err := ClientCertSubject(r); !errors.Is(err, ErrNoKey) {
+		t.Errorf("got %v without TLS, want ErrNoKey", err)
+	}
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "billing", Organization: []string{"Acme"}}}
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if _, err := ClientCertSubject(r); !errors.Is(err, ErrNoKey) {
+		t.Errorf("got %v for an unverified certificate, want ErrNoKey", err)
+	}
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	if got, err := ClientCertSubject(r); err != nil || got != "CN=billing,O=Acme" {
+		t.Errorf("got %q, %v, want the certificate's subject", got, err)
+	}
+}
+
+func TestComposite(t *testing.T) {
+	key := Composite(Header("X-Tenant"), RemoteIP)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "[2001:db8::7]:443"
+	r.Header.Set("X-Tenant", "acme")
+	if got, _ := key(r); got != "acme:2001%3Adb8%3A%3A7" {
+		t.Errorf("got %q, want the escaped parts joined", got)
+	}
+
+	// Parts that differ must never make the same key
+	other := httptest.NewRequest("GET", "/", nil)
+	other.RemoteAddr = "db8::7"
+	other.Header.Set("X-Tenant", "acme:2001:")
+	a, _ := key(r)
+	b, _ := key(other)
+	if a == b {
+		t.Errorf("got %q for both requests", a)
+	}
+
+	r.Header.Del("X-Tenant")
+	if _, err := key(r); !errors.Is(err, ErrNoKey) {
+		t.Errorf("got %v, want ErrNoKey from the missing part", err)
+	}
+}
+
+func TestNoKeyIsBadRequest(t *testing.T) {
+	h := New(newLimiter(t, 1), Options{KeyFunc: APIKey("X-API-Key", "")}).Handler(ok)
+	if w := serve(h, "GET", "/"); w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want 400", w.Code)
+	}
+}
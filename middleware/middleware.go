@@ -0,0 +1,152 @@
+// Package middleware limits net/http handlers with any limiter from the
+// algorithms package.
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/codetesla51/limitz/algorithms"
+)
+
+// KeyFunc returns the key a request is limited by. An error is passed to
+// the middleware's OnError handler and the request is not served.
+type KeyFunc func(r *http.Request) (string, error)
+
+// DeniedHandler writes the response for a request the limiter denied. The
+// rate limit headers are already set when it is called.
+type DeniedHandler func(w http.ResponseWriter, r *http.Request, result algorithms.Result)
+
+// ErrorHandler writes the response for a request that could not be checked,
+// because its key could not be found or the limiter returned an error.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+type Options struct {
+	KeyFunc  KeyFunc       // Defaults to RemoteIP
+	OnDenied DeniedHandler // Defaults to a plain 429 Too Many Requests
+	OnError  ErrorHandler  // Defaults to a plain 400 for ErrNoKey and 500 otherwise
+
+	// ExemptPaths are never limited. A path ending in a slash exempts every
+	// path below it, as with http.ServeMux.
+	ExemptPaths []string
+	// ExemptMethods are never limited, such as OPTIONS for CORS preflights.
+	ExemptMethods []string
+
+	Headers Headers       // Which rate limit headers to send
+	Policy  string        // Name of the policy in the IETF headers, "default" if empty
+	Window  time.Duration // The limiter's window, sent as w in RateLimit-Policy when set
+}
+
+// Middleware checks every request against a limiter before passing it on.
+type Middleware struct {
+	limiter  algorithms.RateLimiter
+	keyFunc  KeyFunc
+	onDenied DeniedHandler
+	onError  ErrorHandler
+	paths    map[string]bool
+	subtrees []string
+	methods  map[string]bool
+	headers  Headers
+	policy   string // Quoted for the IETF headers
+	window   int    // Seconds, 0 when unknown
+}
+
+func New(limiter algorithms.RateLimiter, opts Options) *Middleware {
+	if limiter == nil {
+		panic("limiter cannot be nil")
+	}
+	if opts.Window < 0 {
+		panic("window cannot be negative")
+	}
+	if opts.Policy == "" {
+		opts.Policy = "default"
+	}
+	policy, ok := quote(opts.Policy)
+	if !ok {
+		panic(fmt.Sprintf("policy name %q must be printable ASCII", opts.Policy))
+	}
+	m := &Middleware{
+		limiter:  limiter,
+		keyFunc:  opts.KeyFunc,
+		onDenied: opts.OnDenied,
+		onError:  opts.OnError,
+		paths:    make(map[string]bool),
+		methods:  make(map[string]bool),
+		headers:  opts.Headers,
+		policy:   policy,
+		window:   seconds(opts.Window),
+	}
+	if m.keyFunc == nil {
+		m.keyFunc = RemoteIP
+	}
+	if m.onDenied == nil {
+		m.onDenied = tooManyRequests
+	}
+	if m.onError == nil {
+		m.onError = internalError
+	}
+	for _, p := range opts.ExemptPaths {
+		if strings.HasSuffix(p, "/") {
+			m.subtrees = append(m.subtrees, p)
+		} else {
+			m.paths[p] = true
+		}
+	}
+	for _, method := range opts.ExemptMethods {
+		m.methods[strings.ToUpper(method)] = true
+	}
+	return m
+}
+
+// Handler wraps next so that it only serves requests the limiter allows.
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.exempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, err := m.keyFunc(r)
+		if err != nil {
+			m.onError(w, r, fmt.Errorf("failed to get rate limit key: %w", err))
+			return
+		}
+		result, err := m.limiter.Allow(r.Context(), key)
+		if err != nil {
+			m.onError(w, r, err)
+			return
+		}
+		m.setHeaders(w.Header(), result, time.Now())
+		if !result.Allowed {
+			m.onDenied(w, r, result)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m *Middleware) exempt(r *http.Request) bool {
+	if m.methods[r.Method] || m.paths[r.URL.Path] {
+		return true
+	}
+	for _, p := range m.subtrees {
+		if strings.HasPrefix(r.URL.Path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, result algorithms.Result) {
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
+
+func internalError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrNoKey) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/codetesla51/limitz/algorithms"
+	"github.com/codetesla51/limitz/store"
+)
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+func newLimiter(t *testing.T, limit int) algorithms.RateLimiter {
+	t.Helper()
+	s := store.NewMemoryStore()
+	t.Cleanup(s.Close)
+	return algorithms.NewFixedWindow(limit, time.Minute, s)
+}
+
+func serve(h http.Handler, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestHeaders(t *testing.T) {
+	h := New(newLimiter(t, 2), Options{Policy: "api", Window: time.Minute}).Handler(ok)
+
+	w := serve(h, "GET", "/")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", w.Code)
+	}
+	want := map[string]string{
+		"RateLimit-Policy":      `"api";q=2;w=60`,
+		"RateLimit":             `"api";r=1`,
+		"X-RateLimit-Limit":     "2",
+		"X-RateLimit-Remaining": "1",
+		"X-RateLimit-Reset":     "",
+		"Retry-After":           "",
+	}
+	for name, value := range want {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("allowed %s: got %q, want %q", name, got, value)
+		}
+	}
+
+	serve(h, "GET", "/")
+	w = serve(h, "GET", "/")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want 429", w.Code)
+	}
+	retry, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || retry < 1 || retry > 60 {
+		t.Fatalf("got Retry-After %q, want 1 to 60 seconds", w.Header().Get("Retry-After"))
+	}
+	want = map[string]string{
+		"RateLimit":             `"api";r=0;t=` + strconv.Itoa(retry),
+		"X-RateLimit-Remaining": "0",
+	}
+	for name, value := range want {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("denied %s: got %q, want %q", name, got, value)
+		}
+	}
+	// The clock may tick over a second between the request and here
+	reset, _ := strconv.ParseInt(w.Header().Get("X-RateLimit-Reset"), 10, 64)
+	if at := time.Now().Unix() + int64(retry); reset < at-1 || reset > at {
+		t.Errorf("got X-RateLimit-Reset %d, want about %d", reset, at)
+	}
+}
+
+func TestHeadersSelection(t *testing.T) {
+	for headers, want := range map[Headers][]string{
+		DraftHeaders:  {"RateLimit-Policy", "RateLimit"},
+		LegacyHeaders: {"X-RateLimit-Limit", "X-RateLimit-Remaining"},
+		NoHeaders:     nil,
+	} {
+		w := serve(New(newLimiter(t, 2), Options{Headers: headers}).Handler(ok), "GET", "/")
+		var got []string
+		for _, name := range []string{"RateLimit-Policy", "RateLimit", "X-RateLimit-Limit", "X-RateLimit-Remaining"} {
+			if w.Header().Get(name) != "" {
+				got = append(got, name)
+			}
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("Headers %d: got %v, want %v", headers, got, want)
+		}
+	}
+}
+
+func TestExempt(t *testing.T) {
+	h := New(newLimiter(t, 1), Options{
+		ExemptPaths:   []string{"/healthz", "/static/"},
+		ExemptMethods: []string{"options"},
+	}).Handler(ok)
+
+	serve(h, "GET", "/")
+	for _, req := range [][2]string{{"GET", "/healthz"}, {"GET", "/static/app.js"}, {"OPTIONS", "/"}} {
+		if w := serve(h, req[0], req[1]); w.Code != http.StatusOK {
+			t.Errorf("%s %s: got status %d, want it exempt", req[0], req[1], w.Code)
+		}
+	}
+	for _, path := range []string{"/", "/healthz/x", "/static"} {
+		if w := serve(h, "GET", path); w.Code != http.StatusTooManyRequests {
+			t.Errorf("GET %s: got status %d, want 429", path, w.Code)
+		}
+	}
+}
+
+func TestKeyFuncAndDeniedHandler(t *testing.T) {
+	h := New(newLimiter(t, 1), Options{
+		KeyFunc: func(r *http.Request) (string, error) {
+			return r.Header.Get("X-User"), nil
+		},
+		OnDenied: func(w http.ResponseWriter, r *http.Request, result algorithms.Result) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+	}).Handler(ok)
+
+	for user, want := range map[string]int{"alice": http.StatusOK, "bob": http.StatusOK} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%s: got status %d, want %d", user, w.Code, want)
+		}
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-User", "alice")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d from the deny handler, want 503", w.Code)
+	}
+}
+
+// failingLimiter fails every request, as a limiter whose store is down does.
+type failingLimiter struct {
+	algorithms.RateLimiter
+}
+
+var errDown = errors.New("store is down")
+
+func (failingLimiter) Allow(ctx context.Context, key string) (algorithms.Result, error) {
+	return algorithms.Result{}, errDown
+}
+
+func TestErrorHandler(t *testing.T) {
+	w := serve(New(failingLimiter{}, Options{}).Handler(ok), "GET", "/")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want 500 by default", w.Code)
+	}
+
+	var got error
+	h := New(failingLimiter{}, Options{
+		OnError: func(w http.ResponseWriter, r *http.Request, err error) {
+			got = err
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+	}).Handler(ok)
+	if w := serve(h, "GET", "/"); w.Code != http.StatusServiceUnavailable || !errors.Is(got, errDown) {
+		t.Errorf("got status %d and error %v, want the store's error passed to OnError", w.Code, got)
+	}
+}
+
+func TestFailOpenSendsNoQuota(t *testing.T) {
+	result := algorithms.Result{Allowed: true, Degraded: true}
+	h := http.Header{}
+	New(newLimiter(t, 1), Options{}).setHeaders(h, result, time.Now())
+	if len(h) != 0 {
+		t.Errorf("got headers %v for a result without a limit, want none", h)
+	}
+}
+
+func TestPolicyName(t *testing.T) {
+	if got, _ := quote(`a"b\c`); got != `"a\"b\\c"` {
+		t.Errorf("got %s, want the quote and backslash escaped", got)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("want a panic for a policy name outside printable ASCII")
+		}
+	}()
+	New(newLimiter(t, 1), Options{Policy: "naïve"})
+}
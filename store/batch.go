@@ -0,0 +1,108 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Entry is one value for SetMany to store.
+type Entry struct {
+	Key   string
+	Value interface{}
+	TTL   time.Duration
+}
+
+// Batcher is implemented by stores that can read or write many keys in one
+// round trip, which limiters use to decide a batch of requests at once.
+type Batcher interface {
+	// GetMany returns the values of keys, in the same order, with nil for
+	// keys that have no value or have expired.
+	GetMany(ctx context.Context, keys []string) ([]interface{}, error)
+
+	// SetMany stores every entry. When a key appears more than once, the
+	// last entry for it wins.
+	SetMany(ctx context.Context, entries []Entry) error
+}
+
+// UpdateManyFunc decides a batch: it gets the positions in the batch's keys
+// of the keys it decides and, in the same order, their values, nil for keys
+// that have none, and returns the entries to write for those keys.
+type UpdateManyFunc func(indexes []int, values []interface{}) ([]Entry, error)
+
+// BatchUpdater is implemented by stores that can update many keys at once
+// as safely as Updater updates one: no other writer, in this process or
+// another, gets between the read of a key and its write.
+type BatchUpdater interface {
+	// UpdateMany runs fn on copies of the values of keys and writes the
+	// entries it returns. Nothing is written if fn fails.
+	//
+	// A store that cannot update every key in one step, such as Redis
+	// Cluster for keys in different slots, calls fn once for each group of
+	// keys it can, with every repeat of a key in the same group. Groups
+	// written before one that fails stay written. fn may also be called
+	// again for a group whose keys another client changed in between.
+	UpdateMany(ctx context.Context, keys []string, fn UpdateManyFunc) error
+}
+
+// checkBatch validates the entries fn returned for the keys at indexes, as
+// Update validates a single value, and drops every entry a later one for
+// the same key replaces.
+func checkBatch(keys []string, indexes []int, entries []Entry) ([]Entry, error) {
+	if err := checkEntries(entries); err != nil {
+		return nil, err
+	}
+	decided := make(map[string]bool, len(indexes))
+	for _, i := range indexes {
+		decided[keys[i]] = true
+	}
+	for _, e := range entries {
+		if !decided[e.Key] {
+			return nil, fmt.Errorf("key %s is not in the batch", e.Key)
+		}
+	}
+	return lastEntries(entries), nil
+}
+
+// allIndexes returns the positions of every key in a batch of n.
+func allIndexes(n int) []int {
+	indexes := make([]int, n)
+	for i := range indexes {
+		indexes[i] = i
+	}
+	return indexes
+}
+
+// checkEntries validates entries as Set validates a single value.
+func checkEntries(entries []Entry) error {
+	for _, e := range entries {
+		if e.Key == "" {
+			return fmt.Errorf("key cannot be empty")
+		}
+		if e.Value == nil {
+			return fmt.Errorf("value for key %s cannot be nil", e.Key)
+		}
+		if e.TTL <= 0 {
+			return fmt.Errorf("TTL for key %s must be greater than 0", e.Key)
+		}
+	}
+	return nil
+}
+
+// lastEntries drops every entry that a later one for the same key replaces.
+func lastEntries(entries []Entry) []Entry {
+	last := make(map[string]int, len(entries))
+	for i, e := range entries {
+		last[e.Key] = i
+	}
+	if len(last) == len(entries) {
+		return entries
+	}
+	out := make([]Entry, 0, len(last))
+	for i, e := range entries {
+		if last[e.Key] == i {
+			out = append(out, e)
+		}
+	}
+	return out
+}
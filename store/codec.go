@@ -0,0 +1,124 @@
+package store
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Codec turns limiter state into the value handed to a store, and a value
+// read back from the store into state again. v is always a pointer to the
+// state, such as *algorithms.Buckets.
+type Codec interface {
+	Encode(v interface{}) (interface{}, error)
+	Decode(data interface{}, v interface{}) error
+}
+
+// CodecStore is implemented by stores that choose how limiter state is
+// encoded for them. Stores that do not implement it get JSONCodec.
+type CodecStore interface {
+	Codec() Codec
+}
+
+// CodecOf returns the codec used for state kept in s.
+func CodecOf(s Store) Codec {
+	if cs, ok := s.(CodecStore); ok {
+		return cs.Codec()
+	}
+	return JSONCodec{}
+}
+
+// JSONCodec encodes state as JSON. It is the default for RedisStore and
+// DatabaseStore, and reads state written by earlier versions of limitz.
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(v interface{}) (interface{}, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Decode(data interface{}, v interface{}) error {
+	b, err := bytesOf(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// BinaryCodec encodes state with its own compact binary format. The state
+// must implement encoding.BinaryMarshaler and encoding.BinaryUnmarshaler,
+// as every algorithm's state does. The result is not valid text, so it
+// suits RedisStore but not the text Value column of DatabaseStore.
+type BinaryCodec struct{}
+
+func (BinaryCodec) Encode(v interface{}) (interface{}, error) {
+	m, ok := v.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("%T does not implement encoding.BinaryMarshaler", v)
+	}
+	return m.MarshalBinary()
+}
+
+func (BinaryCodec) Decode(data interface{}, v interface{}) error {
+	u, ok := v.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return fmt.Errorf("%T does not implement encoding.BinaryUnmarshaler", v)
+	}
+	b, err := bytesOf(data)
+	if err != nil {
+		return err
+	}
+	return u.UnmarshalBinary(b)
+}
+
+// IdentityCodec hands state to the store as it is, for stores such as
+// MemoryStore that keep Go values rather than bytes. It also decodes state
+// held as bytes in its binary format, as MemoryStore.Restore leaves it.
+type IdentityCodec struct{}
+
+func (IdentityCodec) Encode(v interface{}) (interface{}, error) {
+	return v, nil
+}
+
+func (IdentityCodec) Decode(data interface{}, v interface{}) error {
+	if b, ok := data.([]byte); ok {
+		if u, ok := v.(encoding.BinaryUnmarshaler); ok {
+			return u.UnmarshalBinary(b)
+		}
+	}
+	dst := reflect.ValueOf(v)
+	src := reflect.ValueOf(data)
+	if dst.Kind() != reflect.Pointer || src.Type() != dst.Type() {
+		return fmt.Errorf("cannot decode %T into %T", data, v)
+	}
+	dst.Elem().Set(src.Elem())
+	return nil
+}
+
+// bytesOf returns the encoded bytes in a value read from a store. Redis and
+// the database hand back strings, while MemoryStore keeps the []byte it was
+// given.
+func bytesOf(data interface{}) ([]byte, error) {
+	switch v := data.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return nil, fmt.Errorf("cannot decode %T, want encoded bytes", data)
+	}
+}
+
+// marshal turns a value passed to Set into the string kept by Redis or the
+// database. Values already encoded by a Codec are stored as they are, and
+// anything else is encoded as JSON.
+func marshal(value interface{}) (string, error) {
+	if b, ok := value.([]byte); ok {
+		return string(b), nil
+	}
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal value: %w", err)
+	}
+	return string(jsonData), nil
+}
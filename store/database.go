@@ -2,12 +2,14 @@ package store
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"iter"
+	"slices"
+	"strings"
 	"time"
 
-	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // RateLimitEntry represents a row in the database
@@ -18,30 +20,95 @@ type RateLimitEntry struct {
 }
 
 type DatabaseStore struct {
-	db *gorm.DB
+	db      *gorm.DB
+	table   string
+	dialect sqlDialect
+	ownsDB  bool
+	codec   Codec
 }
 
-func NewDatabaseStore(dsn string) (*DatabaseStore, error) {
-	if dsn == "" {
-		return nil, fmt.Errorf("database DSN cannot be empty")
+// DatabaseOptions configures a store built from an existing connection.
+type DatabaseOptions struct {
+	Table  string // Defaults to rate_limit_entries
+	Schema string // Schema the table is in; empty uses the connection's default
+	// SkipMigration leaves creating the table to the application. The
+	// statements it needs are returned by DatabaseMigrations.
+	SkipMigration bool
+}
+
+// NewDatabaseStore opens a connection pool with dialector, such as
+// postgres.Open(dsn) from gorm.io/driver/postgres, and creates the table
+// unless opts say otherwise. The dialect must be postgres, mysql or sqlite.
+// The store owns the pool and closes it when it is closed.
+func NewDatabaseStore(dialector gorm.Dialector, opts DatabaseOptions) (*DatabaseStore, error) {
+	if dialector == nil {
+		return nil, fmt.Errorf("database dialector cannot be nil")
 	}
 
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err := gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
 
-	// Auto-create table if needed
-	if err := db.AutoMigrate(&RateLimitEntry{}); err != nil {
-		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	ds, err := NewDatabaseStoreFromDB(db, opts)
+	if err != nil {
+		if sqlDB, dbErr := db.DB(); dbErr == nil {
+			sqlDB.Close()
+		}
+		return nil, err
+	}
+	ds.ownsDB = true
+	return ds, nil
+}
+
+// NewDatabaseStoreFromDB uses an application's existing GORM connection,
+// which may wrap a *sql.DB it already has. Its dialect must be postgres,
+// mysql or sqlite. The connection stays the caller's: closing the store does
+// not close it.
+func NewDatabaseStoreFromDB(db *gorm.DB, opts DatabaseOptions) (*DatabaseStore, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database cannot be nil")
+	}
+	name := db.Dialector.Name()
+	dialect, err := lookupDialect(name)
+	if err != nil {
+		return nil, err
+	}
+
+	table := opts.Table
+	if table == "" {
+		table = "rate_limit_entries"
+	}
+	if opts.Schema != "" {
+		table = opts.Schema + "." + table
 	}
 
-	// Create index on ExpiresAt for cleanup queries
-	if !db.Migrator().HasIndex(&RateLimitEntry{}, "expires_at") {
-		db.Migrator().CreateIndex(&RateLimitEntry{}, "expires_at")
+	ds := &DatabaseStore{
+		db:      db,
+		table:   table,
+		dialect: dialect,
+		codec:   JSONCodec{},
 	}
+	if !opts.SkipMigration {
+		migrations, _ := DatabaseMigrations(name, table)
+		for _, stmt := range migrations {
+			if err := db.Exec(stmt).Error; err != nil {
+				return nil, fmt.Errorf("failed to migrate database: %w", err)
+			}
+		}
+	}
+	return ds, nil
+}
+
+// Codec returns the codec limiters use for state kept in this store.
+func (ds *DatabaseStore) Codec() Codec {
+	return ds.codec
+}
 
-	return &DatabaseStore{db: db}, nil
+// SetCodec changes how limiters encode their state in this store. The Value
+// column is text, so the codec must produce valid UTF-8.
+func (ds *DatabaseStore) SetCodec(codec Codec) {
+	ds.codec = codec
 }
 
 // Get retrieves a value from database
@@ -53,16 +120,16 @@ func (ds *DatabaseStore) Get(ctx context.Context, key string) (interface{}, erro
 	var entry RateLimitEntry
 
 	// Query and check if expired
-	result := ds.db.WithContext(ctx).Where("key = ? AND expires_at > ?", key, time.Now()).First(&entry)
+	result := ds.query(ctx).Where(keyIs(key)).Where(liveAt(utcNow())).First(&entry)
 
 	if result.Error == gorm.ErrRecordNotFound {
-		return nil, fmt.Errorf("key not found")
+		return nil, ErrNotFound
 	}
 	if result.Error != nil {
-		return nil, fmt.Errorf("database Get error: %w", result.Error)
+		return nil, &BackendError{Backend: "database", Op: "Get", Err: result.Error}
 	}
 
-	// Return the JSON string (caller will unmarshal)
+	// Return the encoded string (caller will decode)
 	return entry.Value, nil
 }
 
@@ -78,21 +145,237 @@ func (ds *DatabaseStore) Set(ctx context.Context, key string, value interface{},
 		return fmt.Errorf("TTL must be greater than 0")
 	}
 
-	// Convert value to JSON string
-	jsonData, err := json.Marshal(value)
+	data, err := marshal(value)
 	if err != nil {
-		return fmt.Errorf("failed to marshal value: %w", err)
+		return err
 	}
 
 	entry := RateLimitEntry{
 		Key:       key,
-		Value:     string(jsonData),
-		ExpiresAt: time.Now().Add(ttl),
+		Value:     data,
+		ExpiresAt: utcNow().Add(ttl),
+	}
+
+	if err := ds.query(ctx).Clauses(upsert).Create(&entry).Error; err != nil {
+		return &BackendError{Backend: "database", Op: "Set", Err: err}
+	}
+	return nil
+}
+
+// upsert makes an insert replace the value and expiry of an existing key. GORM
+// renders it in the dialect's own syntax.
+var upsert = clause.OnConflict{
+	Columns:   []clause.Column{{Name: "key"}},
+	DoUpdates: clause.AssignmentColumns([]string{"value", "expires_at"}),
+}
+
+// GetMany reads the live rows of keys with one SELECT ... WHERE key IN
+// query for every manyBatch keys.
+func (ds *DatabaseStore) GetMany(ctx context.Context, keys []string) ([]interface{}, error) {
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("key cannot be empty")
+		}
+	}
+
+	found := make(map[string]string, len(keys))
+	now := utcNow()
+	for batch := range slices.Chunk(keys, manyBatch) {
+		values := make([]interface{}, len(batch))
+		for i, key := range batch {
+			values[i] = key
+		}
+		var entries []RateLimitEntry
+		if err := ds.query(ctx).Where(clause.IN{Column: clause.Column{Name: "key"}, Values: values}).
+			Where(liveAt(now)).Find(&entries).Error; err != nil {
+			return nil, &BackendError{Backend: "database", Op: "GetMany", Err: err}
+		}
+		for _, e := range entries {
+			found[e.Key] = e.Value
+		}
+	}
+
+	out := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if value, ok := found[key]; ok {
+			out[i] = value
+		}
+	}
+	return out, nil
+}
+
+// SetMany upserts entries with one multi-row INSERT for every manyBatch
+// entries.
+func (ds *DatabaseStore) SetMany(ctx context.Context, entries []Entry) error {
+	if err := checkEntries(entries); err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// An upsert may not touch the same row twice
+	entries = lastEntries(entries)
+	now := utcNow()
+	rows := make([]RateLimitEntry, len(entries))
+	for i, e := range entries {
+		data, err := marshal(e.Value)
+		if err != nil {
+			return err
+		}
+		rows[i] = RateLimitEntry{Key: e.Key, Value: data, ExpiresAt: now.Add(e.TTL)}
+	}
+
+	if err := ds.query(ctx).Clauses(upsert).CreateInBatches(&rows, manyBatch).Error; err != nil {
+		return &BackendError{Backend: "database", Op: "SetMany", Err: err}
+	}
+	return nil
+}
+
+// UpdateMany runs fn on the values of keys inside one transaction that
+// holds the row locks of every key, as Update does for one key. Rows are
+// locked with SELECT ... ORDER BY key FOR UPDATE, so batches sharing keys
+// wait for each other rather than deadlock, and written with one multi-row
+// upsert for every manyBatch keys.
+func (ds *DatabaseStore) UpdateMany(ctx context.Context, keys []string, fn UpdateManyFunc) error {
+	for _, key := range keys {
+		if key == "" {
+			return fmt.Errorf("key cannot be empty")
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	distinct := slices.Compact(slices.Sorted(slices.Values(keys)))
+
+	// As in Update, errors from fn and from encoding are returned as they
+	// are rather than as backend errors
+	var callerErr error
+	err := ds.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		placeholders := make([]RateLimitEntry, len(distinct))
+		for i, key := range distinct {
+			placeholders[i] = RateLimitEntry{Key: key, ExpiresAt: time.Unix(0, 0).UTC()}
+		}
+		if err := tx.Table(ds.table).Clauses(clause.OnConflict{DoNothing: true}).
+			CreateInBatches(&placeholders, manyBatch).Error; err != nil {
+			return err
+		}
+
+		locked := make(map[string]RateLimitEntry, len(distinct))
+		for batch := range slices.Chunk(distinct, manyBatch) {
+			values := make([]interface{}, len(batch))
+			for i, key := range batch {
+				values[i] = key
+			}
+			var rows []RateLimitEntry
+			if err := tx.Table(ds.table).Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where(clause.IN{Column: clause.Column{Name: "key"}, Values: values}).
+				Order(clause.OrderByColumn{Column: clause.Column{Name: "key"}}).
+				Find(&rows).Error; err != nil {
+				return err
+			}
+			for _, row := range rows {
+				locked[row.Key] = row
+			}
+		}
+
+		now := utcNow()
+		values := make([]interface{}, len(keys))
+		for i, key := range keys {
+			if row, ok := locked[key]; ok && row.ExpiresAt.After(now) {
+				values[i] = row.Value
+			}
+		}
+		indexes := allIndexes(len(keys))
+		entries, err := fn(indexes, values)
+		if err == nil {
+			entries, err = checkBatch(keys, indexes, entries)
+		}
+		if err != nil || len(entries) == 0 {
+			callerErr = err
+			return err
+		}
+		rows := make([]RateLimitEntry, len(entries))
+		for i, e := range entries {
+			data, err := marshal(e.Value)
+			if err != nil {
+				callerErr = err
+				return err
+			}
+			rows[i] = RateLimitEntry{Key: e.Key, Value: data, ExpiresAt: now.Add(e.TTL)}
+		}
+		return tx.Table(ds.table).Clauses(upsert).CreateInBatches(&rows, manyBatch).Error
+	})
+	if callerErr != nil {
+		return callerErr
+	}
+	if err != nil {
+		return &BackendError{Backend: "database", Op: "UpdateMany", Err: err}
+	}
+	return nil
+}
+
+// manyBatch is the most keys GetMany, SetMany and UpdateMany send in one
+// statement, well below every database's limit on bound parameters.
+const manyBatch = 1000
+
+// Update runs fn on key's value inside a transaction that holds a row lock
+// on key, so concurrent updates of the same key from any number of app
+// servers run one after another while other keys are unaffected.
+//
+// A placeholder row, already expired, is inserted first when key has none,
+// because SELECT ... FOR UPDATE cannot lock a row that does not exist yet.
+// SQLite has no row locks and serializes write transactions instead.
+func (ds *DatabaseStore) Update(ctx context.Context, key string, fn UpdateFunc) error {
+	if key == "" {
+		return fmt.Errorf("key cannot be empty")
 	}
 
-	// Upsert (insert or update)
-	if err := ds.db.WithContext(ctx).Save(&entry).Error; err != nil {
-		return fmt.Errorf("database Set error: %w", err)
+	// Errors from fn and from encoding roll the transaction back like any
+	// other, but are returned as they are rather than as backend errors
+	var callerErr error
+	err := ds.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		placeholder := RateLimitEntry{Key: key, ExpiresAt: time.Unix(0, 0).UTC()}
+		if err := tx.Table(ds.table).Clauses(clause.OnConflict{DoNothing: true}).Create(&placeholder).Error; err != nil {
+			return err
+		}
+
+		var entry RateLimitEntry
+		if err := tx.Table(ds.table).Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where(keyIs(key)).First(&entry).Error; err != nil {
+			return err
+		}
+
+		var current interface{}
+		now := utcNow()
+		if entry.ExpiresAt.After(now) {
+			current = entry.Value
+		}
+
+		next, ttl, err := fn(current)
+		if err == nil && next != nil && ttl <= 0 {
+			err = fmt.Errorf("TTL must be greater than 0")
+		}
+		if err != nil || next == nil {
+			callerErr = err
+			return err
+		}
+		data, err := marshal(next)
+		if err != nil {
+			callerErr = err
+			return err
+		}
+
+		return tx.Table(ds.table).Where(keyIs(key)).Updates(map[string]interface{}{
+			"value":      data,
+			"expires_at": now.Add(ttl),
+		}).Error
+	})
+	if callerErr != nil {
+		return callerErr
+	}
+	if err != nil {
+		return &BackendError{Backend: "database", Op: "Update", Err: err}
 	}
 	return nil
 }
@@ -103,12 +386,12 @@ func (ds *DatabaseStore) Delete(ctx context.Context, key string) error {
 		return fmt.Errorf("key cannot be empty")
 	}
 
-	result := ds.db.WithContext(ctx).Delete(&RateLimitEntry{}, "key = ?", key)
+	result := ds.query(ctx).Where(keyIs(key)).Delete(&RateLimitEntry{})
 	if result.Error != nil {
-		return fmt.Errorf("database Delete error: %w", result.Error)
+		return &BackendError{Backend: "database", Op: "Delete", Err: result.Error}
 	}
 	if result.RowsAffected == 0 {
-		return fmt.Errorf("key not found")
+		return ErrNotFound
 	}
 	return nil
 }
@@ -120,21 +403,118 @@ func (ds *DatabaseStore) Exists(ctx context.Context, key string) (bool, error) {
 	}
 
 	var count int64
-	if err := ds.db.WithContext(ctx).Model(&RateLimitEntry{}).
-		Where("key = ? AND expires_at > ?", key, time.Now()).
+	if err := ds.query(ctx).Where(keyIs(key)).Where(liveAt(utcNow())).
 		Count(&count).Error; err != nil {
-		return false, fmt.Errorf("database Exists error: %w", err)
+		return false, &BackendError{Backend: "database", Op: "Exists", Err: err}
 	}
 
 	return count > 0, nil
 }
 
+// Scan yields the live keys matching pattern, in key order. Rows are read
+// scanBatch at a time, each page starting after the last key of the one
+// before, and narrowed with LIKE on the literal start of pattern before the
+// rest of it is matched.
+func (ds *DatabaseStore) Scan(ctx context.Context, pattern string) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		prefix := globPrefix(pattern)
+		last := ""
+		for {
+			q := ds.query(ctx).Where(liveAt(utcNow()))
+			if prefix != "" {
+				q = q.Where(clause.Expr{
+					SQL:  "? LIKE ?" + ds.dialect.likeEscape,
+					Vars: []interface{}{clause.Column{Name: "key"}, escapeLike(prefix) + "%"},
+				})
+			}
+			if last != "" {
+				q = q.Where(clause.Gt{Column: clause.Column{Name: "key"}, Value: last})
+			}
+
+			var keys []string
+			if err := q.Order(clause.OrderByColumn{Column: clause.Column{Name: "key"}}).
+				Limit(scanBatch).Pluck("key", &keys).Error; err != nil {
+				yield("", &BackendError{Backend: "database", Op: "Scan", Err: err})
+				return
+			}
+			for _, key := range keys {
+				if matchGlob(pattern, key) && !yield(key, nil) {
+					return
+				}
+			}
+			if len(keys) < scanBatch {
+				return
+			}
+			last = keys[len(keys)-1]
+		}
+	}
+}
+
+const scanBatch = 1000
+
+// escapeLike escapes the characters with a meaning in a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// CleanupExpired deletes expired rows, 1000 at a time so that no single
+// statement holds locks on a large part of the table.
 func (ds *DatabaseStore) CleanupExpired() error {
-	return ds.db.Delete(&RateLimitEntry{}, "expires_at <= ?", time.Now()).Error
+	stmt := fmt.Sprintf(ds.dialect.deleteExpired, ds.dialect.quoteIdent(ds.table))
+	cutoff := utcNow()
+	for {
+		result := ds.db.Exec(stmt, cutoff, cleanupBatch)
+		if result.Error != nil {
+			return &BackendError{Backend: "database", Op: "CleanupExpired", Err: result.Error}
+		}
+		if result.RowsAffected < cleanupBatch {
+			return nil
+		}
+	}
+}
+
+const cleanupBatch = 1000
+
+// query starts a query on the store's table.
+func (ds *DatabaseStore) query(ctx context.Context) *gorm.DB {
+	return ds.db.WithContext(ctx).Table(ds.table)
+}
+
+// keyIs matches key's row. The column name is quoted, since key is a
+// reserved word in MySQL.
+func keyIs(key string) clause.Expression {
+	return clause.Eq{Column: clause.Column{Name: "key"}, Value: key}
+}
+
+// liveAt matches rows that have not expired at t.
+func liveAt(t time.Time) clause.Expression {
+	return clause.Gt{Column: clause.Column{Name: "expires_at"}, Value: t}
 }
 
-// Close closes the database connection
+// utcNow returns the current time in UTC. Expiry times are always written and
+// compared in UTC, because SQLite compares them as text.
+func utcNow() time.Time {
+	return time.Now().UTC()
+}
+
+// Ping checks that the database is reachable.
+func (ds *DatabaseStore) Ping(ctx context.Context) error {
+	sqlDB, err := ds.db.DB()
+	if err == nil {
+		err = sqlDB.PingContext(ctx)
+	}
+	if err != nil {
+		return &BackendError{Backend: "database", Op: "Ping", Err: err}
+	}
+	return nil
+}
+
+// Close closes the database connection, unless it was passed in by the
+// application.
 func (ds *DatabaseStore) Close() error {
+	if !ds.ownsDB {
+		return nil
+	}
 	sqlDB, err := ds.db.DB()
 	if err != nil {
 		return err
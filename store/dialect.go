@@ -0,0 +1,96 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sqlDialect holds the statements DatabaseStore cannot leave to GORM, in a
+// form for one database. Upserts are built with GORM's OnConflict clause,
+// which each dialect already renders in its own syntax.
+type sqlDialect struct {
+	quote string // Identifier quote character
+	// migrations create the table and its expires_at index. %[1]s is the
+	// quoted table name and %[2]s the quoted index name. %[3]s and %[4]s are
+	// the same with the schema moved from the table to the index, as SQLite
+	// wants it.
+	migrations []string
+	// deleteExpired deletes up to a batch of expired rows. %[1]s is the
+	// quoted table name; the arguments are the current time and the batch
+	// size.
+	deleteExpired string
+	// likeEscape makes \ the escape character of a LIKE pattern where it is
+	// not the default.
+	likeEscape string
+}
+
+var sqlDialects = map[string]sqlDialect{
+	"postgres": {
+		quote: `"`,
+		migrations: []string{
+			`CREATE TABLE IF NOT EXISTS %[1]s ("key" text PRIMARY KEY, "value" text, "expires_at" timestamptz NOT NULL)`,
+			`CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s ("expires_at")`,
+		},
+		// Postgres has no DELETE ... LIMIT
+		deleteExpired: `DELETE FROM %[1]s WHERE ctid IN (SELECT ctid FROM %[1]s WHERE "expires_at" <= ? LIMIT ?)`,
+	},
+	"mysql": {
+		quote: "`",
+		// MySQL has no CREATE INDEX IF NOT EXISTS, so the index is declared
+		// with the table. TEXT cannot be a primary key without a length.
+		migrations: []string{
+			"CREATE TABLE IF NOT EXISTS %[1]s (`key` VARCHAR(255) NOT NULL PRIMARY KEY, `value` TEXT, `expires_at` DATETIME(6) NOT NULL, INDEX %[2]s (`expires_at`))",
+		},
+		deleteExpired: "DELETE FROM %[1]s WHERE `expires_at` <= ? LIMIT ?",
+	},
+	"sqlite": {
+		quote: `"`,
+		migrations: []string{
+			`CREATE TABLE IF NOT EXISTS %[1]s ("key" text PRIMARY KEY, "value" text, "expires_at" datetime NOT NULL)`,
+			`CREATE INDEX IF NOT EXISTS %[3]s ON %[4]s ("expires_at")`,
+		},
+		deleteExpired: `DELETE FROM %[1]s WHERE rowid IN (SELECT rowid FROM %[1]s WHERE "expires_at" <= ? LIMIT ?)`,
+		likeEscape:    ` ESCAPE '\'`,
+	},
+}
+
+func lookupDialect(name string) (sqlDialect, error) {
+	d, ok := sqlDialects[name]
+	if !ok {
+		return sqlDialect{}, fmt.Errorf("unsupported database dialect %q, want postgres, mysql or sqlite", name)
+	}
+	return d, nil
+}
+
+// DatabaseMigrations returns the SQL that creates a DatabaseStore's table
+// and index in the given dialect, "postgres", "mysql" or "sqlite", for use
+// with DatabaseOptions.SkipMigration and a migration tool. table may be
+// qualified with a schema, as in "limits.rate_limit_entries".
+func DatabaseMigrations(dialect, table string) ([]string, error) {
+	d, err := lookupDialect(dialect)
+	if err != nil {
+		return nil, err
+	}
+	schema, name := "", table
+	if i := strings.LastIndexByte(table, '.'); i >= 0 {
+		schema, name = table[:i+1], table[i+1:]
+	}
+	index := "idx_" + name + "_expires_at"
+
+	out := make([]string, len(d.migrations))
+	for i, stmt := range d.migrations {
+		out[i] = fmt.Sprintf(stmt, d.quoteIdent(table), d.quoteIdent(index),
+			d.quoteIdent(schema+index), d.quoteIdent(name))
+	}
+	return out, nil
+}
+
+// quoteIdent quotes each dot-separated part of a possibly schema-qualified
+// name.
+func (d sqlDialect) quoteIdent(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = d.quote + strings.ReplaceAll(p, d.quote, d.quote+d.quote) + d.quote
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,41 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNotFound is returned by Get and Delete when a key has no value.
+	ErrNotFound = errors.New("key not found")
+
+	// ErrExpired is returned by stores that can tell a key's value has
+	// expired. It is also an ErrNotFound, so checking for ErrNotFound
+	// covers both.
+	ErrExpired = fmt.Errorf("key expired: %w", ErrNotFound)
+
+	// ErrBackend is matched by every BackendError, so callers can tell an
+	// outage apart from a missing key or a bad argument.
+	ErrBackend = errors.New("store backend error")
+)
+
+// BackendError is returned when the system behind a store fails, such as a
+// Redis outage or a database timeout. Unwrap returns the backend's own error.
+type BackendError struct {
+	Backend string // "Redis" or "database"
+	Op      string // The store method that failed, such as "Get"
+	Err     error
+}
+
+func (e *BackendError) Error() string {
+	return fmt.Sprintf("%s %s error: %v", e.Backend, e.Op, e.Err)
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports a BackendError as ErrBackend.
+func (e *BackendError) Is(target error) bool {
+	return target == ErrBackend
+}
@@ -0,0 +1,396 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"sync"
+	"time"
+)
+
+// errNoBackend is returned when every backend's circuit is open.
+var errNoBackend = errors.New("no healthy backend")
+
+// Pinger is implemented by stores that can check their connection cheaply.
+// FailoverStore probes backends with Ping when they have it, and with an
+// Exists call otherwise.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Transition describes FailoverStore switching backends. From and To are
+// indexes into the backends it was built with; To is -1 when no backend is
+// healthy, and From is -1 when one becomes healthy again after that.
+type Transition struct {
+	From int
+	To   int
+	Err  error // The error that opened From's circuit, nil on switch-back
+}
+
+// FailoverStore spreads one Store over an ordered list of backends, such as
+// Redis with PostgreSQL and then memory behind it. Every call goes to the
+// first healthy backend.
+//
+// Each backend has a circuit breaker: after failureThreshold backend errors
+// in a row its circuit opens and calls move on to the next backend. Every
+// probeInterval each backend is probed; a probe failure counts like any other
+// error, and a successful probe closes an open circuit, switching back to the
+// backend if it comes before the one in use.
+//
+// Backends do not share state, so a limit starts afresh on the backend
+// switched to, and picks up whatever the earlier backend still holds when
+// switching back. Limiter state is encoded as JSON, which every backend can
+// hold.
+//
+// FailoverStore is also a Scanner, Batcher and BatchUpdater, passing those
+// calls to the active backend. Batches fall back to a call per key on a
+// backend without batch operations, and Scan fails on one that cannot scan.
+type FailoverStore struct {
+	backends  []Store
+	threshold int
+	interval  time.Duration
+
+	mu       sync.Mutex
+	failures []int
+	open     []bool
+	active   int
+	hooks    []func(Transition)
+
+	stop chan struct{}
+}
+
+func NewFailoverStore(failureThreshold int, probeInterval time.Duration, backends ...Store) *FailoverStore {
+	if len(backends) == 0 {
+		panic("at least one backend is required")
+	}
+	if failureThreshold <= 0 {
+		panic("failureThreshold must be greater than 0")
+	}
+	if probeInterval <= 0 {
+		panic("probeInterval must be greater than 0")
+	}
+	f := &FailoverStore{
+		backends:  backends,
+		threshold: failureThreshold,
+		interval:  probeInterval,
+		failures:  make([]int, len(backends)),
+		open:      make([]bool, len(backends)),
+		stop:      make(chan struct{}),
+	}
+
+	go f.probeLoop()
+
+	return f
+}
+
+// OnTransition registers fn to be called every time the store switches
+// backends. Hooks run synchronously on the goroutine that caused the switch,
+// so they should return quickly.
+func (f *FailoverStore) OnTransition(fn func(Transition)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hooks = append(f.hooks, fn)
+}
+
+// Active returns the index of the backend calls go to, or -1 if none is
+// healthy.
+func (f *FailoverStore) Active() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active
+}
+
+// Close stops the background probes. The backends are left open.
+func (f *FailoverStore) Close() {
+	close(f.stop)
+}
+
+func (f *FailoverStore) Get(ctx context.Context, key string) (interface{}, error) {
+	var value interface{}
+	err := f.do(ctx, "Get", func(s Store) error {
+		var err error
+		value, err = s.Get(ctx, key)
+		return err
+	})
+	return value, err
+}
+
+func (f *FailoverStore) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return f.do(ctx, "Set", func(s Store) error {
+		return s.Set(ctx, key, value, ttl)
+	})
+}
+
+func (f *FailoverStore) Delete(ctx context.Context, key string) error {
+	return f.do(ctx, "Delete", func(s Store) error {
+		return s.Delete(ctx, key)
+	})
+}
+
+func (f *FailoverStore) Exists(ctx context.Context, key string) (bool, error) {
+	var exists bool
+	err := f.do(ctx, "Exists", func(s Store) error {
+		var err error
+		exists, err = s.Exists(ctx, key)
+		return err
+	})
+	return exists, err
+}
+
+// Update runs fn atomically when the active backend is an Updater, and as a
+// Get followed by a Set on it otherwise.
+func (f *FailoverStore) Update(ctx context.Context, key string, fn UpdateFunc) error {
+	return f.do(ctx, "Update", func(s Store) error {
+		return update(ctx, s, key, fn)
+	})
+}
+
+// GetMany reads keys from the active backend, in one call when it is a
+// Batcher and with a Get per key otherwise.
+func (f *FailoverStore) GetMany(ctx context.Context, keys []string) ([]interface{}, error) {
+	var values []interface{}
+	err := f.do(ctx, "GetMany", func(s Store) error {
+		if b, ok := s.(Batcher); ok {
+			var err error
+			values, err = b.GetMany(ctx, keys)
+			return err
+		}
+		values = make([]interface{}, len(keys))
+		for i, key := range keys {
+			value, err := s.Get(ctx, key)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			values[i] = value
+		}
+		return nil
+	})
+	return values, err
+}
+
+// SetMany writes entries to the active backend, in one call when it is a
+// Batcher and with a Set per entry otherwise.
+func (f *FailoverStore) SetMany(ctx context.Context, entries []Entry) error {
+	if err := checkEntries(entries); err != nil {
+		return err
+	}
+	return f.do(ctx, "SetMany", func(s Store) error {
+		if b, ok := s.(Batcher); ok {
+			return b.SetMany(ctx, entries)
+		}
+		for _, e := range lastEntries(entries) {
+			if err := s.Set(ctx, e.Key, e.Value, e.TTL); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateMany runs fn on the active backend, as one batch when it is a
+// BatchUpdater and with an Update per key otherwise, in which case fn is
+// called once for each key.
+func (f *FailoverStore) UpdateMany(ctx context.Context, keys []string, fn UpdateManyFunc) error {
+	return f.do(ctx, "UpdateMany", func(s Store) error {
+		if u, ok := s.(BatchUpdater); ok {
+			return u.UpdateMany(ctx, keys, fn)
+		}
+		for i, key := range keys {
+			err := update(ctx, s, key, func(current interface{}) (interface{}, time.Duration, error) {
+				indexes := []int{i}
+				entries, err := fn(indexes, []interface{}{current})
+				if err == nil {
+					entries, err = checkBatch(keys, indexes, entries)
+				}
+				if err != nil || len(entries) == 0 {
+					return nil, 0, err
+				}
+				return entries[0].Value, entries[0].TTL, nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Scan yields the keys of the active backend, which must be a Scanner. When
+// the backend fails part-way through, the scan goes on with the next
+// backend, whose keys may overlap those already yielded.
+func (f *FailoverStore) Scan(ctx context.Context, pattern string) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		stopped := false
+		err := f.do(ctx, "Scan", func(s Store) error {
+			sc, ok := s.(Scanner)
+			if !ok {
+				return fmt.Errorf("backend %T cannot scan keys", s)
+			}
+			for key, err := range sc.Scan(ctx, pattern) {
+				if err != nil {
+					return err
+				}
+				if !yield(key, nil) {
+					stopped = true
+					return nil
+				}
+			}
+			return nil
+		})
+		if err != nil && !stopped {
+			yield("", err)
+		}
+	}
+}
+
+// update runs fn on key's value in s, atomically when s is an Updater.
+func update(ctx context.Context, s Store, key string, fn UpdateFunc) error {
+	if u, ok := s.(Updater); ok {
+		return u.Update(ctx, key, fn)
+	}
+	current, err := s.Get(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		current = nil
+	} else if err != nil {
+		return err
+	}
+	next, ttl, err := fn(current)
+	if err != nil || next == nil {
+		return err
+	}
+	return s.Set(ctx, key, next, ttl)
+}
+
+// do runs op on the active backend. A backend error counts against the
+// backend's circuit, and when that opens it the call is retried on the next
+// backend. Other errors, and errors caused by ctx ending, leave the circuit
+// alone.
+func (f *FailoverStore) do(ctx context.Context, op string, fn func(s Store) error) error {
+	for {
+		f.mu.Lock()
+		i := f.active
+		f.mu.Unlock()
+		if i < 0 {
+			return &BackendError{Backend: "failover", Op: op, Err: errNoBackend}
+		}
+
+		err := fn(f.backends[i])
+		if ctx.Err() != nil {
+			return err
+		}
+		if !errors.Is(err, ErrBackend) {
+			f.succeed(i)
+			return err
+		}
+		if !f.fail(i, err) {
+			return err
+		}
+	}
+}
+
+// succeed resets backend i's run of failures.
+func (f *FailoverStore) succeed(i int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[i] = 0
+}
+
+// fail counts a failure against backend i and reports whether its circuit
+// is open.
+func (f *FailoverStore) fail(i int, err error) bool {
+	f.mu.Lock()
+	f.failures[i]++
+	if f.open[i] || f.failures[i] < f.threshold {
+		open := f.open[i]
+		f.mu.Unlock()
+		return open
+	}
+	f.open[i] = true
+	t, hooks, changed := f.switchActive(err)
+	f.mu.Unlock()
+
+	if changed {
+		fire(hooks, t)
+	}
+	return true
+}
+
+// recover closes backend i's circuit after a successful probe.
+func (f *FailoverStore) recover(i int) {
+	f.mu.Lock()
+	f.failures[i] = 0
+	if !f.open[i] {
+		f.mu.Unlock()
+		return
+	}
+	f.open[i] = false
+	t, hooks, changed := f.switchActive(nil)
+	f.mu.Unlock()
+
+	if changed {
+		fire(hooks, t)
+	}
+}
+
+// switchActive points active at the first backend whose circuit is closed.
+// f.mu must be held.
+func (f *FailoverStore) switchActive(err error) (Transition, []func(Transition), bool) {
+	next := -1
+	for i, open := range f.open {
+		if !open {
+			next = i
+			break
+		}
+	}
+	if next == f.active {
+		return Transition{}, nil, false
+	}
+	t := Transition{From: f.active, To: next, Err: err}
+	f.active = next
+	return t, f.hooks, true
+}
+
+func fire(hooks []func(Transition), t Transition) {
+	for _, hook := range hooks {
+		hook(t)
+	}
+}
+
+func (f *FailoverStore) probeLoop() {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			for i := range f.backends {
+				f.probe(i)
+			}
+		}
+	}
+}
+
+// probe checks backend i, counting a failure against it or closing its
+// circuit.
+func (f *FailoverStore) probe(i int) {
+	ctx, cancel := context.WithTimeout(context.Background(), f.interval)
+	defer cancel()
+
+	var err error
+	if p, ok := f.backends[i].(Pinger); ok {
+		err = p.Ping(ctx)
+	} else {
+		_, err = f.backends[i].Exists(ctx, "limitz:probe")
+	}
+	if err != nil {
+		f.fail(i, err)
+		return
+	}
+	f.recover(i)
+}
@@ -1,36 +1,218 @@
 package store
 
 import (
+	"bytes"
+	"container/heap"
 	"context"
 	"fmt"
+	"hash/maphash"
+	"iter"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// EvictionPolicy decides which entry a bounded MemoryStore removes when it
+// is full.
+type EvictionPolicy int
+
+const (
+	// EvictLRU removes the least recently used entry.
+	EvictLRU EvictionPolicy = iota
+	// EvictLFU removes the least frequently used entry. Keys in steady use
+	// stay, and a flood of new keys mostly evicts one another.
+	EvictLFU
+	// EvictEarliestExpiry removes the entry closest to expiring, which
+	// loses the least limiter state.
+	EvictEarliestExpiry
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictLRU:
+		return "lru"
+	case EvictLFU:
+		return "lfu"
+	case EvictEarliestExpiry:
+		return "earliest-expiry"
+	default:
+		return fmt.Sprintf("EvictionPolicy(%d)", int(p))
+	}
+}
+
+// MemoryOptions configures a store built by NewMemoryStoreWithOptions. The
+// zero value is an unbounded store, like NewMemoryStore.
+type MemoryOptions struct {
+	// MaxEntries bounds the number of keys; 0 means no bound.
+	MaxEntries int
+	// MaxBytes bounds the approximate memory used by keys and values; 0
+	// means no bound.
+	MaxBytes int64
+	// Eviction picks the entry removed when a bound is reached.
+	Eviction EvictionPolicy
+	// Shards is the number of independently locked maps. Defaults to 16.
+	Shards int
+	// SweepInterval is how often expired entries are removed in the
+	// background. Defaults to 5 minutes.
+	SweepInterval time.Duration
+
+	// SnapshotPath, if set, is where the store writes a snapshot every
+	// SnapshotInterval and when it is closed. Restore it on start with
+	// RestoreFile.
+	SnapshotPath string
+	// SnapshotInterval defaults to 1 minute.
+	SnapshotInterval time.Duration
+	// OnSnapshotError is called when writing a snapshot to SnapshotPath
+	// fails. The store keeps serving and tries again at the next interval.
+	OnSnapshotError func(error)
+}
+
+// MemoryStats describes a MemoryStore's contents.
+type MemoryStats struct {
+	Entries   int    // Keys held, including expired ones not swept yet
+	Bytes     int64  // Approximate size of the keys and values; only tracked with MaxBytes
+	Evictions uint64 // Entries removed to stay within MaxEntries or MaxBytes
+}
+
 type entry struct {
+	key        string
 	value      interface{}
 	expiration time.Time
+	size       int64
+	rank       int64 // Eviction order, lowest first
+	index      int   // Position in the shard's queue
 }
 
 type MemoryStore struct {
-	data map[string]*entry
-	mu   sync.Mutex
-	stop chan struct{}
+	shards    []*memoryShard
+	seed      maphash.Seed
+	policy    EvictionPolicy
+	sweep     time.Duration
+	evictions atomic.Uint64
+	stop      chan struct{}
+	done      chan struct{}
+
+	snapshotPath     string
+	snapshotInterval time.Duration
+	onSnapshotError  func(error)
+}
+
+// memoryShard is one lock's worth of a MemoryStore. A bounded shard keeps
+// its entries in a queue ordered by rank, so the next one to evict is
+// always at the front.
+type memoryShard struct {
+	mu         sync.Mutex
+	data       map[string]*entry
+	queue      evictionQueue
+	bytes      int64
+	clock      int64 // Counts accesses, to rank entries for LRU
+	maxEntries int
+	maxBytes   int64
 }
 
 func NewMemoryStore() *MemoryStore {
+	return NewMemoryStoreWithOptions(MemoryOptions{})
+}
+
+// NewMemoryStoreWithOptions builds a store, bounded if opts set MaxEntries
+// or MaxBytes. The bounds are split evenly across shards and enforced per
+// shard, so a store may evict before it is full overall when keys hash
+// unevenly, and a bound smaller than the shard count means fewer shards.
+// The store never holds more than the bounds, except that an entry larger
+// than a shard's share of MaxBytes is still kept on its own.
+func NewMemoryStoreWithOptions(opts MemoryOptions) *MemoryStore {
+	if opts.MaxEntries < 0 {
+		panic("MaxEntries must not be negative")
+	}
+	if opts.MaxBytes < 0 {
+		panic("MaxBytes must not be negative")
+	}
+	if opts.Eviction < EvictLRU || opts.Eviction > EvictEarliestExpiry {
+		panic(fmt.Sprintf("unknown eviction policy %d", opts.Eviction))
+	}
+	if opts.Shards < 0 {
+		panic("Shards must not be negative")
+	}
+	if opts.SweepInterval < 0 {
+		panic("SweepInterval must not be negative")
+	}
+	if opts.SnapshotInterval < 0 {
+		panic("SnapshotInterval must not be negative")
+	}
+
+	shards := opts.Shards
+	if shards == 0 {
+		shards = 16
+	}
+	// Every shard must be able to hold at least one entry, and get a
+	// share of MaxBytes, since a share of 0 would mean no bound
+	if opts.MaxEntries > 0 && opts.MaxEntries < shards {
+		shards = opts.MaxEntries
+	}
+	if opts.MaxBytes > 0 && opts.MaxBytes < int64(shards) {
+		shards = int(opts.MaxBytes)
+	}
+	sweep := opts.SweepInterval
+	if sweep == 0 {
+		sweep = 5 * time.Minute
+	}
+	snapshotInterval := opts.SnapshotInterval
+	if snapshotInterval == 0 {
+		snapshotInterval = time.Minute
+	}
+
 	store := &MemoryStore{
-		data: make(map[string]*entry),
-		stop: make(chan struct{}),
+		shards: make([]*memoryShard, shards),
+		seed:   maphash.MakeSeed(),
+		policy: opts.Eviction,
+		sweep:  sweep,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+
+		snapshotPath:     opts.SnapshotPath,
+		snapshotInterval: snapshotInterval,
+		onSnapshotError:  opts.OnSnapshotError,
+	}
+	for i := range store.shards {
+		store.shards[i] = &memoryShard{
+			data:       make(map[string]*entry),
+			maxEntries: opts.MaxEntries / shards,
+			maxBytes:   opts.MaxBytes / int64(shards),
+		}
 	}
 
-	go store.cleanupExpired()
+	go store.background()
 
 	return store
 }
 
+// Codec returns IdentityCodec: limiter state is kept as Go values, with no
+// encoding on the way in or out.
+func (ms *MemoryStore) Codec() Codec {
+	return IdentityCodec{}
+}
+
+// Stats returns the store's entry count, size and evictions so far.
+func (ms *MemoryStore) Stats() MemoryStats {
+	stats := MemoryStats{Evictions: ms.evictions.Load()}
+	for _, shard := range ms.shards {
+		shard.mu.Lock()
+		stats.Entries += len(shard.data)
+		stats.Bytes += shard.bytes
+		shard.mu.Unlock()
+	}
+	return stats
+}
+
+// Close stops the background sweep and, if the store has a SnapshotPath,
+// writes a final snapshot there.
 func (ms *MemoryStore) Close() {
 	close(ms.stop)
+	<-ms.done
+	if ms.snapshotPath != "" {
+		ms.writeSnapshot()
+	}
 }
 
 func (ms *MemoryStore) Get(ctx context.Context, key string) (interface{}, error) {
@@ -41,20 +223,22 @@ func (ms *MemoryStore) Get(ctx context.Context, key string) (interface{}, error)
 		return nil, fmt.Errorf("key cannot be empty")
 	}
 
-	ms.mu.Lock()
-	defer ms.mu.Unlock()
+	shard := ms.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	entry, exists := ms.data[key]
+	entry, exists := shard.data[key]
 	if !exists {
-		return nil, fmt.Errorf("key not found: %s", key)
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
 	}
 
 	// Check if expired
 	if time.Now().After(entry.expiration) {
-		delete(ms.data, key)
-		return nil, fmt.Errorf("key expired: %s", key)
+		shard.remove(entry)
+		return nil, fmt.Errorf("%w: %s", ErrExpired, key)
 	}
 
+	ms.touch(shard, entry)
 	return entry.value, nil
 }
 
@@ -72,17 +256,150 @@ func (ms *MemoryStore) Set(ctx context.Context, key string, value interface{}, t
 		return fmt.Errorf("TTL must be greater than 0")
 	}
 
-	ms.mu.Lock()
-	defer ms.mu.Unlock()
+	shard := ms.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	ms.put(shard, key, value, time.Now().Add(ttl))
+	return nil
+}
+
+// Update runs fn on a copy of key's value while holding the lock on key's
+// shard, so updates from limiters sharing the store cannot interleave. fn
+// gets a copy rather than the stored value, so values handed out by Get are
+// never changed underneath their readers, and nothing changes if fn fails.
+// fn must not call the store.
+func (ms *MemoryStore) Update(ctx context.Context, key string, fn UpdateFunc) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if key == "" {
+		return fmt.Errorf("key cannot be empty")
+	}
+
+	shard := ms.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := time.Now()
+	var current interface{}
+	if entry, exists := shard.data[key]; exists && !now.After(entry.expiration) {
+		current = cloneValue(entry.value)
+	}
+
+	next, ttl, err := fn(current)
+	if err != nil || next == nil {
+		return err
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("TTL must be greater than 0")
+	}
+	ms.put(shard, key, next, now.Add(ttl))
+	return nil
+}
+
+// GetMany returns copies of the values of keys, as Update hands to fn, so
+// the caller may change them and write them back with SetMany. Each shard
+// the keys fall in is locked once.
+func (ms *MemoryStore) GetMany(ctx context.Context, keys []string) ([]interface{}, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("key cannot be empty")
+		}
+	}
+
+	values := make([]interface{}, len(keys))
+	now := time.Now()
+	for shard, indexes := range ms.byShard(len(keys), func(i int) string { return keys[i] }) {
+		shard.mu.Lock()
+		for _, i := range indexes {
+			if entry, exists := shard.data[keys[i]]; exists && !now.After(entry.expiration) {
+				ms.touch(shard, entry)
+				values[i] = cloneValue(entry.value)
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return values, nil
+}
+
+// SetMany stores entries, locking each shard they fall in once.
+func (ms *MemoryStore) SetMany(ctx context.Context, entries []Entry) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := checkEntries(entries); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for shard, indexes := range ms.byShard(len(entries), func(i int) string { return entries[i].Key }) {
+		shard.mu.Lock()
+		for _, i := range indexes {
+			e := entries[i]
+			ms.put(shard, e.Key, e.Value, now.Add(e.TTL))
+		}
+		shard.mu.Unlock()
+	}
+	return nil
+}
+
+// UpdateMany runs fn on copies of the values of keys while holding the locks
+// of every shard they fall in, taken in shard order so that batches cannot
+// deadlock each other. fn must not call the store.
+func (ms *MemoryStore) UpdateMany(ctx context.Context, keys []string, fn UpdateManyFunc) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	for _, key := range keys {
+		if key == "" {
+			return fmt.Errorf("key cannot be empty")
+		}
+	}
 
-	ms.data[key] = &entry{
-		value:      value,
-		expiration: time.Now().Add(ttl),
+	groups := ms.byShard(len(keys), func(i int) string { return keys[i] })
+	for _, shard := range ms.shards {
+		if _, ok := groups[shard]; ok {
+			shard.mu.Lock()
+			defer shard.mu.Unlock()
+		}
 	}
 
+	now := time.Now()
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if entry, exists := ms.shard(key).data[key]; exists && !now.After(entry.expiration) {
+			values[i] = cloneValue(entry.value)
+		}
+	}
+	indexes := allIndexes(len(keys))
+	entries, err := fn(indexes, values)
+	if err != nil {
+		return err
+	}
+	if entries, err = checkBatch(keys, indexes, entries); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		ms.put(ms.shard(e.Key), e.Key, e.Value, now.Add(e.TTL))
+	}
 	return nil
 }
 
+// byShard groups the indexes 0 to n-1 by the shard of the key at each one,
+// keeping them in order within a shard.
+func (ms *MemoryStore) byShard(n int, key func(i int) string) map[*memoryShard][]int {
+	groups := make(map[*memoryShard][]int)
+	for i := 0; i < n; i++ {
+		shard := ms.shard(key(i))
+		groups[shard] = append(groups[shard], i)
+	}
+	return groups
+}
+
 func (ms *MemoryStore) Delete(ctx context.Context, key string) error {
 	if ctx.Err() != nil {
 		return ctx.Err()
@@ -91,14 +408,16 @@ func (ms *MemoryStore) Delete(ctx context.Context, key string) error {
 		return fmt.Errorf("key cannot be empty")
 	}
 
-	ms.mu.Lock()
-	defer ms.mu.Unlock()
+	shard := ms.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	if _, exists := ms.data[key]; !exists {
-		return fmt.Errorf("key not found: %s", key)
+	entry, exists := shard.data[key]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
 	}
 
-	delete(ms.data, key)
+	shard.remove(entry)
 	return nil
 }
 
@@ -110,40 +429,273 @@ func (ms *MemoryStore) Exists(ctx context.Context, key string) (bool, error) {
 		return false, fmt.Errorf("key cannot be empty")
 	}
 
-	ms.mu.Lock()
-	defer ms.mu.Unlock()
+	shard := ms.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	entry, exists := ms.data[key]
+	entry, exists := shard.data[key]
 	if !exists {
 		return false, nil
 	}
 
 	// Check if expired
 	if time.Now().After(entry.expiration) {
-		delete(ms.data, key)
+		shard.remove(entry)
 		return false, nil
 	}
 
 	return true, nil
 }
 
-func (ms *MemoryStore) cleanupExpired() {
-	ticker := time.NewTicker(5 * time.Minute)
+// Scan yields the live keys matching pattern. Each shard's matching keys are
+// collected under its lock and yielded after it is released, so the loop
+// body may call the store.
+func (ms *MemoryStore) Scan(ctx context.Context, pattern string) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		for _, shard := range ms.shards {
+			if ctx.Err() != nil {
+				yield("", ctx.Err())
+				return
+			}
+			var keys []string
+			now := time.Now()
+			shard.mu.Lock()
+			for key, e := range shard.data {
+				if !now.After(e.expiration) && matchGlob(pattern, key) {
+					keys = append(keys, key)
+				}
+			}
+			shard.mu.Unlock()
+
+			for _, key := range keys {
+				if !yield(key, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (ms *MemoryStore) shard(key string) *memoryShard {
+	return ms.shards[maphash.String(ms.seed, key)%uint64(len(ms.shards))]
+}
+
+// put stores value under key in shard, which must be locked, and evicts
+// other entries until the shard is within its bounds again.
+func (ms *MemoryStore) put(shard *memoryShard, key string, value interface{}, expiration time.Time) {
+	e, exists := shard.data[key]
+	if !exists {
+		e = &entry{key: key, index: -1}
+		shard.data[key] = e
+	}
+	e.value = value
+	e.expiration = expiration
+	if !shard.bounded() {
+		return
+	}
+
+	if shard.maxBytes > 0 {
+		size := sizeOf(key, value)
+		shard.bytes += size - e.size
+		e.size = size
+	}
+	ms.touch(shard, e)
+
+	// The entry being written is taken out of the queue while others are
+	// evicted, so a write is never lost to its own eviction
+	heap.Remove(&shard.queue, e.index)
+	for shard.full() && len(shard.queue) > 0 {
+		shard.remove(heap.Pop(&shard.queue).(*entry))
+		ms.evictions.Add(1)
+	}
+	heap.Push(&shard.queue, e)
+}
+
+// touch updates e's rank after a read or write, according to the policy.
+func (ms *MemoryStore) touch(shard *memoryShard, e *entry) {
+	if !shard.bounded() {
+		return
+	}
+	switch ms.policy {
+	case EvictLRU:
+		shard.clock++
+		e.rank = shard.clock
+	case EvictLFU:
+		e.rank++
+	case EvictEarliestExpiry:
+		e.rank = e.expiration.UnixNano()
+	}
+	if e.index < 0 {
+		heap.Push(&shard.queue, e)
+	} else {
+		heap.Fix(&shard.queue, e.index)
+	}
+}
+
+func (s *memoryShard) bounded() bool {
+	return s.maxEntries > 0 || s.maxBytes > 0
+}
+
+func (s *memoryShard) full() bool {
+	return (s.maxEntries > 0 && len(s.data) > s.maxEntries) ||
+		(s.maxBytes > 0 && s.bytes > s.maxBytes)
+}
+
+// remove deletes e from the shard, which must be locked.
+func (s *memoryShard) remove(e *entry) {
+	delete(s.data, e.key)
+	if e.index >= 0 {
+		heap.Remove(&s.queue, e.index)
+	}
+	s.bytes -= e.size
+}
+
+// background sweeps expired entries and writes periodic snapshots until
+// the store is closed.
+func (ms *MemoryStore) background() {
+	defer close(ms.done)
+	ticker := time.NewTicker(ms.sweep)
 	defer ticker.Stop()
 
+	var snapshots <-chan time.Time
+	if ms.snapshotPath != "" {
+		snapshotTicker := time.NewTicker(ms.snapshotInterval)
+		defer snapshotTicker.Stop()
+		snapshots = snapshotTicker.C
+	}
+
 	for {
 		select {
 		case <-ms.stop:
 			return
 		case <-ticker.C:
-			ms.mu.Lock()
-			now := time.Now()
-			for key, entry := range ms.data {
-				if now.After(entry.expiration) {
-					delete(ms.data, key)
-				}
+			ms.cleanupExpired()
+		case <-snapshots:
+			ms.writeSnapshot()
+		}
+	}
+}
+
+func (ms *MemoryStore) cleanupExpired() {
+	// One shard at a time, so requests for keys in other shards are not
+	// held up by the sweep
+	for _, shard := range ms.shards {
+		shard.mu.Lock()
+		now := time.Now()
+		for _, entry := range shard.data {
+			if now.After(entry.expiration) {
+				shard.remove(entry)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+func (ms *MemoryStore) writeSnapshot() {
+	if err := ms.SnapshotFile(ms.snapshotPath); err != nil && ms.onSnapshotError != nil {
+		ms.onSnapshotError(err)
+	}
+}
+
+// cloneValue copies a stored value for Update. A pointer to a struct, such
+// as limiter state, gets a new struct with its slices and maps copied too; a
+// []byte is copied; other values are immutable or copied on assignment.
+func cloneValue(value interface{}) interface{} {
+	if b, ok := value.([]byte); ok {
+		return bytes.Clone(b)
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return value
+	}
+	out := reflect.New(v.Elem().Type())
+	out.Elem().Set(v.Elem())
+	for i := 0; i < out.Elem().NumField(); i++ {
+		f := out.Elem().Field(i)
+		if f.IsZero() || !f.CanSet() {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.Slice:
+			f.Set(reflect.AppendSlice(reflect.MakeSlice(f.Type(), 0, f.Len()), f))
+		case reflect.Map:
+			m := reflect.MakeMapWithSize(f.Type(), f.Len())
+			for iter := f.MapRange(); iter.Next(); {
+				m.SetMapIndex(iter.Key(), iter.Value())
+			}
+			f.Set(m)
+		}
+	}
+	return out.Interface()
+}
+
+// evictionQueue is a min-heap of entries by rank.
+type evictionQueue []*entry
+
+func (q evictionQueue) Len() int           { return len(q) }
+func (q evictionQueue) Less(i, j int) bool { return q[i].rank < q[j].rank }
+
+func (q evictionQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *evictionQueue) Push(x any) {
+	e := x.(*entry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *evictionQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*q = old[:len(old)-1]
+	return e
+}
+
+// entryOverhead approximates the map slot, entry struct and queue slot
+// behind every key.
+const entryOverhead = 128
+
+// sizeOf approximates the memory held by key and value. It follows
+// pointers, strings and slices one level deep, which covers []byte values
+// and the limiters' state structs, including SlidingWindow's timestamps.
+func sizeOf(key string, value interface{}) int64 {
+	v := reflect.ValueOf(value)
+	size := int64(entryOverhead+len(key)) + int64(v.Type().Size())
+	if v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+		size += int64(v.Type().Size())
+	}
+	return size + referencedSize(v)
+}
+
+// referencedSize is the size of the string, slice or map data v refers to,
+// or that its fields refer to if it is a struct. A map counts its keys and
+// values, and the strings among them.
+func referencedSize(v reflect.Value) int64 {
+	switch v.Kind() {
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Slice:
+		return int64(v.Cap()) * int64(v.Type().Elem().Size())
+	case reflect.Map:
+		size := int64(v.Len()) * int64(v.Type().Key().Size()+v.Type().Elem().Size())
+		for iter := v.MapRange(); iter.Next(); {
+			size += referencedSize(iter.Key()) + referencedSize(iter.Value())
+		}
+		return size
+	case reflect.Struct:
+		var size int64
+		for i := 0; i < v.NumField(); i++ {
+			if k := v.Field(i).Kind(); k == reflect.String || k == reflect.Slice || k == reflect.Map {
+				size += referencedSize(v.Field(i))
 			}
-			ms.mu.Unlock()
 		}
+		return size
 	}
+	return 0
 }
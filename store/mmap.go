@@ -0,0 +1,581 @@
+//go:build linux
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"iter"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Layout of an MmapStore file: a header, then slotCount slots of slotSize
+// bytes each. Every slot starts with its own header, followed by the key
+// and then the value.
+const (
+	mmapMagic      = "LIMITZ01"
+	mmapHeaderSize = 64
+
+	slotState   = 0  // uint8: slotEmpty, slotUsed or slotDeleted
+	slotKeyLen  = 2  // uint16
+	slotValLen  = 4  // uint32
+	slotExpires = 8  // int64, Unix nanoseconds
+	slotHash    = 16 // uint64, FNV-1a of the key
+	slotData    = 24
+
+	slotEmpty   = 0
+	slotUsed    = 1
+	slotDeleted = 2
+)
+
+// MmapStore keeps state in a memory-mapped file, so every process on a host
+// that opens the same file shares it, with no network round trip. The file
+// is a fixed-size hash table: keys are hashed to a slot and collisions are
+// resolved by probing the following slots.
+//
+// Every operation holds an exclusive flock on the file, so processes take
+// turns, and goroutines within a process take turns on a mutex first. The
+// store implements Updater, so limiters decide each request under that lock
+// and the limits hold across processes.
+//
+// A key and its value must fit in one slot together with a 24-byte slot
+// header. Set fails once no slot is free; expired entries free theirs.
+// Deleted and expired entries are cleared as the store is written, so that
+// lookups for missing keys stay short after heavy churn.
+type MmapStore struct {
+	file      *os.File
+	data      []byte
+	slotSize  int
+	slotCount int
+	mu        sync.Mutex
+	closed    bool // Set by Close, under mu
+	codec     Codec
+}
+
+// NewMmapStore opens the store file at path, creating it with slots slots of
+// slotSize bytes if it does not exist. Every process sharing a file must
+// open it with the same sizes. slotSize must be a multiple of 8 and at
+// least 64; 128 fits the state of every algorithm except SlidingWindow,
+// which needs room for its timestamps.
+func NewMmapStore(path string, slots, slotSize int) (*MmapStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("path cannot be empty")
+	}
+	if slots <= 0 {
+		return nil, fmt.Errorf("slots must be greater than 0")
+	}
+	if slotSize < 64 || slotSize%8 != 0 {
+		return nil, fmt.Errorf("slotSize must be a multiple of 8 and at least 64")
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store file: %w", err)
+	}
+	size := mmapHeaderSize + slots*slotSize
+	if err := initMmapFile(file, size, slots, slotSize); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to map store file: %w", err)
+	}
+
+	return &MmapStore{
+		file:      file,
+		data:      data,
+		slotSize:  slotSize,
+		slotCount: slots,
+		codec:     BinaryCodec{},
+	}, nil
+}
+
+// initMmapFile writes the header of a new file, or checks that an existing
+// one was created with the same sizes. It holds the file lock, so processes
+// starting together do not both initialize it.
+func initMmapFile(file *os.File, size, slots, slotSize int) error {
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock store file: %w", err)
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat store file: %w", err)
+	}
+
+	header := make([]byte, mmapHeaderSize)
+	if info.Size() == 0 {
+		copy(header, mmapMagic)
+		binary.LittleEndian.PutUint32(header[8:], uint32(slotSize))
+		binary.LittleEndian.PutUint32(header[12:], uint32(slots))
+		if _, err := file.WriteAt(header, 0); err != nil {
+			return fmt.Errorf("failed to write store file: %w", err)
+		}
+		if err := file.Truncate(int64(size)); err != nil {
+			return fmt.Errorf("failed to size store file: %w", err)
+		}
+		return nil
+	}
+
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("failed to read store file: %w", err)
+	}
+	if string(header[:8]) != mmapMagic {
+		return fmt.Errorf("%s is not a store file", file.Name())
+	}
+	gotSize := int(binary.LittleEndian.Uint32(header[8:]))
+	gotSlots := int(binary.LittleEndian.Uint32(header[12:]))
+	if gotSize != slotSize || gotSlots != slots || info.Size() != int64(size) {
+		return fmt.Errorf("store file has %d slots of %d bytes, want %d of %d", gotSlots, gotSize, slots, slotSize)
+	}
+	return nil
+}
+
+// Codec returns the codec limiters use for state kept in this store,
+// BinaryCodec unless changed with SetCodec.
+func (m *MmapStore) Codec() Codec {
+	return m.codec
+}
+
+// SetCodec changes how limiters encode their state in this store. Every
+// process sharing the file must use the same codec.
+func (m *MmapStore) SetCodec(codec Codec) {
+	m.codec = codec
+}
+
+func (m *MmapStore) Get(ctx context.Context, key string) (interface{}, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if key == "" {
+		return nil, fmt.Errorf("key cannot be empty")
+	}
+
+	var value []byte
+	err := m.locked("Get", func() error {
+		slot, live := m.find(key, time.Now())
+		if slot < 0 {
+			return fmt.Errorf("%w: %s", ErrNotFound, key)
+		}
+		if !live {
+			return fmt.Errorf("%w: %s", ErrExpired, key)
+		}
+		value = bytes.Clone(m.value(slot))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (m *MmapStore) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if key == "" {
+		return fmt.Errorf("key cannot be empty")
+	}
+	if value == nil {
+		return fmt.Errorf("value cannot be nil")
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("TTL must be greater than 0")
+	}
+
+	data, err := marshal(value)
+	if err != nil {
+		return err
+	}
+	return m.locked("Set", func() error {
+		return m.put(key, data, time.Now().Add(ttl))
+	})
+}
+
+// Update runs fn on key's value while holding the file lock, so no other
+// process or goroutine can change the key in between. fn must not call the
+// store.
+func (m *MmapStore) Update(ctx context.Context, key string, fn UpdateFunc) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if key == "" {
+		return fmt.Errorf("key cannot be empty")
+	}
+
+	return m.locked("Update", func() error {
+		now := time.Now()
+		var current interface{}
+		if slot, live := m.find(key, now); live {
+			current = bytes.Clone(m.value(slot))
+		}
+
+		next, ttl, err := fn(current)
+		if err != nil || next == nil {
+			return err
+		}
+		if ttl <= 0 {
+			return fmt.Errorf("TTL must be greater than 0")
+		}
+		data, err := marshal(next)
+		if err != nil {
+			return err
+		}
+		return m.put(key, data, now.Add(ttl))
+	})
+}
+
+// GetMany reads keys under one hold of the file lock.
+func (m *MmapStore) GetMany(ctx context.Context, keys []string) ([]interface{}, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("key cannot be empty")
+		}
+	}
+
+	values := make([]interface{}, len(keys))
+	err := m.locked("GetMany", func() error {
+		now := time.Now()
+		for i, key := range keys {
+			if slot, live := m.find(key, now); live {
+				values[i] = bytes.Clone(m.value(slot))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// SetMany writes entries under one hold of the file lock. Entries written
+// before one that does not fit stay written.
+func (m *MmapStore) SetMany(ctx context.Context, entries []Entry) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := checkEntries(entries); err != nil {
+		return err
+	}
+	data := make([]string, len(entries))
+	for i, e := range entries {
+		var err error
+		if data[i], err = marshal(e.Value); err != nil {
+			return err
+		}
+	}
+
+	return m.locked("SetMany", func() error {
+		now := time.Now()
+		for i, e := range entries {
+			if err := m.put(e.Key, data[i], now.Add(e.TTL)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateMany runs fn on the values of keys while holding the file lock, so
+// no other process or goroutine can change them in between. As with
+// SetMany, entries written before one that does not fit stay written. fn
+// must not call the store.
+func (m *MmapStore) UpdateMany(ctx context.Context, keys []string, fn UpdateManyFunc) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	for _, key := range keys {
+		if key == "" {
+			return fmt.Errorf("key cannot be empty")
+		}
+	}
+
+	return m.locked("UpdateMany", func() error {
+		now := time.Now()
+		values := make([]interface{}, len(keys))
+		for i, key := range keys {
+			if slot, live := m.find(key, now); live {
+				values[i] = bytes.Clone(m.value(slot))
+			}
+		}
+		indexes := allIndexes(len(keys))
+		entries, err := fn(indexes, values)
+		if err != nil {
+			return err
+		}
+		if entries, err = checkBatch(keys, indexes, entries); err != nil {
+			return err
+		}
+		data := make([]string, len(entries))
+		for i, e := range entries {
+			if data[i], err = marshal(e.Value); err != nil {
+				return err
+			}
+		}
+		for i, e := range entries {
+			if err := m.put(e.Key, data[i], now.Add(e.TTL)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *MmapStore) Delete(ctx context.Context, key string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if key == "" {
+		return fmt.Errorf("key cannot be empty")
+	}
+
+	return m.locked("Delete", func() error {
+		slot, _ := m.find(key, time.Now())
+		if slot < 0 {
+			return fmt.Errorf("%w: %s", ErrNotFound, key)
+		}
+		m.slot(slot)[slotState] = slotDeleted
+		m.reclaim(slot, time.Now().UnixNano())
+		return nil
+	})
+}
+
+func (m *MmapStore) Exists(ctx context.Context, key string) (bool, error) {
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if key == "" {
+		return false, fmt.Errorf("key cannot be empty")
+	}
+
+	var exists bool
+	err := m.locked("Exists", func() error {
+		_, exists = m.find(key, time.Now())
+		return nil
+	})
+	return exists, err
+}
+
+// Scan yields the live keys matching pattern. They are collected under the
+// file lock and yielded once it is released, so the loop body may call the
+// store.
+func (m *MmapStore) Scan(ctx context.Context, pattern string) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		if ctx.Err() != nil {
+			yield("", ctx.Err())
+			return
+		}
+		var keys []string
+		err := m.locked("Scan", func() error {
+			now := time.Now().UnixNano()
+			for i := 0; i < m.slotCount; i++ {
+				s := m.slot(i)
+				if s[slotState] != slotUsed || now >= int64(binary.LittleEndian.Uint64(s[slotExpires:])) {
+					continue
+				}
+				if key := string(m.key(i)); matchGlob(pattern, key) {
+					keys = append(keys, key)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			yield("", err)
+			return
+		}
+		for _, key := range keys {
+			if !yield(key, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Close unmaps the file and closes it. The state stays in the file for the
+// other processes, and for the next process that opens it.
+func (m *MmapStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	if err := syscall.Munmap(m.data); err != nil {
+		return err
+	}
+	m.closed = true
+	m.data = nil
+	return m.file.Close()
+}
+
+// locked runs fn while holding the store's mutex and the file lock. Only a
+// closed store or a failure to take the lock is a backend error; fn's error
+// is returned as it is.
+func (m *MmapStore) locked(op string, fn func() error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return &BackendError{Backend: "mmap", Op: op, Err: os.ErrClosed}
+	}
+
+	fd := int(m.file.Fd())
+	if err := syscall.Flock(fd, syscall.LOCK_EX); err != nil {
+		return &BackendError{Backend: "mmap", Op: op, Err: err}
+	}
+	defer syscall.Flock(fd, syscall.LOCK_UN)
+	return fn()
+}
+
+// find returns key's slot and whether its entry is live at now, or -1 if
+// the key has no slot. The lock must be held.
+func (m *MmapStore) find(key string, now time.Time) (int, bool) {
+	hash := hashKey(key)
+	start := int(hash % uint64(m.slotCount))
+	for i := 0; i < m.slotCount; i++ {
+		slot := (start + i) % m.slotCount
+		s := m.slot(slot)
+		switch s[slotState] {
+		case slotEmpty:
+			return -1, false
+		case slotUsed:
+			if binary.LittleEndian.Uint64(s[slotHash:]) == hash && string(m.key(slot)) == key {
+				return slot, now.UnixNano() < int64(binary.LittleEndian.Uint64(s[slotExpires:]))
+			}
+		}
+	}
+	return -1, false
+}
+
+// put writes key's value into its slot, or into the first free or expired
+// slot on its probe path if it has none. The lock must be held.
+func (m *MmapStore) put(key, value string, expiration time.Time) error {
+	if slotData+len(key)+len(value) > m.slotSize {
+		return fmt.Errorf("key %s and its %d-byte value do not fit in a %d-byte slot", key, len(value), m.slotSize)
+	}
+
+	hash := hashKey(key)
+	now := time.Now().UnixNano()
+	start := int(hash % uint64(m.slotCount))
+	free := -1
+	target := -1
+	stop := -1
+	for i := 0; i < m.slotCount; i++ {
+		slot := (start + i) % m.slotCount
+		s := m.slot(slot)
+		state := s[slotState]
+		if state == slotUsed && binary.LittleEndian.Uint64(s[slotHash:]) == hash && string(m.key(slot)) == key {
+			target = slot
+			break
+		}
+		reusable := state != slotUsed || now >= int64(binary.LittleEndian.Uint64(s[slotExpires:]))
+		if reusable && free < 0 {
+			free = slot
+		}
+		if state == slotEmpty {
+			stop = slot
+			break
+		}
+	}
+	if target < 0 {
+		target = free
+	}
+	if target < 0 {
+		return fmt.Errorf("no free slot for key %s: store is full", key)
+	}
+
+	s := m.slot(target)
+	// Mark the slot unused while it is rewritten, so a crash part-way
+	// through leaves no torn entry behind
+	s[slotState] = slotDeleted
+	binary.LittleEndian.PutUint16(s[slotKeyLen:], uint16(len(key)))
+	binary.LittleEndian.PutUint32(s[slotValLen:], uint32(len(value)))
+	binary.LittleEndian.PutUint64(s[slotExpires:], uint64(expiration.UnixNano()))
+	binary.LittleEndian.PutUint64(s[slotHash:], hash)
+	copy(s[slotData:], key)
+	copy(s[slotData+len(key):], value)
+	s[slotState] = slotUsed
+
+	// Clear the dead entries the probe crossed just before the empty slot
+	if stop >= 0 {
+		m.reclaim((stop+m.slotCount-1)%m.slotCount, now)
+	}
+	return nil
+}
+
+// dead reports whether slot holds an entry no lookup needs: a deleted or
+// expired one.
+func (m *MmapStore) dead(slot int, now int64) bool {
+	s := m.slot(slot)
+	switch s[slotState] {
+	case slotDeleted:
+		return true
+	case slotUsed:
+		return now >= int64(binary.LittleEndian.Uint64(s[slotExpires:]))
+	}
+	return false
+}
+
+// reclaim marks the run of dead slots that slot is in as empty, if the run
+// ends at an empty slot or fills the whole table. No probe has to cross such
+// a run to reach a live key, since a probe stops at the empty slot anyway.
+// Without this, every slot ever written would stay on the probe path of
+// missing keys. The lock must be held.
+func (m *MmapStore) reclaim(slot int, now int64) {
+	if !m.dead(slot, now) {
+		return
+	}
+	end := slot
+	for n := 1; n < m.slotCount; n++ {
+		next := (end + 1) % m.slotCount
+		if m.slot(next)[slotState] == slotEmpty {
+			for i := end; m.dead(i, now); i = (i + m.slotCount - 1) % m.slotCount {
+				m.slot(i)[slotState] = slotEmpty
+			}
+			return
+		}
+		if !m.dead(next, now) {
+			return
+		}
+		end = next
+	}
+	for i := 0; i < m.slotCount; i++ {
+		m.slot(i)[slotState] = slotEmpty
+	}
+}
+
+func (m *MmapStore) slot(i int) []byte {
+	off := mmapHeaderSize + i*m.slotSize
+	return m.data[off : off+m.slotSize]
+}
+
+func (m *MmapStore) key(i int) []byte {
+	s := m.slot(i)
+	n := int(binary.LittleEndian.Uint16(s[slotKeyLen:]))
+	return s[slotData : slotData+n]
+}
+
+func (m *MmapStore) value(i int) []byte {
+	s := m.slot(i)
+	k := int(binary.LittleEndian.Uint16(s[slotKeyLen:]))
+	n := int(binary.LittleEndian.Uint32(s[slotValLen:]))
+	return s[slotData+k : slotData+k+n]
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
@@ -2,30 +2,88 @@ package store
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"iter"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 type RedisStore struct {
-	client *redis.Client
+	// KeyPrefix is prepended to every key, so several applications can
+	// share one Redis without their keys colliding.
+	KeyPrefix string
+	// HashTags wraps every key in a Cluster hash tag, {key}, unless it
+	// already has one. Keys built from the same tag land on the same
+	// Cluster slot, which scripts touching several keys need.
+	HashTags bool
+
+	client     redis.UniversalClient
+	ownsClient bool
+	codec      Codec
+}
+
+// RedisOptions configures a store built by NewRedisStoreWithOptions. The
+// embedded redis.UniversalOptions pick the kind of client: a Sentinel client
+// when MasterName is set, a Cluster client when there are several Addrs or
+// IsClusterMode is set, and a single-node client otherwise. TLSConfig, DB,
+// pool sizes and retries are passed through as they are.
+type RedisOptions struct {
+	redis.UniversalOptions
+
+	KeyPrefix string
+	HashTags  bool
 }
 
+// NewRedisStore connects to a single Redis server with a pool of 10
+// connections and up to 3 retries. Use NewRedisStoreWithOptions for other
+// settings, or NewRedisStoreFromClient to share an existing client.
 func NewRedisStore(addr, username, password string) (*RedisStore, error) {
 	if addr == "" {
 		return nil, fmt.Errorf("Redis address cannot be empty")
 	}
 
-	client := redis.NewClient(&redis.Options{
-		Addr:         addr,
-		Username:     username,
-		Password:     password,
-		MaxRetries:   3,
-		PoolSize:     10,
-		MinIdleConns: 5,
+	return NewRedisStoreWithOptions(RedisOptions{
+		UniversalOptions: redis.UniversalOptions{
+			Addrs:        []string{addr},
+			Username:     username,
+			Password:     password,
+			MaxRetries:   3,
+			PoolSize:     10,
+			MinIdleConns: 5,
+		},
 	})
+}
+
+// NewRedisStoreWithOptions builds a client from opts and checks that Redis
+// is reachable. The store closes the client when it is closed.
+func NewRedisStoreWithOptions(opts RedisOptions) (*RedisStore, error) {
+	if len(opts.Addrs) == 0 {
+		return nil, fmt.Errorf("Redis address cannot be empty")
+	}
+
+	client := redis.NewUniversalClient(&opts.UniversalOptions)
+	r, err := NewRedisStoreFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	r.KeyPrefix = opts.KeyPrefix
+	r.HashTags = opts.HashTags
+	r.ownsClient = true
+	return r, nil
+}
+
+// NewRedisStoreFromClient uses an existing client, such as the *redis.Client
+// or *redis.ClusterClient an application already has, and checks that Redis
+// is reachable. The client stays the caller's: closing the store does not
+// close it.
+func NewRedisStoreFromClient(client redis.UniversalClient) (*RedisStore, error) {
+	if client == nil {
+		return nil, fmt.Errorf("Redis client cannot be nil")
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -36,20 +94,33 @@ func NewRedisStore(addr, username, password string) (*RedisStore, error) {
 
 	return &RedisStore{
 		client: client,
+		codec:  JSONCodec{},
 	}, nil
 }
 
+// Codec returns the codec limiters use for state kept in this store.
+func (r *RedisStore) Codec() Codec {
+	return r.codec
+}
+
+// SetCodec changes how limiters encode their state in this store, for
+// example to BinaryCodec. State already written with another codec can no
+// longer be read and should be cleared first.
+func (r *RedisStore) SetCodec(codec Codec) {
+	r.codec = codec
+}
+
 func (r *RedisStore) Get(ctx context.Context, key string) (interface{}, error) {
 	if key == "" {
 		return nil, fmt.Errorf("key cannot be empty")
 	}
 
-	val, err := r.client.Get(ctx, key).Result()
+	val, err := r.client.Get(ctx, r.Key(key)).Result()
 	if err == redis.Nil {
-		return nil, fmt.Errorf("key not found")
+		return nil, ErrNotFound
 	}
 	if err != nil {
-		return nil, fmt.Errorf("Redis Get error: %w", err)
+		return nil, &BackendError{Backend: "Redis", Op: "Get", Err: err}
 	}
 
 	return val, nil
@@ -63,13 +134,243 @@ func (r *RedisStore) Set(ctx context.Context, key string, value interface{}, ttl
 		return fmt.Errorf("value cannot be nil")
 	}
 
-	jsonData, err := json.Marshal(value)
+	data, err := marshal(value)
 	if err != nil {
-		return fmt.Errorf("failed to marshal value: %w", err)
+		return err
 	}
 
-	if err := r.client.Set(ctx, key, string(jsonData), ttl).Err(); err != nil {
-		return fmt.Errorf("Redis Set error: %w", err)
+	if err := r.client.Set(ctx, r.Key(key), data, ttl).Err(); err != nil {
+		return &BackendError{Backend: "Redis", Op: "Set", Err: err}
+	}
+	return nil
+}
+
+// updateAttempts is how many times Update tries before giving up on a key
+// that other clients keep changing.
+const updateAttempts = 16
+
+// Update runs fn on key's value in an optimistic transaction. The key is
+// WATCHed while it is read and fn decides, and the write only goes through
+// if no other client changed the key in between. Otherwise Update starts
+// over, so fn may be called more than once.
+func (r *RedisStore) Update(ctx context.Context, key string, fn UpdateFunc) error {
+	if key == "" {
+		return fmt.Errorf("key cannot be empty")
+	}
+
+	rkey := r.Key(key)
+	// Errors from fn and from encoding end the transaction like any other,
+	// but are returned as they are rather than as backend errors
+	var callerErr error
+	txf := func(tx *redis.Tx) error {
+		var current interface{}
+		val, err := tx.Get(ctx, rkey).Result()
+		if err == nil {
+			current = val
+		} else if err != redis.Nil {
+			return err
+		}
+
+		next, ttl, err := fn(current)
+		if err == nil && next != nil && ttl <= 0 {
+			err = fmt.Errorf("TTL must be greater than 0")
+		}
+		if err != nil || next == nil {
+			callerErr = err
+			return nil
+		}
+		data, err := marshal(next)
+		if err != nil {
+			callerErr = err
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, rkey, data, ttl)
+			return nil
+		})
+		return err
+	}
+
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		callerErr = nil
+		err := r.client.Watch(ctx, txf, rkey)
+		if callerErr != nil {
+			return callerErr
+		}
+		if err == nil {
+			return nil
+		}
+		if err != redis.TxFailedErr {
+			return &BackendError{Backend: "Redis", Op: "Update", Err: err}
+		}
+	}
+	return fmt.Errorf("key %s changed during each of %d update attempts", key, updateAttempts)
+}
+
+// UpdateMany runs fn on the values of keys under one WATCH and writes its
+// entries in one MULTI/EXEC, retrying when another client changes one of
+// the keys in between, as Update does for one key.
+//
+// A Cluster can only WATCH keys in one slot, so there the keys are grouped
+// by hash tag, or by whole key for keys without one, and each group is
+// updated on its own. The batch is then only atomic within a hash tag: keys
+// without one, or with HashTags set, get a transaction each, which is no
+// faster than an Update per key. Give keys that are batched together a
+// shared tag, such as "{tenant1}:alice", to update them in one step.
+func (r *RedisStore) UpdateMany(ctx context.Context, keys []string, fn UpdateManyFunc) error {
+	for _, key := range keys {
+		if key == "" {
+			return fmt.Errorf("key cannot be empty")
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	groups := [][]int{allIndexes(len(keys))}
+	if _, ok := r.client.(*redis.ClusterClient); ok {
+		groups = groups[:0]
+		bySlot := make(map[string]int)
+		for i, key := range keys {
+			tag := hashTag(r.Key(key))
+			g, ok := bySlot[tag]
+			if !ok {
+				g = len(groups)
+				bySlot[tag] = g
+				groups = append(groups, nil)
+			}
+			groups[g] = append(groups[g], i)
+		}
+	}
+	for _, indexes := range groups {
+		if err := r.updateGroup(ctx, keys, indexes, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateGroup is UpdateMany for the keys at indexes, which must all be in
+// one slot.
+func (r *RedisStore) updateGroup(ctx context.Context, keys []string, indexes []int, fn UpdateManyFunc) error {
+	rkeys := make([]string, len(indexes))
+	for j, i := range indexes {
+		rkeys[j] = r.Key(keys[i])
+	}
+
+	// As in Update, errors from fn and from encoding are returned as they
+	// are rather than as backend errors
+	var callerErr error
+	txf := func(tx *redis.Tx) error {
+		cmds := make([]*redis.StringCmd, len(rkeys))
+		_, err := tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for j, rkey := range rkeys {
+				cmds[j] = pipe.Get(ctx, rkey)
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		values := make([]interface{}, len(cmds))
+		for j, cmd := range cmds {
+			if val, err := cmd.Result(); err == nil {
+				values[j] = val
+			}
+		}
+
+		entries, err := fn(indexes, values)
+		if err == nil {
+			entries, err = checkBatch(keys, indexes, entries)
+		}
+		if err != nil || len(entries) == 0 {
+			callerErr = err
+			return nil
+		}
+		data := make([]string, len(entries))
+		for i, e := range entries {
+			if data[i], err = marshal(e.Value); err != nil {
+				callerErr = err
+				return nil
+			}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, e := range entries {
+				pipe.Set(ctx, r.Key(e.Key), data[i], e.TTL)
+			}
+			return nil
+		})
+		return err
+	}
+
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		callerErr = nil
+		err := r.client.Watch(ctx, txf, rkeys...)
+		if callerErr != nil {
+			return callerErr
+		}
+		if err == nil {
+			return nil
+		}
+		if err != redis.TxFailedErr {
+			return &BackendError{Backend: "Redis", Op: "UpdateMany", Err: err}
+		}
+	}
+	return fmt.Errorf("keys changed during each of %d update attempts", updateAttempts)
+}
+
+// GetMany reads keys with one pipeline of GETs, which, unlike MGET, works
+// when the keys are spread over several Cluster nodes.
+func (r *RedisStore) GetMany(ctx context.Context, keys []string) ([]interface{}, error) {
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("key cannot be empty")
+		}
+	}
+
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Get(ctx, r.Key(key))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, &BackendError{Backend: "Redis", Op: "GetMany", Err: err}
+	}
+
+	values := make([]interface{}, len(keys))
+	for i, cmd := range cmds {
+		if val, err := cmd.Result(); err == nil {
+			values[i] = val
+		}
+	}
+	return values, nil
+}
+
+// SetMany writes entries with one pipeline of SETs.
+func (r *RedisStore) SetMany(ctx context.Context, entries []Entry) error {
+	if err := checkEntries(entries); err != nil {
+		return err
+	}
+	data := make([]string, len(entries))
+	for i, e := range entries {
+		var err error
+		if data[i], err = marshal(e.Value); err != nil {
+			return err
+		}
+	}
+
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, e := range entries {
+			pipe.Set(ctx, r.Key(e.Key), data[i], e.TTL)
+		}
+		return nil
+	})
+	if err != nil {
+		return &BackendError{Backend: "Redis", Op: "SetMany", Err: err}
 	}
 	return nil
 }
@@ -79,12 +380,12 @@ func (r *RedisStore) Delete(ctx context.Context, key string) error {
 		return fmt.Errorf("key cannot be empty")
 	}
 
-	deleted, err := r.client.Del(ctx, key).Result()
+	deleted, err := r.client.Del(ctx, r.Key(key)).Result()
 	if err != nil {
-		return fmt.Errorf("Redis Delete error: %w", err)
+		return &BackendError{Backend: "Redis", Op: "Delete", Err: err}
 	}
 	if deleted == 0 {
-		return fmt.Errorf("key not found")
+		return ErrNotFound
 	}
 	return nil
 }
@@ -94,13 +395,223 @@ func (r *RedisStore) Exists(ctx context.Context, key string) (bool, error) {
 		return false, fmt.Errorf("key cannot be empty")
 	}
 
-	exists, err := r.client.Exists(ctx, key).Result()
+	exists, err := r.client.Exists(ctx, r.Key(key)).Result()
 	if err != nil {
-		return false, fmt.Errorf("Redis Exists error: %w", err)
+		return false, &BackendError{Backend: "Redis", Op: "Exists", Err: err}
 	}
 	return exists > 0, nil
 }
 
+// Script is a Lua script that RedisStore runs on the server, where it reads
+// and writes its keys in one atomic step.
+type Script struct {
+	script *redis.Script
+}
+
+func NewScript(src string) *Script {
+	return &Script{script: redis.NewScript(src)}
+}
+
+// Eval runs script with the given keys and arguments. The script is sent by
+// its SHA1 and only loaded into Redis when it is not cached there yet. A nil
+// reply from the script is returned as a nil value, not an error. Keys are
+// mapped with Key, like those of every other method.
+func (r *RedisStore) Eval(ctx context.Context, script *Script, keys []string, args ...interface{}) (interface{}, error) {
+	mapped := make([]string, len(keys))
+	for i, key := range keys {
+		mapped[i] = r.Key(key)
+	}
+	val, err := script.script.Run(ctx, r.client, mapped, args...).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &BackendError{Backend: "Redis", Op: "Eval", Err: err}
+	}
+	return val, nil
+}
+
+// ScriptCall is one run of a script by EvalMany.
+type ScriptCall struct {
+	Keys []string
+	Args []interface{}
+}
+
+// EvalMany runs script once for each call, all in one pipeline, and returns
+// the replies in the same order. Each run is atomic on its own; other
+// clients' commands may run between them. If Redis does not have the script
+// cached yet, it is loaded and the runs that failed for lack of it are sent
+// again.
+func (r *RedisStore) EvalMany(ctx context.Context, script *Script, calls []ScriptCall) ([]interface{}, error) {
+	cmds := make([]*redis.Cmd, len(calls))
+	run := func(indexes []int) error {
+		_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, i := range indexes {
+				keys := make([]string, len(calls[i].Keys))
+				for j, key := range calls[i].Keys {
+					keys[j] = r.Key(key)
+				}
+				cmds[i] = script.script.EvalSha(ctx, pipe, keys, calls[i].Args...)
+			}
+			return nil
+		})
+		return err
+	}
+
+	pending := make([]int, len(calls))
+	for i := range pending {
+		pending[i] = i
+	}
+	if err := run(pending); redis.HasErrorPrefix(err, "NOSCRIPT") {
+		if err := script.script.Load(ctx, r.client).Err(); err != nil {
+			return nil, &BackendError{Backend: "Redis", Op: "EvalMany", Err: err}
+		}
+		pending = pending[:0]
+		for i, cmd := range cmds {
+			if redis.HasErrorPrefix(cmd.Err(), "NOSCRIPT") {
+				pending = append(pending, i)
+			}
+		}
+		run(pending)
+	}
+
+	replies := make([]interface{}, len(calls))
+	for i, cmd := range cmds {
+		val, err := cmd.Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, &BackendError{Backend: "Redis", Op: "EvalMany", Err: err}
+		}
+		replies[i] = val
+	}
+	return replies, nil
+}
+
+// Ping checks that Redis is reachable.
+func (r *RedisStore) Ping(ctx context.Context) error {
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		return &BackendError{Backend: "Redis", Op: "Ping", Err: err}
+	}
+	return nil
+}
+
+// Scan yields the keys matching pattern using SCAN, a page at a time, so
+// Redis is never blocked the way KEYS blocks it. On a Cluster every master
+// is scanned in turn. Keys are yielded without KeyPrefix and without the
+// hash tag HashTags added. As with SCAN itself, a key may be yielded more
+// than once.
+func (r *RedisStore) Scan(ctx context.Context, pattern string) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		nodes, err := r.masters(ctx)
+		if err != nil {
+			yield("", &BackendError{Backend: "Redis", Op: "Scan", Err: err})
+			return
+		}
+
+		match := escapeGlob(r.KeyPrefix) + pattern
+		if r.HashTags {
+			// Only some keys had a hash tag added, so the pattern is
+			// matched once it has been removed
+			match = escapeGlob(r.KeyPrefix) + "*"
+		}
+		for _, node := range nodes {
+			var cursor uint64
+			for {
+				keys, next, err := node.Scan(ctx, cursor, match, scanCount).Result()
+				if err != nil {
+					yield("", &BackendError{Backend: "Redis", Op: "Scan", Err: err})
+					return
+				}
+				for _, k := range keys {
+					key, ok := r.unkey(k)
+					if !ok || (r.HashTags && !matchGlob(pattern, key)) {
+						continue
+					}
+					if !yield(key, nil) {
+						return
+					}
+				}
+				if next == 0 {
+					break
+				}
+				cursor = next
+			}
+		}
+	}
+}
+
+// scanCount is how many keys each SCAN call asks Redis to look at.
+const scanCount = 1000
+
+// masters returns the clients to scan: each master of a Cluster, or the
+// store's own client.
+func (r *RedisStore) masters(ctx context.Context) ([]redis.Cmdable, error) {
+	cluster, ok := r.client.(*redis.ClusterClient)
+	if !ok {
+		return []redis.Cmdable{r.client}, nil
+	}
+	var mu sync.Mutex
+	var nodes []redis.Cmdable
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		mu.Lock()
+		defer mu.Unlock()
+		nodes = append(nodes, node)
+		return nil
+	})
+	return nodes, err
+}
+
+// unkey reverses Key, reporting false for a key without KeyPrefix. A key
+// that had a hash tag of its own and one wrapped in a tag by Key can look
+// alike; both name the same Redis key.
+func (r *RedisStore) unkey(k string) (string, bool) {
+	key, ok := strings.CutPrefix(k, r.KeyPrefix)
+	if !ok {
+		return "", false
+	}
+	if r.HashTags && len(key) > 2 && key[0] == '{' && key[len(key)-1] == '}' {
+		if inner := key[1 : len(key)-1]; !hasHashTag(inner) {
+			key = inner
+		}
+	}
+	return key, true
+}
+
+// Key returns the Redis key that key is stored under, with KeyPrefix and,
+// if HashTags is set, a hash tag added.
+func (r *RedisStore) Key(key string) string {
+	if r.HashTags && !hasHashTag(key) {
+		key = "{" + key + "}"
+	}
+	return r.KeyPrefix + key
+}
+
+// hasHashTag reports whether Redis Cluster would hash only part of key: the
+// text between its first { and the next }, if that is not empty.
+func hasHashTag(key string) bool {
+	return hashTag(key) != key
+}
+
+// hashTag returns the part of key that Redis Cluster hashes to pick its
+// slot: its hash tag, or the whole key if it has none.
+func hashTag(key string) string {
+	open := strings.IndexByte(key, '{')
+	if open < 0 {
+		return key
+	}
+	end := strings.IndexByte(key[open+1:], '}')
+	if end <= 0 {
+		return key
+	}
+	return key[open+1 : open+1+end]
+}
+
+// Close closes the client, unless it was passed to NewRedisStoreFromClient.
 func (r *RedisStore) Close() error {
+	if !r.ownsClient {
+		return nil
+	}
 	return r.client.Close()
 }
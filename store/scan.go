@@ -0,0 +1,143 @@
+package store
+
+import (
+	"context"
+	"iter"
+	"strings"
+)
+
+// Scanner is implemented by stores that can list their keys, for example to
+// find the keys currently being limited or to reset every key of a tenant.
+type Scanner interface {
+	// Scan yields the live keys that match pattern, a glob in which *
+	// matches any run of characters, ? any single character, [abc] or [a-z]
+	// one character of a set ([^abc] one outside it) and \ escapes the
+	// character after it. PrefixPattern builds one matching a prefix.
+	//
+	// Keys come in no particular order, and keys written or deleted while
+	// the scan runs may or may not be yielded. The first error ends the
+	// scan and is yielded with an empty key.
+	Scan(ctx context.Context, pattern string) iter.Seq2[string, error]
+}
+
+// globSpecial holds the characters with a meaning in a Scan pattern.
+const globSpecial = `*?[\`
+
+// PrefixPattern returns a Scan pattern matching every key that starts with
+// prefix.
+func PrefixPattern(prefix string) string {
+	return escapeGlob(prefix) + "*"
+}
+
+// escapeGlob escapes s so that a pattern matches it literally.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(globSpecial, s[i]) >= 0 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// globPrefix returns the literal text pattern starts with, up to its first
+// special character, so that backends can narrow a scan before matching.
+func globPrefix(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c == '\\' && i+1 < len(pattern) {
+			i++
+			b.WriteByte(pattern[i])
+			continue
+		}
+		if strings.IndexByte(globSpecial, c) >= 0 {
+			break
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// matchGlob reports whether s matches pattern, with the same rules as the
+// MATCH option of Redis's SCAN, so every store filters keys alike.
+//
+// It backtracks only to the last * seen, letting it swallow one more
+// character of s each time the rest of the pattern fails, so patterns with
+// many stars take time proportional to len(pattern)*len(s) at most.
+func matchGlob(pattern, s string) bool {
+	p, i := 0, 0
+	starP, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starP, starI = p+1, i
+				p++
+				continue
+			case '?':
+				p, i = p+1, i+1
+				continue
+			case '[':
+				if matched, rest := matchClass(pattern[p+1:], s[i]); matched {
+					p, i = len(pattern)-len(rest), i+1
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) {
+					p++
+				}
+				fallthrough
+			default:
+				if pattern[p] == s[i] {
+					p, i = p+1, i+1
+					continue
+				}
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		starI++
+		p, i = starP, starI
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches c against the set at the start of p, the part of a
+// pattern after its [, and returns the rest of the pattern after the set.
+func matchClass(p string, c byte) (bool, string) {
+	negate := len(p) > 0 && p[0] == '^'
+	if negate {
+		p = p[1:]
+	}
+	matched := false
+	for len(p) > 0 && p[0] != ']' {
+		if p[0] == '\\' && len(p) > 1 {
+			p = p[1:]
+		}
+		lo, hi := p[0], p[0]
+		p = p[1:]
+		if len(p) > 1 && p[0] == '-' && p[1] != ']' {
+			if p[1] == '\\' && len(p) > 2 {
+				p = p[1:]
+			}
+			hi = p[1]
+			p = p[2:]
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	if len(p) > 0 {
+		p = p[1:]
+	}
+	return matched != negate, p
+}
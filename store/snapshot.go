@@ -0,0 +1,188 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotVersion is written at the start of every snapshot, so that a
+// format change can be detected instead of misread.
+const snapshotVersion = 1
+
+// How a value is written in a snapshot.
+const (
+	snapshotBytes  = iota // []byte, as it is
+	snapshotString        // string, as it is
+	snapshotBinary        // encoding.BinaryMarshaler, restored as []byte
+	snapshotGob           // any other value, registered with gob.Register
+)
+
+type snapshot struct {
+	Version int
+	Entries []snapshotEntry
+}
+
+type snapshotEntry struct {
+	Key        string
+	Expiration time.Time
+	Encoding   uint8
+	Data       []byte
+}
+
+// Snapshot writes every live entry and its expiration to w, in a gob-based
+// format read by Restore. Shards are copied one at a time, so requests keep
+// being served while the snapshot is written.
+//
+// Limiter state implements encoding.BinaryMarshaler and is written in its
+// binary format. []byte and string values are written as they are, and any
+// other value with gob, which needs its type registered with gob.Register.
+func (ms *MemoryStore) Snapshot(w io.Writer) error {
+	snap := snapshot{Version: snapshotVersion}
+	now := time.Now()
+	for _, shard := range ms.shards {
+		shard.mu.Lock()
+		for _, e := range shard.data {
+			if now.After(e.expiration) {
+				continue
+			}
+			enc, data, err := encodeSnapshotValue(e.value)
+			if err != nil {
+				shard.mu.Unlock()
+				return fmt.Errorf("failed to snapshot key %s: %w", e.key, err)
+			}
+			snap.Entries = append(snap.Entries, snapshotEntry{
+				Key:        e.key,
+				Expiration: e.expiration,
+				Encoding:   enc,
+				Data:       data,
+			})
+		}
+		shard.mu.Unlock()
+	}
+
+	if err := gob.NewEncoder(w).Encode(&snap); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// Restore reads a snapshot written by Snapshot into the store, replacing
+// keys it already holds. Entries that have expired since the snapshot was
+// taken are skipped, and the rest keep their original expiration.
+//
+// State that was written in its binary format is restored as []byte and
+// decoded by the limiter the first time the key is used.
+func (ms *MemoryStore) Restore(r io.Reader) error {
+	var snap snapshot
+	if err := gob.NewDecoder(r).Decode(&snap); err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+
+	now := time.Now()
+	for _, se := range snap.Entries {
+		if se.Key == "" || now.After(se.Expiration) {
+			continue
+		}
+		value, err := decodeSnapshotValue(se.Encoding, se.Data)
+		if err != nil {
+			return fmt.Errorf("failed to restore key %s: %w", se.Key, err)
+		}
+		shard := ms.shard(se.Key)
+		shard.mu.Lock()
+		ms.put(shard, se.Key, value, se.Expiration)
+		shard.mu.Unlock()
+	}
+	return nil
+}
+
+// SnapshotFile writes a snapshot to path. It is written to a temporary file
+// in the same directory first and renamed over path once complete, so path
+// always holds a whole snapshot, even if the process dies while writing.
+func (ms *MemoryStore) SnapshotFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	// Removing the temporary file fails harmlessly once it has been renamed
+	defer os.Remove(tmp.Name())
+
+	buf := bufio.NewWriter(tmp)
+	err = ms.Snapshot(buf)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace snapshot file: %w", err)
+	}
+	return nil
+}
+
+// RestoreFile restores a snapshot written by SnapshotFile. A missing file is
+// not an error, so a service can call it on every start, including its
+// first.
+func (ms *MemoryStore) RestoreFile(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer f.Close()
+	return ms.Restore(bufio.NewReader(f))
+}
+
+func encodeSnapshotValue(value interface{}) (uint8, []byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return snapshotBytes, v, nil
+	case string:
+		return snapshotString, []byte(v), nil
+	case encoding.BinaryMarshaler:
+		data, err := v.MarshalBinary()
+		return snapshotBinary, data, err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&value); err != nil {
+		return 0, nil, err
+	}
+	return snapshotGob, buf.Bytes(), nil
+}
+
+func decodeSnapshotValue(enc uint8, data []byte) (interface{}, error) {
+	switch enc {
+	case snapshotBytes, snapshotBinary:
+		return data, nil
+	case snapshotString:
+		return string(data), nil
+	case snapshotGob:
+		var value interface{}
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	default:
+		return nil, fmt.Errorf("unknown value encoding %d", enc)
+	}
+}
@@ -18,3 +18,17 @@ type Store interface {
 	// Exists checks if a key exists
 	Exists(ctx context.Context, key string) (bool, error)
 }
+
+// UpdateFunc receives a key's current value, or nil when it has none, and
+// returns the value to store with its TTL. Returning a nil value leaves the
+// key as it was.
+type UpdateFunc func(current interface{}) (next interface{}, ttl time.Duration, err error)
+
+// Updater is implemented by stores that can read and write a key in one
+// atomic step, so limiters in different processes sharing the store cannot
+// interleave their reads and writes.
+type Updater interface {
+	// Update runs fn on key's current value and stores the result. Nothing
+	// is written when fn returns a nil value or an error.
+	Update(ctx context.Context, key string, fn UpdateFunc) error
+}
@@ -0,0 +1,202 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Typed wraps a Store for one type of limiter state. Values of T go in
+// encoded with the store's codec and come back decoded, and a value that
+// cannot be decoded is reported as an error rather than treated as missing.
+type Typed[T any] struct {
+	store Store
+	codec Codec
+}
+
+// NewTyped wraps s, encoding state with CodecOf(s).
+func NewTyped[T any](s Store) *Typed[T] {
+	return NewTypedCodec[T](s, CodecOf(s))
+}
+
+// NewTypedCodec wraps s, encoding state with codec.
+func NewTypedCodec[T any](s Store, codec Codec) *Typed[T] {
+	return &Typed[T]{store: s, codec: codec}
+}
+
+// Store returns the wrapped store.
+func (t *Typed[T]) Store() Store {
+	return t.store
+}
+
+// Get returns key's state, or nil if the key has none. Any error other than
+// ErrNotFound, such as a backend outage, is returned.
+func (t *Typed[T]) Get(ctx context.Context, key string) (*T, error) {
+	data, err := t.store.Get(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t.decode(key, data)
+}
+
+// Set stores v under key for ttl.
+func (t *Typed[T]) Set(ctx context.Context, key string, v *T, ttl time.Duration) error {
+	data, err := t.encode(key, v)
+	if err != nil {
+		return err
+	}
+	return t.store.Set(ctx, key, data, ttl)
+}
+
+// Update is store.Updater's Update for typed state: fn gets key's state, or
+// nil if it has none, and returns the state to write back, or nil to leave
+// the key alone. It is atomic when the wrapped store is a store.Updater, and
+// a Get followed by a Set otherwise.
+func (t *Typed[T]) Update(ctx context.Context, key string, fn func(current *T) (next *T, ttl time.Duration, err error)) error {
+	raw := func(data interface{}) (interface{}, time.Duration, error) {
+		current, err := t.decode(key, data)
+		if err != nil {
+			return nil, 0, err
+		}
+		next, ttl, err := fn(current)
+		if err != nil || next == nil {
+			return nil, 0, err
+		}
+		encoded, err := t.encode(key, next)
+		if err != nil {
+			return nil, 0, err
+		}
+		return encoded, ttl, nil
+	}
+
+	if u, ok := t.store.(Updater); ok {
+		return u.Update(ctx, key, raw)
+	}
+
+	current, err := t.store.Get(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		current = nil
+	} else if err != nil {
+		return err
+	}
+	next, ttl, err := raw(current)
+	if err != nil || next == nil {
+		return err
+	}
+	return t.store.Set(ctx, key, next, ttl)
+}
+
+// UpdateMany runs fn on the state of each of keys, in order, and writes back
+// the states it returns. When the store is a BatchUpdater, the whole batch
+// is one UpdateMany, as atomic as Update is for one key; fn may then be
+// called again for keys another client changed in between. A Batcher that
+// is not an Updater has every state read with one GetMany and written with
+// one SetMany, which is not atomic, so the caller must keep other writers
+// off the keys. Any other store gets an Update for each key in turn.
+//
+// fn gets the index of the key in keys and its state, or nil if it has none.
+// A key listed more than once gets its state as the call before left it.
+func (t *Typed[T]) UpdateMany(ctx context.Context, keys []string, fn func(i int, current *T) (next *T, ttl time.Duration, err error)) error {
+	raw := func(indexes []int, values []interface{}) ([]Entry, error) {
+		states := make(map[string]*T, len(indexes))
+		pending := make(map[string]int)
+		var entries []Entry
+		for j, i := range indexes {
+			key := keys[i]
+			current, seen := states[key]
+			if !seen {
+				var err error
+				if current, err = t.decode(key, values[j]); err != nil {
+					return nil, err
+				}
+			}
+			next, ttl, err := fn(i, current)
+			if err != nil {
+				return nil, err
+			}
+			if next == nil {
+				states[key] = current
+				continue
+			}
+			states[key] = next
+			if k, ok := pending[key]; ok {
+				entries[k].TTL = ttl
+				continue
+			}
+			pending[key] = len(entries)
+			entries = append(entries, Entry{Key: key, TTL: ttl})
+		}
+		for k := range entries {
+			var err error
+			if entries[k].Value, err = t.encode(entries[k].Key, states[entries[k].Key]); err != nil {
+				return nil, err
+			}
+		}
+		return entries, nil
+	}
+
+	if u, ok := t.store.(BatchUpdater); ok {
+		return u.UpdateMany(ctx, keys, raw)
+	}
+	_, updater := t.store.(Updater)
+	b, batcher := t.store.(Batcher)
+	if updater || !batcher {
+		for i, key := range keys {
+			err := t.Update(ctx, key, func(current *T) (*T, time.Duration, error) {
+				return fn(i, current)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	values, err := b.GetMany(ctx, keys)
+	if err != nil {
+		return err
+	}
+	entries, err := raw(allIndexes(len(keys)), values)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	return b.SetMany(ctx, entries)
+}
+
+// Delete removes key.
+func (t *Typed[T]) Delete(ctx context.Context, key string) error {
+	return t.store.Delete(ctx, key)
+}
+
+// Exists reports whether key has state.
+func (t *Typed[T]) Exists(ctx context.Context, key string) (bool, error) {
+	return t.store.Exists(ctx, key)
+}
+
+func (t *Typed[T]) decode(key string, data interface{}) (*T, error) {
+	if data == nil {
+		return nil, nil
+	}
+	// a store holding Go values, such as MemoryStore, hands back the state
+	// itself
+	if v, ok := data.(*T); ok {
+		return v, nil
+	}
+	v := new(T)
+	if err := t.codec.Decode(data, v); err != nil {
+		return nil, fmt.Errorf("failed to decode state for key %s: %w", key, err)
+	}
+	return v, nil
+}
+
+func (t *Typed[T]) encode(key string, v *T) (interface{}, error) {
+	data, err := t.codec.Encode(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode state for key %s: %w", key, err)
+	}
+	return data, nil
+}